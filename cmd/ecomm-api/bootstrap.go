@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/util"
+)
+
+// bootstrapAdmin creates the first admin account. It refuses to run once an
+// admin exists, so it can't be used to escalate privileges later on. The
+// password is read from ADMIN_PASSWORD to keep it out of the shell history.
+func bootstrapAdmin(ctx context.Context, st *storer.MySQLStorer, policy *util.PasswordPolicy, args []string) error {
+	fs := flag.NewFlagSet("bootstrap-admin", flag.ExitOnError)
+	name := fs.String("name", "Admin", "Name of the admin user")
+	email := fs.String("email", "", "Email of the admin user")
+	fs.Parse(args)
+
+	password := os.Getenv("ADMIN_PASSWORD")
+	if *email == "" || password == "" {
+		return fmt.Errorf("-email and the ADMIN_PASSWORD environment variable are required")
+	}
+	if err := policy.Validate(password, *email); err != nil {
+		return err
+	}
+	hashed, err := util.HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	_, err = st.CreateFirstAdmin(ctx, &storer.User{Name: *name, Email: *email, Password: hashed})
+	if errors.Is(err, storer.ErrConflict) {
+		return fmt.Errorf("an admin or a user with this email already exists, grant the role through the API instead")
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/server"
+)
+
+// idempotencyKeyDeleteBatch is how many expired idempotency keys a single
+// statement deletes.
+const idempotencyKeyDeleteBatch = 1000
+
+// deleteExpiredIdempotencyKeys deletes expired idempotency keys every
+// interval until ctx is done. Failures are logged and retried on the next
+// tick, expired keys are never replayed so they only take up space.
+func deleteExpiredIdempotencyKeys(ctx context.Context, srv *server.Server, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var deleted int64
+		for {
+			n, err := srv.DeleteExpiredIdempotencyKeys(ctx, time.Now(), idempotencyKeyDeleteBatch)
+			deleted += n
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.ErrorContext(ctx, "failed to delete expired idempotency keys", "error", err)
+				}
+				break
+			}
+			if n < idempotencyKeyDeleteBatch {
+				break
+			}
+		}
+		if deleted > 0 {
+			slog.InfoContext(ctx, "deleted expired idempotency keys", "count", deleted)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/rbac"
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/hellwind2019/ecomm/util"
+)
+
+// API keys look like ek_<prefix>.<secret>. The prefix is stored in plaintext
+// to find the key, the whole key only as a hash.
+const apiKeyPrefix = "ek_"
+
+// apiKeyTouchInterval is how stale last_used_at may get, so busy integrations
+// don't write to the key on every request.
+const apiKeyTouchInterval = 5 * time.Minute
+
+// /api-keys
+func (h *Handler) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	var req CreateAPIKeyRequest
+	if !decodeAndValidate(w, r, &req) {
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !rbac.IsPermission(scope) {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("Unknown scope %s", scope))
+			return
+		}
+		// nobody can hand out more than they have
+		if !claims.HasPermission(scope) {
+			writeProblem(w, http.StatusForbidden, CodeMissingPermission, fmt.Sprintf("Cannot grant scope %s", scope))
+			return
+		}
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Expiry must be in the future")
+		return
+	}
+	ownerID := req.OwnerID
+	if ownerID == 0 {
+		ownerID = claims.ID
+	}
+	if _, err := h.server.GetUserByID(ctx, ownerID); err != nil {
+		writeProblem(w, http.StatusUnprocessableEntity, CodeInvalidReference, "Owner does not exist")
+		return
+	}
+
+	prefix, err := util.RandomToken(6)
+	if err != nil {
+		writeError(w, err, "Failed to generate api key")
+		return
+	}
+	secret, err := util.RandomToken(32)
+	if err != nil {
+		writeError(w, err, "Failed to generate api key")
+		return
+	}
+	key := apiKeyPrefix + prefix + "." + secret
+	k, err := h.server.CreateAPIKey(ctx, &storer.APIKey{
+		Prefix:    prefix,
+		KeyHash:   util.HashToken(key),
+		Name:      req.Name,
+		OwnerID:   ownerID,
+		Scopes:    strings.Join(req.Scopes, ","),
+		ExpiresAt: req.ExpiresAt,
+		CreatedBy: &claims.ID,
+	})
+	if err != nil {
+		writeError(w, err, "Failed to create api key")
+		return
+	}
+	k.CreatedAt = time.Now()
+	res := CreateAPIKeyResponse{APIKeyResponse: toAPIKeyResponse(k), Key: key}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+func (h *Handler) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	keys, err := h.server.ListAPIKeys(ctx)
+	if err != nil {
+		writeError(w, err, "Failed to list api keys")
+		return
+	}
+	res := ListAPIKeysResponse{APIKeys: []APIKeyResponse{}}
+	for _, k := range keys {
+		res.APIKeys = append(res.APIKeys, toAPIKeyResponse(&k))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// /api-keys/{id}
+func (h *Handler) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	i, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Error parsing ID")
+		return
+	}
+	k, err := h.server.GetAPIKey(ctx, i)
+	if err != nil {
+		writeError(w, err, "Failed to get api key")
+		return
+	}
+	if err := h.server.RevokeAPIKey(ctx, k, &claims.ID); err != nil {
+		writeError(w, err, "Failed to revoke api key")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyAPIKey resolves a key into claims for its owner. The permissions are
+// the key's scopes that the owner still holds, so removing a role from the
+// owner also narrows their keys.
+func (h *Handler) verifyAPIKey(ctx context.Context, key string) (*token.UserClaims, error) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return nil, fmt.Errorf("malformed key")
+	}
+	prefix, _, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, fmt.Errorf("malformed key")
+	}
+	k, err := h.server.GetAPIKeyByPrefix(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("unknown key")
+	}
+	if !util.TokensEqual(k.KeyHash, util.HashToken(key)) {
+		return nil, fmt.Errorf("unknown key")
+	}
+	if k.RevokedAt != nil {
+		return nil, fmt.Errorf("key is revoked")
+	}
+	if k.ExpiresAt != nil && k.ExpiresAt.Before(time.Now()) {
+		return nil, fmt.Errorf("key is expired")
+	}
+	owner, err := h.server.GetUserByID(ctx, k.OwnerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key owner: %w", err)
+	}
+	roles, ownerPermissions, _, err := h.userAccess(ctx, owner.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key owner roles: %w", err)
+	}
+	permissions := []string{}
+	for _, scope := range splitScopes(k.Scopes) {
+		if slices.Contains(ownerPermissions, scope) {
+			permissions = append(permissions, scope)
+		}
+	}
+	if k.LastUsedAt == nil || time.Since(*k.LastUsedAt) >= apiKeyTouchInterval {
+		if err := h.server.TouchAPIKey(ctx, k.ID); err != nil {
+			return nil, err
+		}
+	}
+	return &token.UserClaims{
+		ID:          owner.ID,
+		Email:       owner.Email,
+		Roles:       roles,
+		Permissions: permissions,
+		APIKeyID:    k.ID,
+	}, nil
+}
+func toAPIKeyResponse(k *storer.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:         k.ID,
+		Name:       k.Name,
+		Prefix:     apiKeyPrefix + k.Prefix,
+		OwnerID:    k.OwnerID,
+		Scopes:     splitScopes(k.Scopes),
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+		RevokedAt:  k.RevokedAt,
+		CreatedAt:  k.CreatedAt,
+	}
+}
+func splitScopes(scopes string) []string {
+	if scopes == "" {
+		return []string{}
+	}
+	return strings.Split(scopes, ",")
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hellwind2019/ecomm/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	const key = apiKeyPrefix + "abcd1234.secret"
+	apiKeyColumns := []string{"id", "prefix", "key_hash", "name", "owner_id", "scopes", "expires_at", "last_used_at", "revoked_at", "created_by", "created_at"}
+	now := time.Now()
+	expectKey := func(mock sqlmock.Sqlmock, expiresAt, lastUsedAt, revokedAt any) {
+		mock.ExpectQuery("SELECT * FROM api_keys WHERE prefix = ?").WithArgs("abcd1234").
+			WillReturnRows(sqlmock.NewRows(apiKeyColumns).AddRow(7, "abcd1234", util.HashToken(key), "shop sync", 1, "orders:read,products:write", expiresAt, lastUsedAt, revokedAt, nil, now))
+	}
+	expectOwner := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("SELECT * FROM users WHERE id = ?").WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "password", "is_admin", "created_at", "updated_at", "email_verified_at", "email_verification_sent_at"}).
+				AddRow(1, "john", "john@example.com", "hash", false, now, nil, nil, nil))
+		mock.ExpectQuery("SELECT r.name FROM roles r JOIN user_roles ur ON ur.role_id = r.id WHERE ur.user_id = ? ORDER BY r.name").WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("customer"))
+		// the owner no longer holds products:write
+		mock.ExpectQuery("SELECT DISTINCT rp.permission FROM role_permissions rp JOIN user_roles ur ON ur.role_id = rp.role_id WHERE ur.user_id = ? ORDER BY rp.permission").WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"permission"}).AddRow("orders:create").AddRow("orders:read"))
+	}
+	expectTouch := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec("UPDATE api_keys SET last_used_at = NOW() WHERE id = ?").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	tcs := []struct {
+		name    string
+		mock    func(sqlmock.Sqlmock)
+		wantErr bool
+	}{
+		{
+			name: "first use",
+			mock: func(mock sqlmock.Sqlmock) {
+				expectKey(mock, nil, nil, nil)
+				expectOwner(mock)
+				expectTouch(mock)
+			},
+		},
+		{
+			name: "used recently",
+			mock: func(mock sqlmock.Sqlmock) {
+				expectKey(mock, now.Add(time.Hour), now.Add(-time.Minute), nil)
+				expectOwner(mock)
+			},
+		},
+		{
+			name: "last used long ago",
+			mock: func(mock sqlmock.Sqlmock) {
+				expectKey(mock, nil, now.Add(-apiKeyTouchInterval), nil)
+				expectOwner(mock)
+				expectTouch(mock)
+			},
+		},
+		{
+			name: "revoked",
+			mock: func(mock sqlmock.Sqlmock) {
+				expectKey(mock, nil, nil, now.Add(-time.Minute))
+			},
+			wantErr: true,
+		},
+		{
+			name: "expired",
+			mock: func(mock sqlmock.Sqlmock) {
+				expectKey(mock, now.Add(-time.Minute), nil, nil)
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			h, mock := newSessionTestHandler(t)
+			tc.mock(mock)
+			r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+			r.Header.Set("Authorization", "ApiKey "+key)
+			claims, err := h.Authenticate(r)
+			if tc.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, []string{"orders:read"}, claims.Permissions)
+				require.EqualValues(t, 7, claims.APIKeyID)
+			}
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	// backgroundWorkers is how many background jobs run at once.
+	backgroundWorkers = 4
+	// backgroundQueueSize is how many jobs may wait for a worker. Jobs
+	// beyond it are dropped, so a flood of requests can't pile up work.
+	backgroundQueueSize = 256
+)
+
+// backgroundQueue runs work that outlives its request, such as sending
+// mail, on a fixed number of workers. Drain waits for it on shutdown.
+type backgroundQueue struct {
+	mu     sync.Mutex
+	closed bool
+	jobs   chan func()
+	wg     sync.WaitGroup
+}
+
+func newBackgroundQueue(workers, size int) *backgroundQueue {
+	q := &backgroundQueue{jobs: make(chan func(), size)}
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer q.wg.Done()
+			for job := range q.jobs {
+				job()
+			}
+		}()
+	}
+	return q
+}
+
+// enqueue schedules job and reports false if the queue is full or drained.
+func (q *backgroundQueue) enqueue(job func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain stops accepting jobs and waits until the queued ones have run or
+// ctx is done.
+func (q *backgroundQueue) drain(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drain waits for background work started by requests, such as password
+// reset mail, to finish. Call it once the HTTP server stopped and before
+// closing the database.
+func (h *Handler) Drain(ctx context.Context) error {
+	return h.background.drain(ctx)
+}
@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackgroundQueue(t *testing.T) {
+	q := newBackgroundQueue(1, 1)
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var ran atomic.Int32
+	job := func() {
+		started <- struct{}{}
+		<-release
+		ran.Add(1)
+	}
+
+	// one job runs, one waits and the next is dropped
+	require.True(t, q.enqueue(job))
+	<-started
+	require.True(t, q.enqueue(job))
+	require.False(t, q.enqueue(job))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, q.drain(ctx), context.Canceled)
+	require.False(t, q.enqueue(job))
+
+	close(release)
+	require.NoError(t, q.drain(context.Background()))
+	require.EqualValues(t, 2, ran.Load())
+}
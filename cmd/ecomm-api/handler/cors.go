@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig lets browser clients on other origins, such as the storefront,
+// call the API.
+type CORSConfig struct {
+	// AllowedOrigins are exact origins like https://shop.example.com, "*"
+	// allows any. CORS is disabled when empty.
+	AllowedOrigins []string
+	// AllowCredentials lets browsers send cookies and read responses to
+	// credentialed requests. It only applies to origins listed exactly,
+	// never to ones matched by "*".
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight response.
+	MaxAge time.Duration
+}
+
+var (
+	corsAllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	corsAllowedHeaders = []string{"Authorization", "Content-Type", requestIDHeader, idempotencyKeyHeader}
+	// corsExposedHeaders are the response headers scripts may read besides
+	// the CORS-safelisted ones.
+	corsExposedHeaders = []string{"Location", "Retry-After", requestIDHeader, "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", idempotentReplayedHeader, "Deprecation", "Sunset", "Link"}
+)
+
+// CORS answers preflight requests from allowed origins and marks their other
+// responses as readable. Requests from other origins pass through without
+// CORS headers, so browsers block them.
+func CORS(cfg CORSConfig) func(http.Handler) http.Handler {
+	listed := func(origin string) bool {
+		return slices.Contains(cfg.AllowedOrigins, origin)
+	}
+	allowed := func(origin string) bool {
+		return slices.Contains(cfg.AllowedOrigins, "*") || listed(origin)
+	}
+	return func(next http.Handler) http.Handler {
+		if len(cfg.AllowedOrigins) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if preflight {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+			}
+			if origin == "" || !allowed(origin) {
+				if preflight {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// the origin is echoed instead of *, which browsers reject for
+			// credentialed requests
+			h.Set("Access-Control-Allow-Origin", origin)
+			// any site could read responses with the user's cookies if
+			// the wildcard allowed credentials
+			if cfg.AllowCredentials && listed(origin) {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if !preflight {
+				h.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+				next.ServeHTTP(w, r)
+				return
+			}
+			h.Set("Access-Control-Allow-Methods", strings.Join(corsAllowedMethods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+			if cfg.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORS(t *testing.T) {
+	h := RegisterRoutes(&Handler{cors: CORSConfig{
+		AllowedOrigins:   []string{"https://shop.example.com"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}})
+	do := func(method, origin string, preflight bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/healthz", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if preflight {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("preflight", func(t *testing.T) {
+		w := do(http.MethodOptions, "https://shop.example.com", true)
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Equal(t, "https://shop.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		require.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+		require.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), http.MethodPatch)
+		require.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+		require.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+	})
+	t.Run("actual request", func(t *testing.T) {
+		w := do(http.MethodGet, "https://shop.example.com", false)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "https://shop.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		require.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), requestIDHeader)
+		require.Equal(t, []string{"Origin"}, w.Header().Values("Vary"))
+	})
+	t.Run("other origin", func(t *testing.T) {
+		w := do(http.MethodOptions, "https://evil.example.com", true)
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+		w = do(http.MethodGet, "https://evil.example.com", false)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	})
+	t.Run("same origin", func(t *testing.T) {
+		w := do(http.MethodGet, "", false)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestCORSWildcardWithoutCredentials(t *testing.T) {
+	h := RegisterRoutes(&Handler{cors: CORSConfig{
+		AllowedOrigins:   []string{"*", "https://shop.example.com"},
+		AllowCredentials: true,
+	}})
+	do := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// any origin may read public responses, but not with the user's cookies
+	w := do("https://evil.example.com")
+	require.Equal(t, "https://evil.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+
+	w = do("https://shop.example.com")
+	require.Equal(t, "https://shop.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	get := func(h *Handler, path string) http.Header {
+		w := httptest.NewRecorder()
+		RegisterRoutes(h).ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Header()
+	}
+
+	hdr := get(&Handler{}, "/healthz")
+	require.Equal(t, "nosniff", hdr.Get("X-Content-Type-Options"))
+	require.Equal(t, "DENY", hdr.Get("X-Frame-Options"))
+	require.Equal(t, apiCSP, hdr.Get("Content-Security-Policy"))
+	require.Empty(t, hdr.Get("Strict-Transport-Security"))
+
+	require.Equal(t, hstsValue, get(&Handler{hsts: true}, "/healthz").Get("Strict-Transport-Security"))
+
+	// the docs page loads Swagger UI and runs its inline script
+	csp := get(&Handler{}, "/docs").Get("Content-Security-Policy")
+	require.Contains(t, csp, "script-src https://unpkg.com 'sha256-")
+	require.Contains(t, csp, "frame-ancestors 'none'")
+}
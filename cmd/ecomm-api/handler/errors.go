@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+)
+
+// Error codes sent in the code member of problem responses. Clients match on
+// these, so they must never change once released.
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeUnauthorized         = "unauthorized"
+	CodeInvalidCredentials   = "invalid_credentials"
+	CodeInvalidToken         = "invalid_token"
+	CodeInvalidCode          = "invalid_code"
+	CodeForbidden            = "forbidden"
+	CodeMissingPermission    = "missing_permission"
+	CodeEmailNotVerified     = "email_not_verified"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeConflict             = "conflict"
+	CodeLastAdmin            = "last_admin"
+	CodeInvalidReference     = "invalid_reference"
+	CodeValidationFailed     = "validation_failed"
+	CodeBodyTooLarge         = "body_too_large"
+	CodeUnsupportedMedia     = "unsupported_media_type"
+	CodeInvalidPatch         = "invalid_patch"
+	CodePatchTestFailed      = "patch_test_failed"
+	CodeFieldNotAllowed      = "field_not_allowed"
+	CodeTooManyRequests      = "too_many_requests"
+	CodeRequestCanceled      = "request_canceled"
+	CodeTimeout              = "timeout"
+	CodeAccountLocked        = "account_locked"
+	CodeNotReady             = "not_ready"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeEndpointRetired      = "endpoint_retired"
+	CodeInternal             = "internal_error"
+)
+
+// Problem is an RFC 7807 problem details object. Type is always about:blank,
+// Code tells problems with the same status apart. Errors lists the invalid
+// fields of a validation_failed problem.
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Code   string       `json:"code"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// StatusClientClosedRequest is the non-standard status nginx logs for requests
+// the client gave up on. The client never sees it, it keeps cancellations
+// apart from failures in logs.
+const StatusClientClosedRequest = 499
+
+func writeProblem(w http.ResponseWriter, status int, code, detail string) {
+	writeProblemWithErrors(w, status, code, detail, nil)
+}
+func writeProblemWithErrors(w http.ResponseWriter, status int, code, detail string, errs []FieldError) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	title := http.StatusText(status)
+	if status == StatusClientClosedRequest {
+		title = "Client Closed Request"
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:   "about:blank",
+		Title:  title,
+		Status: status,
+		Detail: detail,
+		Code:   code,
+		Errors: errs,
+	})
+}
+
+// writeError translates a storer error into a problem. Domain errors become
+// client errors and a cancelled or timed out context 499 or 504, anything else
+// is reported as an internal error with only detail, so database messages
+// never reach the client. The error itself goes to the access log.
+func writeError(w http.ResponseWriter, err error, detail string) {
+	lw := accessLogFor(w)
+	if lw != nil {
+		lw.err = err
+	}
+	switch {
+	case errors.Is(err, storer.ErrNotFound):
+		writeProblem(w, http.StatusNotFound, CodeNotFound, "The requested resource does not exist")
+	case errors.Is(err, storer.ErrLastAdmin):
+		writeProblem(w, http.StatusConflict, CodeLastAdmin, "The store must keep at least one admin")
+	case errors.Is(err, storer.ErrConflict):
+		writeProblem(w, http.StatusConflict, CodeConflict, "The request conflicts with an existing resource")
+	case errors.Is(err, storer.ErrInvalidReference):
+		writeProblem(w, http.StatusUnprocessableEntity, CodeInvalidReference, "The request refers to a resource that does not exist")
+	case errors.Is(err, context.Canceled):
+		writeProblem(w, StatusClientClosedRequest, CodeRequestCanceled, "The request was cancelled by the client")
+	case errors.Is(err, context.DeadlineExceeded):
+		writeProblem(w, http.StatusGatewayTimeout, CodeTimeout, "The request took too long")
+	default:
+		if lw == nil {
+			slog.Error(detail, "error", err)
+		}
+		writeProblem(w, http.StatusInternalServerError, CodeInternal, detail)
+	}
+}
@@ -3,41 +3,133 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"maps"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/hellwind2019/ecomm/cmd/ecomm-api/server"
 	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/mailer"
+	"github.com/hellwind2019/ecomm/metrics"
+	"github.com/hellwind2019/ecomm/rbac"
+	"github.com/hellwind2019/ecomm/sso"
 	"github.com/hellwind2019/ecomm/token"
 	"github.com/hellwind2019/ecomm/util"
 )
 
+// Config holds the Handler settings that come from the environment.
+type Config struct {
+	SecretKey string
+	// PublicURL is the base URL the storefront and API are served under,
+	// used for links in emails.
+	PublicURL string
+	Mailer    mailer.Mailer
+	// RequireVerifiedEmail blocks placing orders until the email is verified.
+	RequireVerifiedEmail bool
+	// RequireAdminMFA withholds admin permissions until two-factor
+	// authentication is enabled on the account.
+	RequireAdminMFA bool
+	// PasswordPolicy checks new passwords, the default only enforces
+	// util.DefaultMinPasswordLength.
+	PasswordPolicy *util.PasswordPolicy
+	// OIDCProviders are the external providers users can sign in with, keyed
+	// by the name used in their URLs.
+	OIDCProviders map[string]*sso.Provider
+	// RequestTimeout bounds every request, DefaultRequestTimeout when zero.
+	RequestTimeout time.Duration
+	// Database is pinged by /readyz, which only tracks shutdown when nil.
+	Database Database
+	// RateLimitStore keeps the rate limit buckets, in memory when nil.
+	RateLimitStore RateLimitStore
+	// RateLimits overrides DefaultRateLimits by policy name.
+	RateLimits map[string]RateLimitPolicy
+	// TrustedProxies are the load balancers whose X-Forwarded-For header is
+	// believed, see the TrustedProxies middleware.
+	TrustedProxies []netip.Prefix
+	CORS           CORSConfig
+	// HSTS sends Strict-Transport-Security, only set it when the API is
+	// served over HTTPS, directly or by the load balancer.
+	HSTS bool
+	// LegacyRoutesSunset is when the unversioned aliases of the /v1 routes
+	// stop working, announced in their Sunset header. They are served
+	// indefinitely when zero.
+	LegacyRoutesSunset time.Time
+}
+
+const DefaultRequestTimeout = 10 * time.Second
+
 type Handler struct {
-	ctx        context.Context
 	server     *server.Server
 	TokenMaker *token.JWTMaker
+	mailer     mailer.Mailer
+	publicURL  string
+
+	requireVerifiedEmail bool
+	requireAdminMFA      bool
+	passwordPolicy       *util.PasswordPolicy
+	oidcProviders        map[string]*sso.Provider
+	requestTimeout       time.Duration
+	database             Database
+	shuttingDown         atomic.Bool
+	rateLimitStore       RateLimitStore
+	rateLimits           map[string]RateLimitPolicy
+	trustedProxies       []netip.Prefix
+	cors                 CORSConfig
+	hsts                 bool
+	legacyRoutesSunset   time.Time
+	background           *backgroundQueue
 }
 
-func NewHandler(srv *server.Server, secretKey string) *Handler {
+func NewHandler(srv *server.Server, cfg Config) *Handler {
+	if cfg.PasswordPolicy == nil {
+		cfg.PasswordPolicy, _ = util.NewPasswordPolicy(util.DefaultMinPasswordLength, "")
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = DefaultRequestTimeout
+	}
+	if cfg.RateLimitStore == nil {
+		cfg.RateLimitStore = NewMemoryRateLimitStore()
+	}
+	rateLimits := maps.Clone(DefaultRateLimits)
+	maps.Copy(rateLimits, cfg.RateLimits)
 	return &Handler{
-		ctx:        context.Background(),
 		server:     srv,
-		TokenMaker: token.NewJWTMaker(secretKey),
+		TokenMaker: token.NewJWTMaker(cfg.SecretKey),
+		mailer:     cfg.Mailer,
+		publicURL:  strings.TrimSuffix(cfg.PublicURL, "/"),
+
+		requireVerifiedEmail: cfg.RequireVerifiedEmail,
+		requireAdminMFA:      cfg.RequireAdminMFA,
+		passwordPolicy:       cfg.PasswordPolicy,
+		oidcProviders:        cfg.OIDCProviders,
+		requestTimeout:       cfg.RequestTimeout,
+		database:             cfg.Database,
+		rateLimitStore:       cfg.RateLimitStore,
+		rateLimits:           rateLimits,
+		trustedProxies:       cfg.TrustedProxies,
+		cors:                 cfg.CORS,
+		hsts:                 cfg.HSTS,
+		legacyRoutesSunset:   cfg.LegacyRoutesSunset,
+		background:           newBackgroundQueue(backgroundWorkers, backgroundQueueSize),
 	}
 }
 
 func (h *Handler) createProduct(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	var p ProductRequest
-	err := json.NewDecoder(r.Body).Decode(&p)
-	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeAndValidate(w, r, &p) {
 		return
 	}
-	product, err := h.server.CreateProduct(h.ctx, toStoreProduct(p))
+	product, err := h.server.CreateProduct(ctx, toStoreProduct(p))
 	if err != nil {
-		http.Error(w, "Failed to create product", http.StatusInternalServerError)
+		writeError(w, err, "Failed to create product")
 		return
 	}
 	res := toResponseProduct(*product)
@@ -48,16 +140,17 @@ func (h *Handler) createProduct(w http.ResponseWriter, r *http.Request) {
 
 // /product/{id}
 func (h *Handler) getProduct(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	id := chi.URLParam(r, "id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		http.Error(w, "Error parsing ID", http.StatusBadRequest)
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Error parsing ID")
 		return
 	}
 
-	product, err := h.server.GetProduct(h.ctx, i)
+	product, err := h.server.GetProduct(ctx, i)
 	if err != nil {
-		http.Error(w, "Failed to get product", http.StatusInternalServerError)
+		writeError(w, err, "Failed to get product")
 		return
 	}
 	res := toResponseProduct(*product)
@@ -67,9 +160,10 @@ func (h *Handler) getProduct(w http.ResponseWriter, r *http.Request) {
 
 }
 func (h *Handler) listProducts(w http.ResponseWriter, r *http.Request) {
-	products, err := h.server.ListProducts(h.ctx)
+	ctx := r.Context()
+	products, err := h.server.ListProducts(ctx)
 	if err != nil {
-		http.Error(w, "Failed to list products", http.StatusInternalServerError)
+		writeError(w, err, "Failed to list products")
 		return
 	}
 	var res []ProductResponse
@@ -80,29 +174,35 @@ func (h *Handler) listProducts(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(res)
 }
+
+// PATCH /products/{id} takes a merge patch or a JSON patch, see patch.go.
 func (h *Handler) updateProduct(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
 	id := chi.URLParam(r, "id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		http.Error(w, "Error parsing ID", http.StatusBadRequest)
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Error parsing ID")
 		return
 	}
-	var p ProductRequest
-	err = json.NewDecoder(r.Body).Decode(&p)
+	product, err := h.server.GetProduct(ctx, i)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, err, "Failed to get product")
 		return
 	}
-	product, err := h.server.GetProduct(h.ctx, i)
-	if err != nil {
-		http.Error(w, "Failed to get product", http.StatusInternalServerError)
+	p := toProductRequest(product)
+	if !decodePatch(w, r, &p, allowedPatchFields(claims, productPatchFields)) {
+		return
+	}
+	if errs := validationErrors(&p); len(errs) > 0 {
+		writeValidationProblem(w, errs)
 		return
 	}
 	//patch the product with new values
 	pathcProductReq(product, p)
-	updated, err := h.server.UpdateProduct(h.ctx, product)
+	updated, err := h.server.UpdateProduct(ctx, product)
 	if err != nil {
-		http.Error(w, "Failed to update product", http.StatusInternalServerError)
+		writeError(w, err, "Failed to update product")
 		return
 	}
 	res := toResponseProduct(*updated)
@@ -112,46 +212,43 @@ func (h *Handler) updateProduct(w http.ResponseWriter, r *http.Request) {
 
 }
 func (h *Handler) deleteProduct(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	id := chi.URLParam(r, "id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		http.Error(w, "Error parsing ID", http.StatusBadRequest)
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Error parsing ID")
 		return
 	}
-	err = h.server.DeleteProduct(h.ctx, i)
+	err = h.server.DeleteProduct(ctx, i)
 	if err != nil {
-		http.Error(w, "Failed to delete product", http.StatusInternalServerError)
+		writeError(w, err, "Failed to delete product")
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 func pathcProductReq(product *storer.Product, p ProductRequest) {
-	if p.Name != "" {
-		product.Name = p.Name
-	}
-	if p.Image != "" {
-		product.Image = p.Image
-	}
-	if p.Category != "" {
-		product.Category = p.Category
-	}
-	if p.Description != "" {
-		product.Description = p.Description
-	}
-	if p.Rating != 0 {
-		product.Rating = p.Rating
-	}
-	if p.NumReviews != 0 {
-		product.NumReviews = p.NumReviews
-	}
-	if p.Price != 0 {
-		product.Price = p.Price
-	}
-	if p.CountInStock != 0 {
-		product.CountInStock = p.CountInStock
-	}
+	product.Name = p.Name
+	product.Image = p.Image
+	product.Category = p.Category
+	product.Description = p.Description
+	product.Rating = p.Rating
+	product.NumReviews = p.NumReviews
+	product.Price = p.Price
+	product.CountInStock = p.CountInStock
 	product.UpdatedAt = toTimePtr(time.Now())
 }
+func toProductRequest(p *storer.Product) ProductRequest {
+	return ProductRequest{
+		Name:         p.Name,
+		Image:        p.Image,
+		Category:     p.Category,
+		Description:  p.Description,
+		Rating:       p.Rating,
+		NumReviews:   p.NumReviews,
+		Price:        p.Price,
+		CountInStock: p.CountInStock,
+	}
+}
 func toTimePtr(t time.Time) *time.Time {
 	if t.IsZero() {
 		return nil
@@ -187,32 +284,45 @@ func toResponseProduct(p storer.Product) *ProductResponse {
 }
 
 func (h *Handler) createOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	var o OrderReq
-	err := json.NewDecoder(r.Body).Decode(&o)
-	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeAndValidate(w, r, &o) {
 		return
 	}
 
 	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	if h.requireVerifiedEmail {
+		user, err := h.server.GetUserByID(ctx, claims.ID)
+		if err != nil {
+			writeError(w, err, "Failed to get user")
+			return
+		}
+		if user.EmailVerifiedAt == nil {
+			writeProblem(w, http.StatusForbidden, CodeEmailNotVerified, "Email address must be verified before placing orders")
+			return
+		}
+	}
 	so := toStorerOrder(o)
 	so.UserID = claims.ID
-	order, err := h.server.CreateOrder(h.ctx, so)
+	order, err := h.server.CreateOrder(ctx, so)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, "Failed to create order")
 		return
 	}
+	metrics.OrdersCreated.Inc()
+	metrics.OrderValue.Observe(float64(order.TotalPrice))
 	res := toOrderResponse(order)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(res)
 }
 func (h *Handler) getOrder(w http.ResponseWriter, r *http.Request) {
-	claims := r.Context().Value(authKey{}).(*token.UserClaims)	
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
 
-	order, err := h.server.GetOrder(h.ctx, claims.ID)
+	order, err := h.server.GetOrder(ctx, claims.ID)
 	if err != nil {
-		http.Error(w, "Failed to get order", http.StatusInternalServerError)
+		writeError(w, err, "Failed to get order")
 		return
 	}
 	res := toOrderResponse(order)
@@ -222,9 +332,10 @@ func (h *Handler) getOrder(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) listOrders(w http.ResponseWriter, r *http.Request) {
-	orders, err := h.server.ListOrders(h.ctx)
+	ctx := r.Context()
+	orders, err := h.server.ListOrders(ctx)
 	if err != nil {
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		writeError(w, err, "Failed to list orders")
 		return
 	}
 	var res []OrderResponse
@@ -284,26 +395,35 @@ func toOrderRespItems(items []storer.OrderItem) []OrderItem {
 }
 
 func (h *Handler) createUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	var u UserRequest
-	err := json.NewDecoder(r.Body).Decode(&u)
-	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeBody(w, r, &u) {
+		return
+	}
+	errs := h.checkPassword(validationErrors(&u), u.Password, u.Email)
+	if len(errs) > 0 {
+		writeValidationProblem(w, errs)
 		return
 	}
-
 	// hash password
-	hashed, err := util.HashPassword(u.Password)
+	hashed, err := hashPassword(ctx, u.Password)
 	if err != nil {
-		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		writeError(w, err, "Failed to hash password")
 		return
 	}
 	u.Password = hashed
 
-	user, err := h.server.CreateUser(h.ctx, toStorerUser(u))
+	user, err := h.server.CreateUser(ctx, toStorerUser(u))
+	if errors.Is(err, storer.ErrConflict) {
+		writeProblem(w, http.StatusConflict, CodeConflict, "A user with this email already exists")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		writeError(w, err, "Failed to create user")
 		return
 	}
+	// a failed email doesn't fail the signup, the user can ask for a resend
+	_ = h.sendVerificationEmail(ctx, user)
 	res := toUserResponse(user)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -314,20 +434,22 @@ func toStorerUser(u UserRequest) *storer.User {
 		Name:     u.Name,
 		Email:    u.Email,
 		Password: u.Password,
-		IsAdmin:  u.IsAdmin,
 	}
 }
 func toUserResponse(u *storer.User) UserResponse {
 	return UserResponse{
-		Name:    u.Name,
-		Email:   u.Email,
-		IsAdmin: u.IsAdmin,
+		ID:            u.ID,
+		Name:          u.Name,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerifiedAt != nil,
+		IsAdmin:       u.IsAdmin,
 	}
 }
 func (h *Handler) listUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := h.server.ListUsers(h.ctx)
+	ctx := r.Context()
+	users, err := h.server.ListUsers(ctx)
 	if err != nil {
-		http.Error(w, "Failed to list users", http.StatusInternalServerError)
+		writeError(w, err, "Failed to list users")
 		return
 	}
 	var res ListUserResponse
@@ -337,25 +459,26 @@ func (h *Handler) listUsers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(res)
 }
+
+// PATCH /users changes the caller's own account, see patch.go.
 func (h *Handler) updateUser(w http.ResponseWriter, r *http.Request) {
-	var u UserRequest
-	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
+	ctx := r.Context()
 	claims := r.Context().Value(authKey{}).(*token.UserClaims)
-	user, err := h.server.GetUser(h.ctx, claims.Email)
+	user, err := h.server.GetUser(ctx, claims.Email)
 	if err != nil {
-		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		writeError(w, err, "Failed to get user")
+		return
+	}
+	u := toUserPatch(user)
+	if !decodePatch(w, r, &u, ownUserPatchFields) {
 		return
 	}
-	pathcUserReq(user, u)
-	if user.Email == ""{
-		user.Email = claims.Email
+	if errs := h.checkPassword(validationErrors(&u), u.Password, u.Email); len(errs) > 0 {
+		writeValidationProblem(w, errs)
+		return
 	}
-	updated, err := h.server.UpdateUser(h.ctx, user)
-	if err != nil {
-		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+	updated, ok := h.saveUserPatch(ctx, w, user, u, &claims.ID)
+	if !ok {
 		return
 	}
 	res := toUserResponse(updated)
@@ -363,74 +486,189 @@ func (h *Handler) updateUser(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 
 }
-func pathcUserReq(user *storer.User, u UserRequest) {
-	if u.Name != "" {
-		user.Name = u.Name
+
+// PATCH /users/{id} lets admins change other accounts, including granting
+// and revoking the admin role through is_admin.
+func (h *Handler) patchUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	user, ok := h.userFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	u := toUserPatch(user)
+	if !decodePatch(w, r, &u, allowedPatchFields(claims, userPatchFields)) {
+		return
+	}
+	if errs := validationErrors(&u); len(errs) > 0 {
+		writeValidationProblem(w, errs)
+		return
+	}
+	updated, ok := h.saveUserPatch(ctx, w, user, u, &claims.ID)
+	if !ok {
+		return
+	}
+	res := toUserResponse(updated)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// saveUserPatch stores the name, email, password and admin role of u on user
+// in one transaction, actorID is recorded as the one who changed the role. A
+// changed email has to be verified again.
+func (h *Handler) saveUserPatch(ctx context.Context, w http.ResponseWriter, user *storer.User, u UserPatch, actorID *int64) (*storer.User, bool) {
+	emailChanged := u.Email != user.Email
+	if err := pathcUserReq(ctx, user, u); err != nil {
+		writeError(w, err, "Failed to hash password")
+		return nil, false
+	}
+	if emailChanged {
+		user.EmailVerifiedAt = nil
+	}
+	updated, err := h.server.UpdateUser(ctx, user, actorID)
+	if errors.Is(err, storer.ErrConflict) {
+		writeProblem(w, http.StatusConflict, CodeConflict, "A user with this email already exists")
+		return nil, false
+	}
+	if err != nil {
+		writeError(w, err, "Failed to update user")
+		return nil, false
 	}
-	if u.Email != "" {
-		user.Email = u.Email
+	if emailChanged {
+		_ = h.sendVerificationEmail(ctx, updated)
 	}
+	return updated, true
+}
+func pathcUserReq(ctx context.Context, user *storer.User, u UserPatch) error {
+	user.Name = u.Name
+	user.Email = u.Email
+	user.IsAdmin = u.IsAdmin
 	if u.Password != "" {
-		hashed, err := util.HashPassword(u.Password)
+		hashed, err := hashPassword(ctx, u.Password)
 		if err != nil {
-			panic("Failed to hash password: " + err.Error())
+			return err
 		}
 		user.Password = hashed
 	}
-	if u.IsAdmin {
-		user.IsAdmin = u.IsAdmin
-	}
 	user.UpdatedAt = toTimePtr(time.Now())
+	return nil
+}
+func toUserPatch(u *storer.User) UserPatch {
+	return UserPatch{Name: u.Name, Email: u.Email, IsAdmin: u.IsAdmin}
 }
 func (h *Handler) deleteUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	id := chi.URLParam(r, "id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		http.Error(w, "Error parsing ID", http.StatusBadRequest)
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Error parsing ID")
 		return
 	}
-	err = h.server.DeleteUser(h.ctx, i)
+	err = h.server.DeleteUser(ctx, i)
 	if err != nil {
-		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		writeError(w, err, "Failed to delete user")
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 func (h *Handler) loginUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	var u LoginUserRequest
-	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeAndValidate(w, r, &u) {
 		return
 	}
-	gu, err := h.server.GetUser(h.ctx, u.Email)
+	ip := clientIP(r)
+	locked, err := h.loginLockedFor(ctx, u.Email, ip)
 	if err != nil {
-		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		writeError(w, err, "Failed to check login attempts")
 		return
 	}
-	err = util.CheckPasswordHash(u.Password, gu.Password)
-	if err != nil {
-		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+	if locked > 0 {
+		writeLoginLocked(w, locked)
+		return
+	}
+	// unknown emails and wrong passwords get the same response after the
+	// same amount of work, so neither reveals whether an account exists
+	gu, err := h.server.GetUser(ctx, u.Email)
+	if err != nil && !errors.Is(err, storer.ErrNotFound) {
+		writeError(w, err, "Failed to get user")
+		return
+	}
+	hash := dummyPasswordHash()
+	if gu != nil {
+		hash = gu.Password
+	}
+	if err := checkPasswordHash(ctx, u.Password, hash); err != nil || gu == nil {
+		if err := h.recordLoginFailure(ctx, u.Email, ip); err != nil {
+			writeError(w, err, "Failed to record login attempt")
+			return
+		}
+		metrics.Logins.WithLabelValues(metrics.LoginFailure).Inc()
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidCredentials, "Invalid email or password")
 		return
 	}
-	// create a json web token (JWT)
-	accessToken, accessTokenClaims, err := h.TokenMaker.CreateToken(gu.ID, gu.Email, gu.IsAdmin, time.Minute*15)
+	if err := h.clearLoginFailures(ctx, gu.Email); err != nil {
+		writeError(w, err, "Failed to record login attempt")
+		return
+	}
+	// upgrade hashes made with an older algorithm or weaker parameters while
+	// the plaintext is at hand, a failure only delays the upgrade
+	if util.NeedsRehash(gu.Password) {
+		if hashed, err := hashPassword(ctx, u.Password); err == nil {
+			if err := h.server.UpdateUserPassword(ctx, gu.ID, hashed); err == nil {
+				gu.Password = hashed
+			}
+		}
+	}
+	mfaEnabled, err := h.totpEnabled(ctx, gu.ID)
 	if err != nil {
-		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		writeError(w, err, "Failed to get two-factor status")
 		return
 	}
+	if mfaEnabled {
+		// tokens are only issued by /users/login/mfa once a valid code is given
+		h.writeMFAChallenge(w, gu)
+		return
+	}
+	metrics.Logins.WithLabelValues(metrics.LoginSuccess).Inc()
+	h.startSession(w, r, gu)
+}
 
-	refreshToken, refreshClaims, err := h.TokenMaker.CreateToken(gu.ID, gu.Email, gu.IsAdmin, time.Hour*24)
+// startSession issues the access and refresh tokens for an authenticated user
+// and records the session.
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, gu *storer.User) {
+	ctx := r.Context()
+	roles, permissions, mfaPending, err := h.userAccess(ctx, gu.ID)
+	if err != nil {
+		writeError(w, err, "Failed to get user roles")
+		return
+	}
+	// create a json web token (JWT), the refresh token starts the session
+	refreshToken, refreshClaims, err := h.TokenMaker.CreateToken(token.TokenTypeRefresh, gu.ID, gu.Email, roles, permissions, "", time.Hour*24)
+	if err != nil {
+		writeError(w, err, "Failed to create token")
+		return
+	}
+	accessToken, accessTokenClaims, err := h.TokenMaker.CreateToken(token.TokenTypeAccess, gu.ID, gu.Email, roles, permissions, refreshClaims.SessionID, time.Minute*15)
 	if err != nil {
-		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		writeError(w, err, "Failed to create token")
 		return
 	}
-	session, _ := h.server.CreateSession(h.ctx, &storer.Session{
-		ID:           refreshClaims.RegisteredClaims.ID,
+	now := time.Now()
+	session, err := h.server.CreateSession(ctx, &storer.Session{
+		ID:           refreshClaims.SessionID,
 		UserEmail:    gu.Email,
-		RefreshToken: refreshToken,
+		RefreshToken: util.HashToken(refreshToken),
 		IsRevoked:    false,
 		ExpiresAt:    refreshClaims.RegisteredClaims.ExpiresAt.Time,
+		UserAgent:    r.UserAgent(),
+		IPAddress:    clientIP(r),
+		LastUsedAt:   &now,
 	})
+	if err != nil {
+		writeError(w, err, "Failed to create session")
+		return
+	}
 
 	res := LoginUserResponse{
 		SessionID:             session.ID,
@@ -439,49 +677,87 @@ func (h *Handler) loginUser(w http.ResponseWriter, r *http.Request) {
 		AccessTokenExpiresAt:  accessTokenClaims.ExpiresAt.Time,
 		RefreshTokenExpiresAt: refreshClaims.RegisteredClaims.ExpiresAt.Time,
 		User:                  toUserResponse(gu),
+		MFAEnrollmentRequired: mfaPending,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(res)
 }
+
+// userAccess loads the roles and permissions to embed in a user's tokens. When
+// two-factor authentication is mandatory for admins and the user is an admin
+// without it, no permissions are granted until they enroll, and mfaPending is
+// true.
+func (h *Handler) userAccess(ctx context.Context, userID int64) (roles []string, permissions []string, mfaPending bool, err error) {
+	roles, err = h.server.ListUserRoles(ctx, userID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	permissions, err = h.server.ListUserPermissions(ctx, userID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if h.requireAdminMFA && slices.Contains(roles, rbac.RoleAdmin) {
+		enabled, err := h.totpEnabled(ctx, userID)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if !enabled {
+			return roles, []string{}, true, nil
+		}
+	}
+	return roles, permissions, false, nil
+}
 func (h *Handler) logoutUser(w http.ResponseWriter, r *http.Request) {
-	claims := r.Context().Value(authKey{}).(*token.UserClaims)	
-	err := h.server.DeleteSession(h.ctx, claims.RegisteredClaims.ID)
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	err := h.server.DeleteSession(ctx, claims.SessionID)
 	if err != nil {
-		http.Error(w, "Failed to delete session", http.StatusInternalServerError)
+		writeError(w, err, "Failed to delete session")
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 func (h *Handler) renewAccessToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	var req RenewAccessTokenRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeAndValidate(w, r, &req) {
 		return
 	}
-	refreshClaims, err := h.TokenMaker.VerifyToken(req.RefreshToken)
+	refreshClaims, err := h.TokenMaker.VerifyToken(token.TokenTypeRefresh, req.RefreshToken)
 	if err != nil {
-		http.Error(w, "Error verifying token", http.StatusUnauthorized)
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidToken, "Error verifying token")
 		return
 	}
-	session, err := h.server.GetSession(h.ctx, refreshClaims.RegisteredClaims.ID)
+	session, err := h.server.GetSession(ctx, refreshClaims.SessionID)
 	if err != nil {
-		http.Error(w, "Failed to get session", http.StatusInternalServerError)
+		writeError(w, err, "Failed to get session")
 		return
 	}
 	if session.IsRevoked {
-		http.Error(w, "Session is revoked", http.StatusUnauthorized)
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidToken, "Session is revoked")
+		return
+	}
+	if session.UserEmail != refreshClaims.Email || session.RefreshToken != util.HashToken(req.RefreshToken) {
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidToken, "Invalid session")
 		return
 	}
-	if session.UserEmail != refreshClaims.Email {
-		http.Error(w, "Invalid session", http.StatusUnauthorized)
+	if err := h.server.TouchSession(ctx, session.ID); err != nil {
+		writeError(w, err, "Failed to update session")
+		return
+	}
+	// reload roles so that grants and revocations apply on the next renewal
+	roles, permissions, _, err := h.userAccess(ctx, refreshClaims.ID)
+	if err != nil {
+		writeError(w, err, "Failed to get user roles")
 		return
 	}
-	accessToken, accessClaims, err := h.TokenMaker.CreateToken(refreshClaims.ID, refreshClaims.Email, refreshClaims.IsAdmin, time.Minute*15)
+	accessToken, accessClaims, err := h.TokenMaker.CreateToken(token.TokenTypeAccess, refreshClaims.ID, refreshClaims.Email, roles, permissions, session.ID, time.Minute*15)
 	if err != nil {
-		http.Error(w, "Failed to create access token", http.StatusInternalServerError)
+		writeError(w, err, "Failed to create access token")
 		return
 	}
+	metrics.TokenRenewals.Inc()
 	res := RenewAccessTokenResponse{
 		AccessToken:          accessToken,
 		AccessTokenExpiresAt: accessClaims.RegisteredClaims.ExpiresAt.Time,
@@ -491,10 +767,11 @@ func (h *Handler) renewAccessToken(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(res)
 }
 func (h *Handler) revokeSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	claims := r.Context().Value(authKey{}).(*token.UserClaims)
-	err := h.server.RevokeSession(h.ctx, claims.RegisteredClaims.ID)
+	err := h.server.RevokeSession(ctx, claims.SessionID)
 	if err != nil {
-		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		writeError(w, err, "Failed to revoke session")
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Database is checked by /readyz, *db.Database implements it.
+type Database interface {
+	Ping(ctx context.Context) error
+	CheckMigrations(ctx context.Context) error
+}
+
+// readinessTimeout bounds the checks of /readyz, load balancers give up on
+// probes after a few seconds.
+const readinessTimeout = 2 * time.Second
+
+// BuildTime is set when linking with
+// -ldflags "-X github.com/hellwind2019/ecomm/cmd/ecomm-api/handler.BuildTime=$(date -u +%FT%TZ)".
+var BuildTime string
+
+// StartShutdown makes /readyz fail so load balancers stop sending new
+// requests before the server drains.
+func (h *Handler) StartShutdown() {
+	h.shuttingDown.Store(true)
+}
+
+// /healthz
+func (h *Handler) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthResponse{Status: "ok"})
+}
+
+// /readyz
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if h.shuttingDown.Load() {
+		writeProblem(w, http.StatusServiceUnavailable, CodeNotReady, "The server is shutting down")
+		return
+	}
+	checks := map[string]string{}
+	var failed []string
+	if h.database != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+		for _, c := range []struct {
+			name  string
+			check func(context.Context) error
+		}{
+			{"database", h.database.Ping},
+			{"migrations", h.database.CheckMigrations},
+		} {
+			if err := c.check(ctx); err != nil {
+				slog.WarnContext(ctx, "readiness check failed", "check", c.name, "error", err)
+				failed = append(failed, c.name)
+				continue
+			}
+			checks[c.name] = "ok"
+		}
+	}
+	if len(failed) > 0 {
+		writeProblem(w, http.StatusServiceUnavailable, CodeNotReady, "Failed checks: "+strings.Join(failed, ", "))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReadinessResponse{Status: "ready", Checks: checks})
+}
+
+// BuildInfo describes the running binary, as served by /version.
+var BuildInfo = sync.OnceValue(func() VersionResponse {
+	res := VersionResponse{BuildTime: BuildTime}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return res
+	}
+	res.GoVersion = info.GoVersion
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			res.Commit = s.Value
+		case "vcs.time":
+			res.CommitTime = s.Value
+		case "vcs.modified":
+			res.Modified = s.Value == "true"
+		}
+	}
+	return res
+})
+
+// /version
+func (h *Handler) version(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BuildInfo())
+}
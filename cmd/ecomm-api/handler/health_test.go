@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDatabase struct {
+	pingErr, migrationsErr error
+}
+
+func (d fakeDatabase) Ping(context.Context) error            { return d.pingErr }
+func (d fakeDatabase) CheckMigrations(context.Context) error { return d.migrationsErr }
+
+func TestReadyz(t *testing.T) {
+	tcs := []struct {
+		name         string
+		db           fakeDatabase
+		shuttingDown bool
+		status       int
+		detail       string
+	}{
+		{name: "ready", status: http.StatusOK},
+		{name: "database down", db: fakeDatabase{pingErr: errors.New("refused")}, status: http.StatusServiceUnavailable, detail: "Failed checks: database"},
+		{name: "migrations behind", db: fakeDatabase{migrationsErr: errors.New("behind")}, status: http.StatusServiceUnavailable, detail: "Failed checks: migrations"},
+		{name: "shutting down", shuttingDown: true, status: http.StatusServiceUnavailable, detail: "The server is shutting down"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &Handler{database: tc.db}
+			if tc.shuttingDown {
+				h.StartShutdown()
+			}
+			w := httptest.NewRecorder()
+			RegisterRoutes(h).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			require.Equal(t, tc.status, w.Code)
+			if tc.status != http.StatusOK {
+				var p Problem
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&p))
+				require.Equal(t, CodeNotReady, p.Code)
+				require.Equal(t, tc.detail, p.Detail)
+			}
+		})
+	}
+}
+
+func TestHealthzDuringShutdown(t *testing.T) {
+	// the process is still alive while draining, only readiness fails
+	h := &Handler{}
+	h.StartShutdown()
+	w := httptest.NewRecorder()
+	RegisterRoutes(h).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestVersion(t *testing.T) {
+	w := httptest.NewRecorder()
+	RegisterRoutes(&Handler{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var res VersionResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	require.NotEmpty(t, res.GoVersion)
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ServerConfig configures the http.Server the API is served with.
+type ServerConfig struct {
+	Addr string
+	// ReadTimeout covers the whole request including the body,
+	// ReadHeaderTimeout only the headers.
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	// WriteTimeout must be longer than the handler's request timeout, or
+	// timed out requests lose their 504 response.
+	WriteTimeout   time.Duration
+	IdleTimeout    time.Duration
+	MaxHeaderBytes int
+	// Certificates serves HTTPS when set, plain HTTP otherwise.
+	Certificates *CertReloader
+}
+
+func NewHTTPServer(h http.Handler, cfg ServerConfig) *http.Server {
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           h,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	if cfg.Certificates != nil {
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: cfg.Certificates.GetCertificate,
+		}
+	}
+	return srv
+}
+
+// Serve serves srv on ln until ctx is done, then stops accepting connections
+// and waits up to shutdownTimeout for in-flight requests to finish. It
+// returns nil after a clean shutdown.
+func Serve(ctx context.Context, srv *http.Server, ln net.Listener, shutdownTimeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// the certificate comes from TLSConfig.GetCertificate
+			errc <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		errc <- srv.Serve(ln)
+	}()
+	select {
+	case err := <-errc:
+		return fmt.Errorf("failed to serve: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		// cut off whatever is still running
+		srv.Close()
+		return fmt.Errorf("failed to drain requests: %w", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve: %w", err)
+	}
+	return nil
+}
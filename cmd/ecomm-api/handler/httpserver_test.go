@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeDrainsRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := NewHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	}), ServerConfig{ReadHeaderTimeout: time.Second})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- Serve(ctx, srv, ln, 5*time.Second) }()
+
+	res, resErr := make(chan *http.Response, 1), make(chan error, 1)
+	go func() {
+		r, err := http.Get("http://" + ln.Addr().String())
+		res <- r
+		resErr <- err
+	}()
+	<-started
+	stop()
+	// the in-flight request still completes after the shutdown started
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	r := <-res
+	require.NoError(t, <-resErr)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	require.Equal(t, "done", string(body))
+	require.NoError(t, <-served)
+}
+
+func TestRegisterRoutesInstances(t *testing.T) {
+	// each call builds its own router, so servers don't share state
+	a := httptest.NewServer(RegisterRoutes(&Handler{}))
+	defer a.Close()
+	b := httptest.NewServer(RegisterRoutes(&Handler{}))
+	defer b.Close()
+	for _, url := range []string{a.URL, b.URL} {
+		res, err := http.Get(url + "/openapi.json")
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+	}
+}
@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	idempotencyKeyLifetime   = 24 * time.Hour
+	idempotencyPollInterval  = 100 * time.Millisecond
+)
+
+// idempotentResponseHeaders are stored with the response and sent again on
+// replays, the others are set by middleware for each request.
+var idempotentResponseHeaders = []string{"Content-Type", "Location"}
+
+// idempotent lets clients retry a mutating request safely by sending the same
+// Idempotency-Key header. The first request runs and its response is kept for
+// idempotencyKeyLifetime, retries get that response back without running the
+// handler. A retry arriving while the first request is still running waits
+// for it. Reusing a key for a different request is rejected with 422.
+//
+// Keys are scoped by rateLimitKey, so it goes after RequirePermission.
+// Requests without the header and responses that failed with 5xx, which a
+// retry should run again, are not kept.
+func (h *Handler) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("%s must be 1 to %d printable ASCII characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeProblem(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("Request body must not be larger than %d bytes", maxBodyBytes))
+				return
+			}
+			writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Failed to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		claim := &storer.IdempotencyKey{
+			Scope:       rateLimitKey(r),
+			Key:         key,
+			RequestHash: requestHash(r, body),
+		}
+		for {
+			now := time.Now()
+			// the lock outlives any request holding it, the Timeout
+			// middleware ends them sooner
+			claim.LockedUntil = now.Add(2 * h.requestTimeout)
+			claim.ExpiresAt = now.Add(idempotencyKeyLifetime)
+			rec, claimed, err := h.server.ClaimIdempotencyKey(ctx, claim, now)
+			switch {
+			case errors.Is(err, storer.ErrNotFound):
+				// expired and deleted by another request meanwhile, try
+				// again after the poll interval
+			case err != nil:
+				writeError(w, err, "Failed to check idempotency key")
+				return
+			case claimed:
+				h.runIdempotent(w, r, next, claim)
+				return
+			case rec.RequestHash != claim.RequestHash:
+				writeProblem(w, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, "The idempotency key was already used for a different request")
+				return
+			case rec.ResponseStatus != nil:
+				replayResponse(w, rec)
+				return
+			}
+			select {
+			case <-ctx.Done():
+				writeError(w, ctx.Err(), "Request with the same idempotency key did not complete")
+				return
+			case <-time.After(idempotencyPollInterval):
+			}
+		}
+	})
+}
+
+// runIdempotent runs next for a claimed key and stores its response.
+func (h *Handler) runIdempotent(w http.ResponseWriter, r *http.Request, next http.Handler, claim *storer.IdempotencyKey) {
+	var body bytes.Buffer
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	ww.Tee(&body)
+	next.ServeHTTP(ww, r)
+
+	// the outcome is recorded even when the request timed out, otherwise
+	// retries wait for the lock to expire
+	ctx := context.WithoutCancel(r.Context())
+	status := ww.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status >= http.StatusInternalServerError || status == StatusClientClosedRequest {
+		if err := h.server.ReleaseIdempotencyKey(ctx, claim.Scope, claim.Key); err != nil {
+			slog.ErrorContext(ctx, "failed to release idempotency key", "error", err)
+		}
+		return
+	}
+	headers := map[string]string{}
+	for _, k := range idempotentResponseHeaders {
+		if v := ww.Header().Get(k); v != "" {
+			headers[k] = v
+		}
+	}
+	encoded, _ := json.Marshal(headers)
+	stored := string(encoded)
+	claim.ResponseStatus = &status
+	claim.ResponseHeaders = &stored
+	claim.ResponseBody = body.Bytes()
+	if err := h.server.SaveIdempotentResponse(ctx, claim); err != nil {
+		slog.ErrorContext(ctx, "failed to save idempotent response", "error", err)
+		// without the response a retry must run the request again
+		if err := h.server.ReleaseIdempotencyKey(ctx, claim.Scope, claim.Key); err != nil {
+			slog.ErrorContext(ctx, "failed to release idempotency key", "error", err)
+		}
+	}
+}
+
+func replayResponse(w http.ResponseWriter, rec *storer.IdempotencyKey) {
+	if rec.ResponseHeaders != nil {
+		var headers map[string]string
+		json.Unmarshal([]byte(*rec.ResponseHeaders), &headers)
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(*rec.ResponseStatus)
+	w.Write(rec.ResponseBody)
+}
+
+// requestHash identifies a request by its method, target and body, a key
+// must not be reused with a different one. The version prefix is left out,
+// so a retry may switch between a route and its unversioned alias.
+func requestHash(r *http.Request, body []byte) string {
+	target := *r.URL
+	target.Path = unversionedPath(target.Path)
+	target.RawPath = ""
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, target.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for _, c := range []byte(key) {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/server"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotent(t *testing.T) {
+	const body = `{"items":[{"product_id":1,"quantity":1}]}`
+	newRequest := func(body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+		req.Header.Set(idempotencyKeyHeader, "k1")
+		return req
+	}
+	hash := requestHash(newRequest(body), []byte(body))
+	columns := []string{"scope", "idempotency_key", "request_hash", "response_status", "response_headers", "response_body", "locked_until", "expires_at", "created_at"}
+	now := time.Now()
+
+	tcs := []struct {
+		name   string
+		body   string
+		mock   func(sqlmock.Sqlmock)
+		status int
+		runs   int
+		check  func(*testing.T, *httptest.ResponseRecorder)
+	}{
+		{
+			name: "first request",
+			body: body,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO idempotency_keys (scope, idempotency_key, request_hash, locked_until, expires_at) VALUES (?, ?, ?, ?, ?)").
+					WithArgs("ip:192.0.2.1", "k1", hash, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE idempotency_keys SET response_status = ?, response_headers = ?, response_body = ? WHERE scope = ? AND idempotency_key = ?").
+					WithArgs(http.StatusCreated, `{"Content-Type":"application/json"}`, []byte(`{"id":7}`), "ip:192.0.2.1", "k1").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			status: http.StatusCreated,
+			runs:   1,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				require.Empty(t, w.Header().Get(idempotentReplayedHeader))
+			},
+		},
+		{
+			name: "replay",
+			body: body,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO idempotency_keys (scope, idempotency_key, request_hash, locked_until, expires_at) VALUES (?, ?, ?, ?, ?)").
+					WithArgs("ip:192.0.2.1", "k1", hash, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnError(&mysql.MySQLError{Number: 1062})
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT * FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? FOR UPDATE").WithArgs("ip:192.0.2.1", "k1").
+					WillReturnRows(sqlmock.NewRows(columns).AddRow("ip:192.0.2.1", "k1", hash, http.StatusCreated, `{"Content-Type":"application/json"}`, []byte(`{"id":7}`), now, now.Add(time.Hour), now))
+				mock.ExpectCommit()
+			},
+			status: http.StatusCreated,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				require.Equal(t, "true", w.Header().Get(idempotentReplayedHeader))
+				require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+				require.Equal(t, `{"id":7}`, w.Body.String())
+			},
+		},
+		{
+			name: "key deleted meanwhile",
+			body: body,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO idempotency_keys (scope, idempotency_key, request_hash, locked_until, expires_at) VALUES (?, ?, ?, ?, ?)").
+					WithArgs("ip:192.0.2.1", "k1", hash, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnError(&mysql.MySQLError{Number: 1062})
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT * FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? FOR UPDATE").WithArgs("ip:192.0.2.1", "k1").
+					WillReturnRows(sqlmock.NewRows(columns))
+				mock.ExpectRollback()
+				mock.ExpectExec("INSERT INTO idempotency_keys (scope, idempotency_key, request_hash, locked_until, expires_at) VALUES (?, ?, ?, ?, ?)").
+					WithArgs("ip:192.0.2.1", "k1", hash, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE idempotency_keys SET response_status = ?, response_headers = ?, response_body = ? WHERE scope = ? AND idempotency_key = ?").
+					WithArgs(http.StatusCreated, `{"Content-Type":"application/json"}`, []byte(`{"id":7}`), "ip:192.0.2.1", "k1").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			status: http.StatusCreated,
+			runs:   1,
+		},
+		{
+			name: "different request",
+			body: `{"items":[{"product_id":2,"quantity":1}]}`,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO idempotency_keys (scope, idempotency_key, request_hash, locked_until, expires_at) VALUES (?, ?, ?, ?, ?)").
+					WithArgs("ip:192.0.2.1", "k1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnError(&mysql.MySQLError{Number: 1062})
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT * FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? FOR UPDATE").WithArgs("ip:192.0.2.1", "k1").
+					WillReturnRows(sqlmock.NewRows(columns).AddRow("ip:192.0.2.1", "k1", hash, http.StatusCreated, `{"Content-Type":"application/json"}`, []byte(`{"id":7}`), now, now.Add(time.Hour), now))
+				mock.ExpectCommit()
+			},
+			status: http.StatusUnprocessableEntity,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				require.Contains(t, w.Body.String(), CodeIdempotencyKeyReused)
+			},
+		},
+		{
+			name: "failed request",
+			body: body,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO idempotency_keys (scope, idempotency_key, request_hash, locked_until, expires_at) VALUES (?, ?, ?, ?, ?)").
+					WithArgs("ip:192.0.2.1", "k1", hash, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? AND response_status IS NULL").
+					WithArgs("ip:192.0.2.1", "k1").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			status: http.StatusInternalServerError,
+			runs:   1,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			require.NoError(t, err)
+			defer mockDB.Close()
+			tc.mock(mock)
+			h := NewHandler(server.NewServer(storer.NewMySQLStorer(sqlx.NewDb(mockDB, "sqlmock"))), Config{})
+
+			runs := 0
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				runs++
+				if tc.status == http.StatusInternalServerError {
+					writeProblem(w, http.StatusInternalServerError, CodeInternal, "Failed to create order")
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"id":7}`))
+			})
+			w := httptest.NewRecorder()
+			h.idempotent(next).ServeHTTP(w, newRequest(tc.body))
+			require.Equal(t, tc.status, w.Code)
+			require.Equal(t, tc.runs, runs)
+			if tc.check != nil {
+				tc.check(t, w)
+			}
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRequestHash(t *testing.T) {
+	body := []byte(`{"items":[{"product_id":1,"quantity":1}]}`)
+	hash := requestHash(httptest.NewRequest(http.MethodPost, "/orders?x=1", nil), body)
+	require.Equal(t, hash, requestHash(httptest.NewRequest(http.MethodPost, "/v1/orders?x=1", nil), body))
+	require.NotEqual(t, hash, requestHash(httptest.NewRequest(http.MethodPost, "/v1/orders?x=2", nil), body))
+	require.NotEqual(t, hash, requestHash(httptest.NewRequest(http.MethodPut, "/v1/orders?x=1", nil), body))
+}
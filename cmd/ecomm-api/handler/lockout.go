@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/hellwind2019/ecomm/util"
+)
+
+// Failed logins are counted per account and per client IP. Once a counter
+// reaches its threshold the key is locked, for loginLockoutBase at first and
+// twice as long for every further failure, up to loginLockoutMax. Counters
+// start over after loginFailureWindow without failures.
+const (
+	maxAccountLoginFailures = 5
+	maxIPLoginFailures      = 20
+	loginLockoutBase        = time.Minute
+	loginLockoutMax         = time.Hour
+	loginFailureWindow      = time.Hour
+)
+
+// dummyPasswordHash is compared against when the email is unknown, so that
+// the response takes as long as for a wrong password.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hashed, _ := util.HashPassword("not a real password")
+	return hashed
+})
+
+// loginLockedFor returns how long logins for the email or from the IP are
+// still locked.
+func (h *Handler) loginLockedFor(ctx context.Context, email, ip string) (time.Duration, error) {
+	var locked time.Duration
+	for kind, key := range map[string]string{storer.ThrottleAccount: accountThrottleKey(email), storer.ThrottleIP: ip} {
+		t, err := h.server.GetLoginThrottle(ctx, kind, key)
+		if errors.Is(err, storer.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if t.LockedUntil != nil {
+			locked = max(locked, time.Until(*t.LockedUntil))
+		}
+	}
+	return locked, nil
+}
+func (h *Handler) recordLoginFailure(ctx context.Context, email, ip string) error {
+	keys := []struct {
+		kind, key string
+		limit     int64
+	}{
+		{storer.ThrottleAccount, accountThrottleKey(email), maxAccountLoginFailures},
+		{storer.ThrottleIP, ip, maxIPLoginFailures},
+	}
+	for _, k := range keys {
+		t, err := h.server.RecordLoginFailure(ctx, k.kind, k.key, loginFailureWindow)
+		if err != nil {
+			return err
+		}
+		if d := lockoutDuration(t.Failures, k.limit); d > 0 {
+			if err := h.server.LockLogin(ctx, k.kind, k.key, time.Now().Add(d)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+func (h *Handler) clearLoginFailures(ctx context.Context, email string) error {
+	return h.server.ClearLoginThrottle(ctx, storer.ThrottleAccount, accountThrottleKey(email))
+}
+
+// /users/{id}/lockout
+func (h *Handler) unlockUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	user, ok := h.userFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	if err := h.server.UnlockAccount(ctx, user, &claims.ID); err != nil {
+		writeError(w, err, "Failed to unlock account")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeLoginLocked(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+	writeProblem(w, http.StatusTooManyRequests, CodeAccountLocked, "Too many failed login attempts, try again later")
+}
+func lockoutDuration(failures, limit int64) time.Duration {
+	if failures < limit {
+		return 0
+	}
+	d := loginLockoutBase
+	for i := limit; i < failures && d < loginLockoutMax; i++ {
+		d *= 2
+	}
+	return min(d, loginLockoutMax)
+}
+
+// accountThrottleKey must match the key storer.UnlockAccount clears.
+func accountThrottleKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
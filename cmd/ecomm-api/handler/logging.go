@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"github.com/hellwind2019/ecomm/logging"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+)
+
+// quietRoutes are polled by load balancers and scrapers, their successful
+// requests are only logged at debug level.
+var quietRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// RequestID keeps the X-Request-ID of the client or proxy in front of us when
+// it is valid and generates one otherwise. The ID is echoed in the response
+// and carried by every log record of the request.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID only accepts short IDs of URL-safe characters, so clients
+// can't inject anything into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// accessLogWriter collects what the access log line reports beyond the
+// response itself. Handlers reach it through accessLogFor.
+type accessLogWriter struct {
+	middleware.WrapResponseWriter
+	userID int64
+	err    error
+}
+
+// accessLogFor finds the accessLogWriter under w, nil when the request isn't
+// logged.
+func accessLogFor(w http.ResponseWriter) *accessLogWriter {
+	for {
+		switch t := w.(type) {
+		case *accessLogWriter:
+			return t
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// AccessLog logs one line per request with its outcome, the authenticated
+// user and the error writeError reported. Sensitive query parameters are
+// redacted.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &accessLogWriter{WrapResponseWriter: middleware.NewWrapResponseWriter(w, r.ProtoMajor)}
+		next.ServeHTTP(lw, r)
+
+		status := lw.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := routePattern(r)
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", logging.RedactURL(r.URL)),
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.Int("bytes", lw.BytesWritten()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_ip", clientIP(r)),
+			slog.String("user_agent", r.UserAgent()),
+		}
+		if lw.userID != 0 {
+			attrs = append(attrs, slog.Int64("user_id", lw.userID))
+		}
+		if lw.err != nil {
+			attrs = append(attrs, slog.String("error", lw.err.Error()))
+			// the span of Tracing is only told the status
+			trace.SpanFromContext(r.Context()).RecordError(lw.err)
+		}
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case quietRoutes[route] && status < http.StatusBadRequest:
+			level = slog.LevelDebug
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
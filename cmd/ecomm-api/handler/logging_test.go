@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/logging"
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/stretchr/testify/require"
+)
+
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, "debug", "json")
+	require.NoError(t, err)
+	prev := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestRequestID(t *testing.T) {
+	var got string
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = logging.RequestID(r.Context())
+	}))
+	tcs := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "kept", header: "abc-123", keep: true},
+		{name: "generated", header: ""},
+		{name: "invalid", header: "a b\nc"},
+		{name: "too long", header: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(requestIDHeader, tc.header)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			require.NotEmpty(t, got)
+			require.Equal(t, got, w.Header().Get(requestIDHeader))
+			require.Equal(t, tc.keep, got == tc.header)
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	buf := captureLogs(t)
+	r := chi.NewRouter()
+	r.Use(RequestID, AccessLog)
+	r.Get("/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		withClaims(w, r, &token.UserClaims{ID: 42})
+		writeError(w, fmt.Errorf("failed to get order: %w", fmt.Errorf("%w: sql: no rows in result set", storer.ErrNotFound)), "Failed to get order")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/orders/7?token=secret", nil)
+	req.Header.Set(requestIDHeader, "req-1")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &rec))
+	require.Equal(t, "INFO", rec["level"])
+	require.Equal(t, "req-1", rec["request_id"])
+	require.Equal(t, "/orders/{id}", rec["route"])
+	require.Equal(t, "/orders/7?token=%5BREDACTED%5D", rec["path"])
+	require.EqualValues(t, http.StatusNotFound, rec["status"])
+	require.EqualValues(t, 42, rec["user_id"])
+	require.Equal(t, "failed to get order: not found: sql: no rows in result set", rec["error"])
+}
@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hellwind2019/ecomm/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsRoutePattern(t *testing.T) {
+	r := RegisterRoutes(&Handler{})
+	count := func(route, status string) float64 {
+		return testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues(route, http.MethodGet, status))
+	}
+	healthz, unmatched := count("/healthz", "200"), count(unmatchedRoute, "404")
+
+	for _, path := range []string{"/healthz", "/nope/1", "/nope/2"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	require.Equal(t, healthz+1, count("/healthz", "200"))
+	// unknown paths share one series
+	require.Equal(t, unmatched+2, count(unmatchedRoute, "404"))
+
+	// scraping needs the metrics:read permission
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	(&Handler{}).metrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `ecomm_http_requests_total{method="GET",route="/healthz",status="200"}`)
+	require.Contains(t, w.Body.String(), `ecomm_logins_total{result="failure"} 0`)
+}
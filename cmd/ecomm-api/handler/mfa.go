@@ -0,0 +1,340 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/metrics"
+	"github.com/hellwind2019/ecomm/rbac"
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/hellwind2019/ecomm/totp"
+	"github.com/hellwind2019/ecomm/util"
+)
+
+const (
+	totpIssuer        = "ecomm"
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// mfaChallenge is the subject of the token handed out after the password
+// step. It carries the email so the lockout is checked before the user is
+// loaded.
+type mfaChallenge struct {
+	UserID int64  `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// /users/login/mfa
+// Second step of the login for accounts with two-factor authentication.
+func (h *Handler) loginMFA(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req LoginMFARequest
+	if !decodeAndValidate(w, r, &req) {
+		return
+	}
+	subject, err := h.TokenMaker.VerifyPurposeToken(token.PurposeMFAChallenge, req.MFAToken)
+	if err != nil {
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidToken, "Invalid or expired MFA token")
+		return
+	}
+	var c mfaChallenge
+	if err := json.Unmarshal([]byte(subject), &c); err != nil {
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidToken, "Invalid or expired MFA token")
+		return
+	}
+	// codes are guessed against the same counters as passwords
+	ip := clientIP(r)
+	locked, err := h.loginLockedFor(ctx, c.Email, ip)
+	if err != nil {
+		writeError(w, err, "Failed to check login attempts")
+		return
+	}
+	if locked > 0 {
+		writeLoginLocked(w, locked)
+		return
+	}
+	user, err := h.server.GetUserByID(ctx, c.UserID)
+	if err != nil && !errors.Is(err, storer.ErrNotFound) {
+		writeError(w, err, "Failed to get user")
+		return
+	}
+	// the account was deleted or its email changed since the password step
+	if err != nil || user.Email != c.Email {
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidToken, "Invalid or expired MFA token")
+		return
+	}
+	ok, err := h.checkSecondFactor(ctx, user.ID, req.Code)
+	if err != nil {
+		writeError(w, err, "Failed to verify code")
+		return
+	}
+	if !ok {
+		if err := h.recordLoginFailure(ctx, user.Email, ip); err != nil {
+			writeError(w, err, "Failed to record login attempt")
+			return
+		}
+		metrics.Logins.WithLabelValues(metrics.LoginFailure).Inc()
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidCode, "Invalid code")
+		return
+	}
+	if err := h.clearLoginFailures(ctx, user.Email); err != nil {
+		writeError(w, err, "Failed to record login attempt")
+		return
+	}
+	metrics.Logins.WithLabelValues(metrics.LoginSuccess).Inc()
+	h.startSession(w, r, user)
+}
+
+// /me/2fa/totp
+// enrollTOTP starts an enrollment. It stays pending, and logins keep working
+// with the password only, until a code is confirmed with confirmTOTP.
+func (h *Handler) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	enabled, err := h.totpEnabled(ctx, claims.ID)
+	if err != nil {
+		writeError(w, err, "Failed to get two-factor status")
+		return
+	}
+	if enabled {
+		writeProblem(w, http.StatusConflict, CodeConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		writeError(w, err, "Failed to generate secret")
+		return
+	}
+	sealed, err := h.TokenMaker.Seal(token.PurposeTOTPSecret, secret)
+	if err != nil {
+		writeError(w, err, "Failed to encrypt secret")
+		return
+	}
+	if err := h.server.SaveTOTPSecret(ctx, claims.ID, sealed); err != nil {
+		writeError(w, err, "Failed to save secret")
+		return
+	}
+	res := TOTPEnrollResponse{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(totpIssuer, claims.Email, secret),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+// /me/2fa/totp/verify
+// confirmTOTP enables two-factor authentication and returns the recovery codes.
+// They are only ever shown here.
+func (h *Handler) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	var req TOTPCodeRequest
+	if !decodeAndValidate(w, r, &req) {
+		return
+	}
+	t, err := h.server.GetUserTOTP(ctx, claims.ID)
+	if err != nil {
+		writeProblem(w, http.StatusConflict, CodeConflict, "No pending two-factor enrollment")
+		return
+	}
+	if t.EnabledAt != nil {
+		writeProblem(w, http.StatusConflict, CodeConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	secret, err := h.totpSecret(t)
+	if err != nil {
+		writeError(w, err, "Failed to decrypt secret")
+		return
+	}
+	step, ok := totp.Validate(secret, req.Code, time.Now())
+	if !ok {
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidCode, "Invalid code")
+		return
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		writeError(w, err, "Failed to generate recovery codes")
+		return
+	}
+	if err := h.server.EnableTOTP(ctx, claims.ID, step, hashes); err != nil {
+		writeError(w, err, "Failed to enable two-factor authentication")
+		return
+	}
+	writeRecoveryCodes(w, codes)
+}
+
+// /me/2fa/recovery-codes
+// regenerateRecoveryCodes replaces all recovery codes, it requires a current code.
+func (h *Handler) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	var req TOTPCodeRequest
+	if !decodeAndValidate(w, r, &req) {
+		return
+	}
+	ok, err := h.checkTOTPCode(ctx, claims.ID, req.Code)
+	if err != nil {
+		writeError(w, err, "Failed to verify code")
+		return
+	}
+	if !ok {
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidCode, "Invalid code")
+		return
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		writeError(w, err, "Failed to generate recovery codes")
+		return
+	}
+	if err := h.server.ReplaceRecoveryCodes(ctx, claims.ID, hashes); err != nil {
+		writeError(w, err, "Failed to save recovery codes")
+		return
+	}
+	writeRecoveryCodes(w, codes)
+}
+
+// disableTOTP turns two-factor authentication off. It requires a current code
+// or a recovery code, and is refused for admins when it is mandatory for them.
+func (h *Handler) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	var req TOTPCodeRequest
+	if !decodeAndValidate(w, r, &req) {
+		return
+	}
+	if h.requireAdminMFA {
+		roles, err := h.server.ListUserRoles(ctx, claims.ID)
+		if err != nil {
+			writeError(w, err, "Failed to get user roles")
+			return
+		}
+		if slices.Contains(roles, rbac.RoleAdmin) {
+			writeProblem(w, http.StatusForbidden, CodeForbidden, "Two-factor authentication is mandatory for admins")
+			return
+		}
+	}
+	ok, err := h.checkSecondFactor(ctx, claims.ID, req.Code)
+	if err != nil {
+		writeError(w, err, "Failed to verify code")
+		return
+	}
+	if !ok {
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidCode, "Invalid code")
+		return
+	}
+	if err := h.server.DisableTOTP(ctx, claims.ID); err != nil {
+		writeError(w, err, "Failed to disable two-factor authentication")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) writeMFAChallenge(w http.ResponseWriter, u *storer.User) {
+	b, err := json.Marshal(mfaChallenge{UserID: u.ID, Email: u.Email})
+	if err != nil {
+		writeError(w, err, "Failed to create token")
+		return
+	}
+	mfaToken, err := h.TokenMaker.CreatePurposeToken(token.PurposeMFAChallenge, string(b), mfaChallengeTTL)
+	if err != nil {
+		writeError(w, err, "Failed to create token")
+		return
+	}
+	res := MFAChallengeResponse{
+		MFARequired:  true,
+		MFAToken:     mfaToken,
+		MFAExpiresAt: time.Now().Add(mfaChallengeTTL),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// totpEnabled reports whether the user completed a TOTP enrollment.
+func (h *Handler) totpEnabled(ctx context.Context, userID int64) (bool, error) {
+	t, err := h.server.GetUserTOTP(ctx, userID)
+	if errors.Is(err, storer.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return t.EnabledAt != nil, nil
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code.
+func (h *Handler) checkSecondFactor(ctx context.Context, userID int64, code string) (bool, error) {
+	ok, err := h.checkTOTPCode(ctx, userID, code)
+	if err != nil || ok {
+		return ok, err
+	}
+	return h.server.UseRecoveryCode(ctx, userID, util.HashToken(normalizeRecoveryCode(code)))
+}
+
+// checkTOTPCode validates a code against the user's enabled secret and marks
+// its time step as used, so each code is accepted only once.
+func (h *Handler) checkTOTPCode(ctx context.Context, userID int64, code string) (bool, error) {
+	t, err := h.server.GetUserTOTP(ctx, userID)
+	if errors.Is(err, storer.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if t.EnabledAt == nil {
+		return false, nil
+	}
+	secret, err := h.totpSecret(t)
+	if err != nil {
+		return false, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok || step <= t.LastUsedStep {
+		return false, nil
+	}
+	return h.server.UseTOTPStep(ctx, userID, step)
+}
+
+// totpSecret decrypts the secret of an enrollment. Secrets stored before
+// they were encrypted are used as they are until sealTOTPSecrets encrypts
+// them at startup.
+func (h *Handler) totpSecret(t *storer.UserTOTP) (string, error) {
+	if !token.IsSealed(t.Secret) {
+		return t.Secret, nil
+	}
+	return h.TokenMaker.Open(token.PurposeTOTPSecret, t.Secret)
+}
+
+// generateRecoveryCodes returns the codes to show to the user and the hashes
+// to store.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(secret[:5] + "-" + secret[5:10])
+		codes = append(codes, code)
+		hashes = append(hashes, util.HashToken(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+func writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	res := RecoveryCodesResponse{RecoveryCodes: codes}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
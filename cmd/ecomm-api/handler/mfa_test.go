@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPSecret(t *testing.T) {
+	h := NewHandler(nil, Config{SecretKey: "0123456789012345678901234567890123456789"})
+	const secret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+	sealed, err := h.TokenMaker.Seal(token.PurposeTOTPSecret, secret)
+	require.NoError(t, err)
+	require.NotContains(t, sealed, secret)
+	got, err := h.totpSecret(&storer.UserTOTP{Secret: sealed})
+	require.NoError(t, err)
+	require.Equal(t, secret, got)
+
+	// secrets stored before encryption still work
+	got, err = h.totpSecret(&storer.UserTOTP{Secret: secret})
+	require.NoError(t, err)
+	require.Equal(t, secret, got)
+
+	// another SECRET_KEY can't open it
+	other := NewHandler(nil, Config{SecretKey: "9876543210987654321098765432109876543210"})
+	_, err = other.totpSecret(&storer.UserTOTP{Secret: sealed})
+	require.Error(t, err)
+}
+
+func TestLoginMFA(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+	throttleColumns := []string{"kind", "throttle_key", "failures", "locked_until", "last_failure_at"}
+	now := time.Now()
+	expectThrottles := func(mock sqlmock.Sqlmock, lockedUntil any) {
+		mock.ExpectQuery("SELECT * FROM login_throttles WHERE kind = ? AND throttle_key = ?").WithArgs(storer.ThrottleAccount, "john@example.com").
+			WillReturnRows(sqlmock.NewRows(throttleColumns).AddRow(storer.ThrottleAccount, "john@example.com", 5, lockedUntil, now))
+		mock.ExpectQuery("SELECT * FROM login_throttles WHERE kind = ? AND throttle_key = ?").WithArgs(storer.ThrottleIP, "192.0.2.1").
+			WillReturnRows(sqlmock.NewRows(throttleColumns))
+	}
+	expectUser := func(mock sqlmock.Sqlmock, email string) {
+		mock.ExpectQuery("SELECT * FROM users WHERE id = ?").WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "password", "is_admin", "created_at", "updated_at", "email_verified_at", "email_verification_sent_at"}).
+				AddRow(1, "john", email, "hash", false, now, nil, nil, nil))
+	}
+	expectFailure := func(mock sqlmock.Sqlmock, kind, key string) {
+		mock.ExpectBegin()
+		mock.ExpectExec(`
+			INSERT INTO login_throttles (kind, throttle_key, failures, last_failure_at) VALUES (?, ?, 1, NOW())
+			ON DUPLICATE KEY UPDATE
+				failures = IF(last_failure_at < NOW() - INTERVAL ? SECOND, 1, failures + 1),
+				last_failure_at = NOW()
+		`).WithArgs(kind, key, int64(loginFailureWindow.Seconds())).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT * FROM login_throttles WHERE kind = ? AND throttle_key = ?").WithArgs(kind, key).
+			WillReturnRows(sqlmock.NewRows(throttleColumns).AddRow(kind, key, 1, nil, now))
+		mock.ExpectCommit()
+	}
+
+	tcs := []struct {
+		name       string
+		mock       func(h *Handler, mock sqlmock.Sqlmock)
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			// the user isn't loaded while the account is locked
+			name: "locked",
+			mock: func(h *Handler, mock sqlmock.Sqlmock) {
+				expectThrottles(mock, now.Add(time.Minute))
+			},
+			wantStatus: http.StatusTooManyRequests,
+			wantCode:   CodeAccountLocked,
+		},
+		{
+			name: "wrong code",
+			mock: func(h *Handler, mock sqlmock.Sqlmock) {
+				expectThrottles(mock, nil)
+				expectUser(mock, "john@example.com")
+				sealed, err := h.TokenMaker.Seal(token.PurposeTOTPSecret, secret)
+				require.NoError(t, err)
+				mock.ExpectQuery("SELECT * FROM user_totp WHERE user_id = ?").WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret", "enabled_at", "last_used_step", "created_at"}).AddRow(1, sealed, now, 0, now))
+				mock.ExpectExec("UPDATE mfa_recovery_codes SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL").
+					WithArgs(1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+				expectFailure(mock, storer.ThrottleAccount, "john@example.com")
+				expectFailure(mock, storer.ThrottleIP, "192.0.2.1")
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   CodeInvalidCode,
+		},
+		{
+			name: "email changed",
+			mock: func(h *Handler, mock sqlmock.Sqlmock) {
+				expectThrottles(mock, nil)
+				expectUser(mock, "jane@example.com")
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   CodeInvalidToken,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			h, mock := newSessionTestHandler(t)
+			// the account and IP counters are looked up in no particular order
+			mock.MatchExpectationsInOrder(false)
+			tc.mock(h, mock)
+			w := httptest.NewRecorder()
+			h.writeMFAChallenge(w, &storer.User{ID: 1, Email: "john@example.com"})
+			var challenge MFAChallengeResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&challenge))
+
+			r := httptest.NewRequest(http.MethodPost, "/users/login/mfa", strings.NewReader(`{"mfa_token":"`+challenge.MFAToken+`","code":"not-a-code"}`))
+			r.Header.Set("Content-Type", "application/json")
+			w = httptest.NewRecorder()
+			h.loginMFA(w, r)
+			require.Equal(t, tc.wantStatus, w.Code)
+			require.Contains(t, w.Body.String(), `"code":"`+tc.wantCode+`"`)
+			if tc.wantStatus == http.StatusTooManyRequests {
+				require.NotEmpty(t, w.Header().Get("Retry-After"))
+			}
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -2,62 +2,195 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
 	"strings"
+	"time"
 
+	"github.com/hellwind2019/ecomm/rbac"
 	"github.com/hellwind2019/ecomm/token"
 )
 
 type authKey struct{}
 
-func GetAuthMiddlewareFunc(tokenMaker *token.JWTMaker) func(http.Handler) http.Handler {
+// Authenticator turns the credentials of a request into claims.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*token.UserClaims, error)
+}
+
+func GetAuthMiddlewareFunc(auth Authenticator) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			claims, err := verifyClaimsFromAuthHeader(r, tokenMaker)
+			claims, err := auth.Authenticate(r)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("error verifying token: %v", err), http.StatusUnauthorized)
+				writeProblem(w, http.StatusUnauthorized, CodeUnauthorized, "Missing or invalid credentials")
 				return
 			}
-			ctx := context.WithValue(r.Context(), authKey{}, claims)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, withClaims(w, r, claims))
+		})
+
+	}
+}
+
+// withClaims stores the authenticated claims in the request context and
+// notes the user for the access log.
+func withClaims(w http.ResponseWriter, r *http.Request, claims *token.UserClaims) *http.Request {
+	if lw := accessLogFor(w); lw != nil {
+		lw.userID = claims.ID
+	}
+	return r.WithContext(context.WithValue(r.Context(), authKey{}, claims))
+}
+
+// TrustedProxies replaces the RemoteAddr of requests relayed by one of
+// proxies with the client address from X-Forwarded-For: the rightmost entry
+// that isn't a trusted proxy itself, since clients can prepend anything. The
+// header of other peers is ignored.
+func TrustedProxies(proxies []netip.Prefix) func(http.Handler) http.Handler {
+	trusted := func(addr string) bool {
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return false
+		}
+		ip = ip.Unmap()
+		for _, p := range proxies {
+			if p.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next http.Handler) http.Handler {
+		if len(proxies) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !trusted(clientIP(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			r = r.WithContext(r.Context())
+			var hops []string
+			for _, v := range r.Header.Values("X-Forwarded-For") {
+				for _, hop := range strings.Split(v, ",") {
+					hops = append(hops, strings.TrimSpace(hop))
+				}
+			}
+			for i := len(hops) - 1; i >= 0; i-- {
+				if _, err := netip.ParseAddr(hops[i]); err != nil {
+					break
+				}
+				r.RemoteAddr = net.JoinHostPort(hops[i], "0")
+				if !trusted(hops[i]) {
+					break
+				}
+			}
+			next.ServeHTTP(w, r)
 		})
+	}
+}
 
+// Timeout cancels the request context after d. Storer calls then fail with
+// context.DeadlineExceeded, which writeError reports as 504. Nested timeouts
+// can only shorten the deadline.
+func Timeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
 	}
 }
-func GetAdminMiddlewareFunc(tokenMaker *token.JWTMaker) func(http.Handler) http.Handler {
+
+// RequirePermission authenticates the request like GetAuthMiddlewareFunc and
+// additionally requires the token to carry the given permission.
+func RequirePermission(auth Authenticator, permission rbac.Permission) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			claims, err := verifyClaimsFromAuthHeader(r, tokenMaker)
+			claims, err := auth.Authenticate(r)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("error verifying token: %v", err), http.StatusUnauthorized)
+				writeProblem(w, http.StatusUnauthorized, CodeUnauthorized, "Missing or invalid credentials")
 				return
 			}
-			if !claims.IsAdmin {
-				http.Error(w, "user is not an admin", http.StatusForbidden)
+			if !claims.HasPermission(string(permission)) {
+				writeProblem(w, http.StatusForbidden, CodeMissingPermission, fmt.Sprintf("Missing permission %s", permission))
 				return
 			}
-			ctx := context.WithValue(r.Context(), authKey{}, claims)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, withClaims(w, r, claims))
 
 		})
 
 	}
 }
-func verifyClaimsFromAuthHeader(r *http.Request, tokenMaker *token.JWTMaker) (*token.UserClaims, error) {
 
+// RequireSession authenticates the request like GetAuthMiddlewareFunc but
+// only accepts the user's own session, not API keys or tokens of third-party
+// apps. It guards account management.
+func RequireSession(auth Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, err := auth.Authenticate(r)
+			if err != nil {
+				writeProblem(w, http.StatusUnauthorized, CodeUnauthorized, "Missing or invalid credentials")
+				return
+			}
+			if claims.Delegated() {
+				writeProblem(w, http.StatusForbidden, CodeForbidden, "Not available to API keys or third-party apps")
+				return
+			}
+			next.ServeHTTP(w, withClaims(w, r, claims))
+		})
+	}
+}
+
+// verifySession rejects access tokens whose session has been revoked, deleted
+// or has expired, so signing out takes effect before the token expires.
+func (h *Handler) verifySession(ctx context.Context, claims *token.UserClaims) error {
+	session, err := h.server.GetSession(ctx, claims.SessionID)
+	if err != nil {
+		return err
+	}
+	if session.IsRevoked || session.UserEmail != claims.Email || !session.ExpiresAt.After(time.Now()) {
+		return errors.New("session is no longer active")
+	}
+	return nil
+}
+
+// Authenticate accepts either "Bearer <access token>" or "ApiKey <key>" in
+// the Authorization header.
+func (h *Handler) Authenticate(r *http.Request) (*token.UserClaims, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		return nil, fmt.Errorf("authorization token is missing")
 	}
 	fiels := strings.Fields(authHeader)
-	if len(fiels) != 2 || fiels[0] != "Bearer" {
+	if len(fiels) != 2 {
 		return nil, fmt.Errorf("invalid authorization header")
 	}
-	token := fiels[1]
-	claims, err := tokenMaker.VerifyToken(token)
-	if err != nil {
-		return nil, fmt.Errorf("invalid token: %w", err)
+	switch fiels[0] {
+	case "Bearer":
+		claims, err := h.TokenMaker.VerifyToken(token.TokenTypeAccess, fiels[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid token: %w", err)
+		}
+		if claims.ClientID != "" {
+			err = h.verifyOAuthGrant(r.Context(), claims)
+		} else {
+			err = h.verifySession(r.Context(), claims)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid token: %w", err)
+		}
+		return claims, nil
+	case "ApiKey":
+		claims, err := h.verifyAPIKey(r.Context(), fiels[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid api key: %w", err)
+		}
+		return claims, nil
 	}
-	return claims, nil
+	return nil, fmt.Errorf("invalid authorization header")
 }
@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeout(t *testing.T) {
+	// waits like a slow query and fails with the wrapped context error
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		writeError(w, fmt.Errorf("failed to list products: %w", r.Context().Err()), "Failed to list products")
+	})
+
+	t.Run("deadline exceeded", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		Timeout(10*time.Millisecond)(slow).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusGatewayTimeout, w.Code)
+		require.Contains(t, w.Body.String(), CodeTimeout)
+	})
+
+	t.Run("client gone", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		w := httptest.NewRecorder()
+		Timeout(time.Minute)(slow).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		require.Equal(t, StatusClientClosedRequest, w.Code)
+		require.Contains(t, w.Body.String(), CodeRequestCanceled)
+	})
+}
@@ -0,0 +1,602 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/hellwind2019/ecomm/util"
+	"golang.org/x/oauth2"
+)
+
+// The authorization server implements the authorization code grant with
+// mandatory PKCE (RFC 6749, RFC 7636), client credentials and refresh tokens,
+// plus revocation (RFC 7009) and introspection (RFC 7662). Scopes are
+// permission names, a token only carries the scopes its user still holds.
+const (
+	oauthConsentTTL           = 10 * time.Minute
+	oauthAuthorizationCodeTTL = 5 * time.Minute
+	oauthAccessTokenTTL       = 15 * time.Minute
+	oauthRefreshTokenTTL      = 30 * 24 * time.Hour
+)
+
+// oauthAuthorizeRequest is a validated authorization request. It is signed
+// into the consent form, so the POST can't change what the user agreed to.
+type oauthAuthorizeRequest struct {
+	ClientID      string   `json:"client_id"`
+	RedirectURI   string   `json:"redirect_uri"`
+	Scopes        []string `json:"scopes"`
+	State         string   `json:"state"`
+	CodeChallenge string   `json:"code_challenge"`
+}
+
+type consentPage struct {
+	Client  string
+	Scopes  []string
+	Consent string
+	Email   string
+	Error   string
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorize {{.Client}}</title></head>
+<body>
+<h1>{{.Client}} wants to access your account</h1>
+{{if .Scopes}}<p>It will be able to:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>
+{{else}}<p>It asks for no permissions beyond knowing who you are.</p>
+{{end}}{{if .Error}}<p role="alert">{{.Error}}</p>
+{{end}}<form method="post">
+<input type="hidden" name="consent" value="{{.Consent}}">
+<p><label>Email <input type="email" name="email" value="{{.Email}}" autocomplete="username"></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password"></label></p>
+<p><label>Two-factor code, if enabled <input type="text" name="code" autocomplete="one-time-code"></label></p>
+<button type="submit" name="decision" value="approve">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+// /oauth/authorize
+// oauthAuthorize shows the consent screen, where the user signs in and
+// approves or denies the client.
+func (h *Handler) oauthAuthorize(w http.ResponseWriter, r *http.Request) {
+	req, c, ok := h.parseAuthorizeRequest(w, r)
+	if !ok {
+		return
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		writeError(w, err, "Failed to start authorization")
+		return
+	}
+	consent, err := h.TokenMaker.CreatePurposeToken(token.PurposeOAuthConsent, string(b), oauthConsentTTL)
+	if err != nil {
+		writeError(w, err, "Failed to start authorization")
+		return
+	}
+	renderConsent(w, http.StatusOK, consentPage{Client: c.Name, Scopes: req.Scopes, Consent: consent})
+}
+
+// oauthApprove handles the consent form. Sign in failures count towards the
+// same lockout as /users/login.
+func (h *Handler) oauthApprove(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if err := r.ParseForm(); err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid form")
+		return
+	}
+	subject, err := h.TokenMaker.VerifyPurposeToken(token.PurposeOAuthConsent, r.PostForm.Get("consent"))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Authorization expired, please start again")
+		return
+	}
+	var req oauthAuthorizeRequest
+	if err := json.Unmarshal([]byte(subject), &req); err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Authorization expired, please start again")
+		return
+	}
+	c, err := h.server.GetOAuthClient(ctx, req.ClientID)
+	if err != nil || c.RevokedAt != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Unknown client")
+		return
+	}
+	if r.PostForm.Get("decision") != "approve" {
+		redirectOAuthError(w, r, req.RedirectURI, req.State, "access_denied", "The user denied the request")
+		return
+	}
+
+	email := r.PostForm.Get("email")
+	page := consentPage{Client: c.Name, Scopes: req.Scopes, Consent: r.PostForm.Get("consent"), Email: email}
+	ip := clientIP(r)
+	locked, err := h.loginLockedFor(ctx, email, ip)
+	if err != nil {
+		writeError(w, err, "Failed to check login attempts")
+		return
+	}
+	if locked > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(locked.Seconds())+1))
+		page.Error = "Too many failed login attempts, try again later"
+		renderConsent(w, http.StatusTooManyRequests, page)
+		return
+	}
+	user, err := h.server.GetUser(ctx, email)
+	if err != nil && !errors.Is(err, storer.ErrNotFound) {
+		writeError(w, err, "Failed to get user")
+		return
+	}
+	hash := dummyPasswordHash()
+	if user != nil {
+		hash = user.Password
+	}
+	if err := checkPasswordHash(ctx, r.PostForm.Get("password"), hash); err != nil || user == nil {
+		if err := h.recordLoginFailure(ctx, email, ip); err != nil {
+			writeError(w, err, "Failed to record login attempt")
+			return
+		}
+		page.Error = "Invalid email or password"
+		renderConsent(w, http.StatusUnauthorized, page)
+		return
+	}
+	mfaEnabled, err := h.totpEnabled(ctx, user.ID)
+	if err != nil {
+		writeError(w, err, "Failed to get two-factor status")
+		return
+	}
+	if mfaEnabled {
+		ok, err := h.checkSecondFactor(ctx, user.ID, r.PostForm.Get("code"))
+		if err != nil {
+			writeError(w, err, "Failed to verify code")
+			return
+		}
+		if !ok {
+			if err := h.recordLoginFailure(ctx, email, ip); err != nil {
+				writeError(w, err, "Failed to record login attempt")
+				return
+			}
+			page.Error = "Enter a valid two-factor code"
+			renderConsent(w, http.StatusUnauthorized, page)
+			return
+		}
+	}
+	if err := h.clearLoginFailures(ctx, user.Email); err != nil {
+		writeError(w, err, "Failed to record login attempt")
+		return
+	}
+
+	code, err := util.RandomToken(32)
+	if err != nil {
+		writeError(w, err, "Failed to create authorization code")
+		return
+	}
+	err = h.server.CreateOAuthAuthorizationCode(ctx, &storer.OAuthAuthorizationCode{
+		CodeHash:      util.HashToken(code),
+		ClientID:      c.ID,
+		UserID:        user.ID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        strings.Join(req.Scopes, ","),
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(oauthAuthorizationCodeTTL),
+	})
+	if err != nil {
+		writeError(w, err, "Failed to create authorization code")
+		return
+	}
+	redirectOAuth(w, r, req.RedirectURI, url.Values{"code": {code}}, req.State)
+}
+
+// /oauth/token
+func (h *Handler) oauthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form")
+		return
+	}
+	c, ok := h.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		h.exchangeAuthorizationCode(w, r, c)
+	case "refresh_token":
+		h.exchangeOAuthRefreshToken(w, r, c)
+	case "client_credentials":
+		h.clientCredentialsGrant(w, r, c)
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+// /oauth/revoke
+// Revoking either token of a grant revokes the whole grant. Unknown tokens
+// are not an error.
+func (h *Handler) oauthRevoke(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form")
+		return
+	}
+	c, ok := h.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+	g := h.oauthGrantForToken(ctx, c, r.PostForm.Get("token"))
+	if g != nil {
+		if err := h.server.RevokeOAuthGrant(ctx, g.ID); err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// /oauth/introspect
+// Clients can only introspect tokens issued to them.
+func (h *Handler) oauthIntrospect(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form")
+		return
+	}
+	c, ok := h.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+	tok := r.PostForm.Get("token")
+	res := IntrospectionResponse{}
+	if rt, err := h.server.GetOAuthRefreshToken(ctx, util.HashToken(tok)); err == nil {
+		g, err := h.server.GetOAuthGrant(ctx, rt.GrantID)
+		if err == nil && g.ClientID == c.ID && g.RevokedAt == nil && rt.UsedAt == nil && rt.ExpiresAt.After(time.Now()) {
+			res = IntrospectionResponse{
+				Active:    true,
+				Scope:     strings.Join(splitScopes(g.Scopes), " "),
+				ClientID:  c.ID,
+				Subject:   strconv.FormatInt(g.UserID, 10),
+				TokenType: "refresh_token",
+				ExpiresAt: rt.ExpiresAt.Unix(),
+				IssuedAt:  rt.CreatedAt.Unix(),
+			}
+		}
+	} else if claims, err := h.TokenMaker.VerifyToken(token.TokenTypeAccess, tok); err == nil && claims.ClientID == c.ID {
+		g, err := h.server.GetOAuthGrant(ctx, claims.SessionID)
+		if err == nil && g.RevokedAt == nil {
+			res = IntrospectionResponse{
+				Active:    true,
+				Scope:     strings.Join(claims.Permissions, " "),
+				ClientID:  c.ID,
+				Username:  claims.Email,
+				Subject:   strconv.FormatInt(claims.ID, 10),
+				TokenType: "access_token",
+				ExpiresAt: claims.ExpiresAt.Unix(),
+				IssuedAt:  claims.IssuedAt.Unix(),
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// parseAuthorizeRequest validates an authorization request. Until the client
+// and redirect URI are known to be good, errors are shown to the user instead
+// of being sent back to the client.
+func (h *Handler) parseAuthorizeRequest(w http.ResponseWriter, r *http.Request) (*oauthAuthorizeRequest, *storer.OAuthClient, bool) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	c, err := h.server.GetOAuthClient(ctx, q.Get("client_id"))
+	if err != nil || c.RevokedAt != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Unknown client")
+		return nil, nil, false
+	}
+	uris := strings.Fields(c.RedirectURIs)
+	redirectURI := q.Get("redirect_uri")
+	if redirectURI == "" && len(uris) == 1 {
+		redirectURI = uris[0]
+	}
+	if !slices.Contains(uris, redirectURI) {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid redirect URI")
+		return nil, nil, false
+	}
+	state := q.Get("state")
+	if q.Get("response_type") != "code" {
+		redirectOAuthError(w, r, redirectURI, state, "unsupported_response_type", "Only the code response type is supported")
+		return nil, nil, false
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		redirectOAuthError(w, r, redirectURI, state, "invalid_request", "PKCE with the S256 method is required")
+		return nil, nil, false
+	}
+	scopes, ok := requestedScopes(c, q.Get("scope"))
+	if !ok {
+		redirectOAuthError(w, r, redirectURI, state, "invalid_scope", "The client may not request these scopes")
+		return nil, nil, false
+	}
+	return &oauthAuthorizeRequest{
+		ClientID:      c.ID,
+		RedirectURI:   redirectURI,
+		Scopes:        scopes,
+		State:         state,
+		CodeChallenge: q.Get("code_challenge"),
+	}, c, true
+}
+
+// authenticateOAuthClient accepts HTTP Basic or client_id and client_secret
+// form fields. Public clients authenticate with their ID alone.
+func (h *Handler) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) (*storer.OAuthClient, bool) {
+	ctx := r.Context()
+	id, secret, basic := r.BasicAuth()
+	if !basic {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	c, err := h.server.GetOAuthClient(ctx, id)
+	valid := err == nil && c.RevokedAt == nil
+	if valid && c.SecretHash != nil {
+		valid = util.TokensEqual(util.HashToken(secret), *c.SecretHash)
+	} else if valid {
+		valid = secret == ""
+	}
+	if !valid {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return nil, false
+	}
+	return c, true
+}
+func (h *Handler) exchangeAuthorizationCode(w http.ResponseWriter, r *http.Request, c *storer.OAuthClient) {
+	ctx := r.Context()
+	code, err := h.server.GetOAuthAuthorizationCode(ctx, util.HashToken(r.PostForm.Get("code")))
+	if errors.Is(err, storer.ErrInvalidToken) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	// everything is checked before the code is used up, so a client that
+	// intercepted or guessed it can't burn it for the one it was issued to
+	if code.ClientID != c.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	challenge := oauth2.S256ChallengeFromVerifier(r.PostForm.Get("code_verifier"))
+	if !util.TokensEqual(challenge, code.CodeChallenge) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "PKCE verification failed")
+		return
+	}
+	err = h.server.UseOAuthAuthorizationCode(ctx, code.ID, c.ID)
+	if errors.Is(err, storer.ErrInvalidToken) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+		return
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	h.issueOAuthTokens(ctx, w, c, code.UserID, splitScopes(code.Scopes))
+}
+func (h *Handler) exchangeOAuthRefreshToken(w http.ResponseWriter, r *http.Request, c *storer.OAuthClient) {
+	ctx := r.Context()
+	oldHash := util.HashToken(r.PostForm.Get("refresh_token"))
+	rt, err := h.server.GetOAuthRefreshToken(ctx, oldHash)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired refresh token")
+		return
+	}
+	g, err := h.server.GetOAuthGrant(ctx, rt.GrantID)
+	if err != nil || g.ClientID != c.ID {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired refresh token")
+		return
+	}
+	refreshToken, err := util.RandomToken(32)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	g, err = h.server.RotateOAuthRefreshToken(ctx, oldHash, &storer.OAuthRefreshToken{
+		TokenHash: util.HashToken(refreshToken),
+		ExpiresAt: time.Now().Add(oauthRefreshTokenTTL),
+	})
+	if errors.Is(err, storer.ErrInvalidToken) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired refresh token")
+		return
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	h.writeOAuthAccessToken(ctx, w, c, g, refreshToken)
+}
+
+// clientCredentialsGrant issues a token acting as the client's owner. It
+// comes without a refresh token, the client can simply ask again. All tokens
+// of the client share one grant covering every scope of the client, so
+// revoking any of them revokes all.
+func (h *Handler) clientCredentialsGrant(w http.ResponseWriter, r *http.Request, c *storer.OAuthClient) {
+	ctx := r.Context()
+	if c.SecretHash == nil {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "Public clients can't use client credentials")
+		return
+	}
+	scopes, ok := requestedScopes(c, r.PostForm.Get("scope"))
+	if !ok {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "The client may not request these scopes")
+		return
+	}
+	g, err := h.server.ClientCredentialsGrant(ctx, &storer.OAuthGrant{
+		ID:       uuid.NewString(),
+		ClientID: c.ID,
+		UserID:   c.OwnerID,
+		Scopes:   c.Scopes,
+	})
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	// the token only carries the scopes asked for this time
+	g.Scopes = strings.Join(scopes, ",")
+	h.writeOAuthAccessToken(ctx, w, c, g, "")
+}
+
+// issueOAuthTokens starts a new grant and responds with its first tokens.
+func (h *Handler) issueOAuthTokens(ctx context.Context, w http.ResponseWriter, c *storer.OAuthClient, userID int64, scopes []string) {
+	g := &storer.OAuthGrant{
+		ID:       uuid.NewString(),
+		ClientID: c.ID,
+		UserID:   userID,
+		Scopes:   strings.Join(scopes, ","),
+	}
+	refreshToken, err := util.RandomToken(32)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	rt := &storer.OAuthRefreshToken{
+		TokenHash: util.HashToken(refreshToken),
+		ExpiresAt: time.Now().Add(oauthRefreshTokenTTL),
+	}
+	if err := h.server.CreateOAuthGrant(ctx, g, rt); err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	h.writeOAuthAccessToken(ctx, w, c, g, refreshToken)
+}
+
+// writeOAuthAccessToken signs an access token for the grant. Its permissions
+// are the granted scopes the user still holds.
+func (h *Handler) writeOAuthAccessToken(ctx context.Context, w http.ResponseWriter, c *storer.OAuthClient, g *storer.OAuthGrant, refreshToken string) {
+	user, err := h.server.GetUserByID(ctx, g.UserID)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	roles, userPermissions, _, err := h.userAccess(ctx, user.ID)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	permissions := []string{}
+	for _, scope := range splitScopes(g.Scopes) {
+		if slices.Contains(userPermissions, scope) {
+			permissions = append(permissions, scope)
+		}
+	}
+	claims, err := token.NewUserClaims(token.TokenTypeAccess, user.ID, user.Email, roles, permissions, g.ID, oauthAccessTokenTTL)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	claims.ClientID = c.ID
+	accessToken, err := h.TokenMaker.SignClaims(claims)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	res := OAuthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(oauthAccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(permissions, " "),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// oauthGrantForToken finds the grant of a refresh or access token issued to c.
+func (h *Handler) oauthGrantForToken(ctx context.Context, c *storer.OAuthClient, tok string) *storer.OAuthGrant {
+	grantID := ""
+	if rt, err := h.server.GetOAuthRefreshToken(ctx, util.HashToken(tok)); err == nil {
+		grantID = rt.GrantID
+	} else if claims, err := h.TokenMaker.VerifyToken(token.TokenTypeAccess, tok); err == nil && claims.ClientID != "" {
+		grantID = claims.SessionID
+	}
+	if grantID == "" {
+		return nil
+	}
+	g, err := h.server.GetOAuthGrant(ctx, grantID)
+	if err != nil || g.ClientID != c.ID {
+		return nil
+	}
+	return g
+}
+
+// verifyOAuthGrant rejects access tokens whose grant has been revoked.
+func (h *Handler) verifyOAuthGrant(ctx context.Context, claims *token.UserClaims) error {
+	g, err := h.server.GetOAuthGrant(ctx, claims.SessionID)
+	if err != nil {
+		return err
+	}
+	if g.RevokedAt != nil || g.ClientID != claims.ClientID {
+		return errors.New("token has been revoked")
+	}
+	return nil
+}
+
+// requestedScopes parses a space separated scope parameter. Without one the
+// client gets all the scopes it is registered for.
+func requestedScopes(c *storer.OAuthClient, scope string) ([]string, bool) {
+	allowed := splitScopes(c.Scopes)
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		return allowed, true
+	}
+	for _, s := range scopes {
+		if !slices.Contains(allowed, s) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+func renderConsent(w http.ResponseWriter, status int, page consentPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// the consent screen must not be framed by the client. form-action is
+	// left out, browsers apply it to the redirect back to the client too.
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", apiCSP)
+	w.WriteHeader(status)
+	consentTemplate.Execute(w, page)
+}
+func redirectOAuth(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values, state string) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid redirect URI")
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if state != "" {
+		q.Set("state", state)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+func redirectOAuthError(w http.ResponseWriter, r *http.Request, redirectURI, state, code, description string) {
+	redirectOAuth(w, r, redirectURI, url.Values{"error": {code}, "error_description": {description}}, state)
+}
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OAuthErrorResponse{Error: code, ErrorDescription: description})
+}
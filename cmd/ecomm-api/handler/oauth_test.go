@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/hellwind2019/ecomm/util"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+var (
+	oauthClientColumns = []string{"id", "secret_hash", "name", "redirect_uris", "scopes", "owner_id", "revoked_at", "created_by", "created_at"}
+	oauthCodeColumns   = []string{"id", "code_hash", "client_id", "user_id", "redirect_uri", "scopes", "code_challenge", "expires_at", "used_at", "created_at"}
+	oauthGrantColumns  = []string{"id", "client_id", "user_id", "scopes", "client_credentials", "revoked_at", "created_at"}
+)
+
+// expectOAuthClient expects a lookup of a client. Clients with an empty
+// secret are public.
+func expectOAuthClient(mock sqlmock.Sqlmock, id, secret, scopes string) {
+	var secretHash any
+	if secret != "" {
+		secretHash = util.HashToken(secret)
+	}
+	mock.ExpectQuery("SELECT * FROM oauth_clients WHERE id = ?").WithArgs(id).
+		WillReturnRows(sqlmock.NewRows(oauthClientColumns).AddRow(id, secretHash, id, "https://"+id+".example.com/cb", scopes, 1, nil, nil, time.Now()))
+}
+
+func postOAuthForm(h func(http.ResponseWriter, *http.Request), form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestExchangeAuthorizationCode(t *testing.T) {
+	const verifier = "a-verifier-that-is-long-enough-for-pkce-0123456789"
+	tcs := []struct {
+		name     string
+		clientID string
+		form     url.Values
+	}{
+		{
+			name:     "PKCE mismatch",
+			clientID: "app",
+			form:     url.Values{"redirect_uri": {"https://app.example.com/cb"}, "code_verifier": {"another-verifier-that-is-long-enough-0123456789"}},
+		},
+		{
+			name:     "redirect URI mismatch",
+			clientID: "app",
+			form:     url.Values{"redirect_uri": {"https://evil.example.com/cb"}, "code_verifier": {verifier}},
+		},
+		{
+			name:     "other client",
+			clientID: "other",
+			form:     url.Values{"redirect_uri": {"https://app.example.com/cb"}, "code_verifier": {verifier}},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			h, mock := newSessionTestHandler(t)
+			expectOAuthClient(mock, tc.clientID, "", "orders:read")
+			mock.ExpectQuery("SELECT * FROM oauth_authorization_codes WHERE code_hash = ? AND used_at IS NULL AND expires_at > NOW()").WithArgs(util.HashToken("code")).
+				WillReturnRows(sqlmock.NewRows(oauthCodeColumns).AddRow(1, util.HashToken("code"), "app", 2, "https://app.example.com/cb", "orders:read", oauth2.S256ChallengeFromVerifier(verifier), time.Now().Add(time.Minute), nil, time.Now()))
+
+			// the code is left unused for the client it was issued to
+			tc.form.Set("grant_type", "authorization_code")
+			tc.form.Set("client_id", tc.clientID)
+			tc.form.Set("code", "code")
+			w := postOAuthForm(h.oauthToken, tc.form)
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			require.Contains(t, w.Body.String(), `"error":"invalid_grant"`)
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestOAuthAccessTokenScopes(t *testing.T) {
+	h, mock := newSessionTestHandler(t)
+	expectOAuthClient(mock, "app", "secret", "orders:read,orders:create")
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT * FROM oauth_grants WHERE client_id = ? AND client_credentials = TRUE AND revoked_at IS NULL LIMIT 1 FOR UPDATE").WithArgs("app").
+		WillReturnRows(sqlmock.NewRows(oauthGrantColumns).AddRow("grant", "app", 1, "orders:read,orders:create", true, nil, time.Now()))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT * FROM users WHERE id = ?").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "password", "is_admin", "created_at", "updated_at", "email_verified_at", "email_verification_sent_at"}).
+			AddRow(1, "john", "john@example.com", "hash", false, time.Now(), nil, nil, nil))
+	mock.ExpectQuery("SELECT r.name FROM roles r JOIN user_roles ur ON ur.role_id = r.id WHERE ur.user_id = ? ORDER BY r.name").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("customer"))
+	// the owner lost orders:create since registering the client
+	mock.ExpectQuery("SELECT DISTINCT rp.permission FROM role_permissions rp JOIN user_roles ur ON ur.role_id = rp.role_id WHERE ur.user_id = ? ORDER BY rp.permission").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"permission"}).AddRow("orders:read").AddRow("users:read"))
+
+	w := postOAuthForm(h.oauthToken, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {"app"},
+		"client_secret": {"secret"},
+		"scope":         {"orders:read orders:create"},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+	var res OAuthTokenResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	require.Equal(t, "orders:read", res.Scope)
+	claims, err := h.TokenMaker.VerifyToken(token.TokenTypeAccess, res.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders:read"}, claims.Permissions)
+	require.Equal(t, "app", claims.ClientID)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOAuthIntrospectOtherClient(t *testing.T) {
+	h, _ := newSessionTestHandler(t)
+	claims, err := token.NewUserClaims(token.TokenTypeAccess, 1, "john@example.com", nil, []string{"orders:read"}, "grant", time.Minute)
+	require.NoError(t, err)
+	claims.ClientID = "other"
+	accessToken, err := h.TokenMaker.SignClaims(claims)
+	require.NoError(t, err)
+
+	tcs := []struct {
+		name  string
+		token string
+		mock  func(sqlmock.Sqlmock)
+	}{
+		{
+			name:  "access token",
+			token: accessToken,
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT * FROM oauth_refresh_tokens WHERE token_hash = ?").WithArgs(util.HashToken(accessToken)).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+		},
+		{
+			name:  "refresh token",
+			token: "refresh",
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT * FROM oauth_refresh_tokens WHERE token_hash = ?").WithArgs(util.HashToken("refresh")).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "token_hash", "grant_id", "expires_at", "used_at", "created_at"}).
+						AddRow(1, util.HashToken("refresh"), "grant", time.Now().Add(time.Hour), nil, time.Now()))
+				mock.ExpectQuery("SELECT * FROM oauth_grants WHERE id = ?").WithArgs("grant").
+					WillReturnRows(sqlmock.NewRows(oauthGrantColumns).AddRow("grant", "other", 1, "orders:read", false, nil, time.Now()))
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			h, mock := newSessionTestHandler(t)
+			expectOAuthClient(mock, "app", "secret", "orders:read")
+			tc.mock(mock)
+
+			w := postOAuthForm(h.oauthIntrospect, url.Values{"client_id": {"app"}, "client_secret": {"secret"}, "token": {tc.token}})
+			require.Equal(t, http.StatusOK, w.Code)
+			require.JSONEq(t, `{"active":false}`, w.Body.String())
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,543 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hellwind2019/ecomm/rbac"
+)
+
+// apiAuth is what a route requires from the Authorization header.
+type apiAuth int
+
+const (
+	authNone apiAuth = iota
+	// authSession accepts access tokens of the user's own session only, see
+	// RequireSession.
+	authSession
+	// authPermission accepts any credential carrying the route's permission.
+	authPermission
+)
+
+// apiParam is a query parameter.
+type apiParam struct {
+	name        string
+	required    bool
+	description string
+}
+
+// oneOf documents a response that is one of several types.
+type oneOf []any
+
+// apiOperation documents one route registered in RegisterRoutes. The request
+// and response fields hold a value of the body type, nil means no body.
+type apiOperation struct {
+	method     string
+	path       string
+	tag        string
+	summary    string
+	auth       apiAuth
+	permission rbac.Permission
+	// pathParams overrides the schema type of path parameters, which are
+	// integers when named id and strings otherwise.
+	pathParams map[string]string
+	query      []apiParam
+	request    any
+	// form bodies are application/x-www-form-urlencoded instead of JSON.
+	form bool
+	// patch bodies are merge patches of the request type or JSON patches.
+	patch    bool
+	status   int
+	response any
+	// html, text and redirect responses have no JSON body.
+	html     bool
+	text     bool
+	redirect bool
+	// oauthErrors responses follow RFC 6749 instead of RFC 7807.
+	oauthErrors bool
+	// idempotent operations accept an Idempotency-Key header.
+	idempotent bool
+	// unversioned operations are served at their path only, the others
+	// under apiV1 and at their deprecated unversioned alias.
+	unversioned bool
+}
+
+// apiOperations must list every route of RegisterRoutes, TestOpenAPICoversRoutes
+// fails otherwise.
+var apiOperations = []apiOperation{
+	{method: "GET", path: "/healthz", tag: "Health", summary: "Check that the process is alive", status: http.StatusOK, response: HealthResponse{}, unversioned: true},
+	{method: "GET", path: "/readyz", tag: "Health", summary: "Check that the database is reachable and migrated, fails with 503 otherwise and while shutting down", status: http.StatusOK, response: ReadinessResponse{}, unversioned: true},
+	{method: "GET", path: "/version", tag: "Health", summary: "Show the build the server runs", status: http.StatusOK, response: VersionResponse{}, unversioned: true},
+	{method: "GET", path: "/metrics", tag: "Health", summary: "Metrics in the Prometheus text format", auth: authPermission, permission: rbac.MetricsRead, status: http.StatusOK, text: true, unversioned: true},
+
+	{method: "GET", path: "/openapi.json", tag: "Docs", summary: "This OpenAPI document", status: http.StatusOK, response: map[string]any{}, unversioned: true},
+	{method: "GET", path: "/docs", tag: "Docs", summary: "Swagger UI for this API", status: http.StatusOK, html: true, unversioned: true},
+
+	{method: "POST", path: "/products", tag: "Products", summary: "Create a product", auth: authPermission, permission: rbac.ProductsWrite, request: ProductRequest{}, status: http.StatusCreated, response: ProductResponse{}, idempotent: true},
+	{method: "GET", path: "/products", tag: "Products", summary: "List products", status: http.StatusOK, response: []ProductResponse{}},
+	{method: "GET", path: "/products/{id}", tag: "Products", summary: "Get a product", status: http.StatusOK, response: ProductResponse{}},
+	{method: "PATCH", path: "/products/{id}", tag: "Products", summary: "Update a product, the fields that may be changed depend on the caller's roles", auth: authPermission, permission: rbac.ProductsWrite, request: ProductRequest{}, patch: true, status: http.StatusOK, response: ProductResponse{}, idempotent: true},
+	{method: "DELETE", path: "/products/{id}", tag: "Products", summary: "Delete a product", auth: authPermission, permission: rbac.ProductsWrite, status: http.StatusNoContent, idempotent: true},
+
+	{method: "GET", path: "/myorder", tag: "Orders", summary: "Get the caller's order", auth: authPermission, permission: rbac.OrdersRead, status: http.StatusOK, response: OrderResponse{}},
+	{method: "POST", path: "/orders", tag: "Orders", summary: "Place an order", auth: authPermission, permission: rbac.OrdersCreate, request: OrderReq{}, status: http.StatusCreated, response: OrderResponse{}, idempotent: true},
+	{method: "GET", path: "/orders", tag: "Orders", summary: "List all orders", auth: authPermission, permission: rbac.OrdersReadAll, status: http.StatusOK, response: []OrderResponse{}},
+
+	{method: "POST", path: "/users", tag: "Users", summary: "Sign up", request: UserRequest{}, status: http.StatusCreated, response: UserResponse{}},
+	{method: "GET", path: "/users", tag: "Users", summary: "List users", auth: authPermission, permission: rbac.UsersRead, status: http.StatusOK, response: ListUserResponse{}},
+	{method: "PATCH", path: "/users", tag: "Users", summary: "Update the caller's name, email or password", auth: authSession, request: UserPatch{}, patch: true, status: http.StatusOK, response: UserResponse{}},
+	{method: "PATCH", path: "/users/{id}", tag: "Users", summary: "Update another user, including admin rights", auth: authPermission, permission: rbac.UsersManageRoles, request: UserPatch{}, patch: true, status: http.StatusOK, response: UserResponse{}},
+	{method: "DELETE", path: "/users/{id}", tag: "Users", summary: "Delete a user", auth: authPermission, permission: rbac.UsersDelete, status: http.StatusNoContent},
+	{method: "DELETE", path: "/users/{id}/lockout", tag: "Users", summary: "Clear failed login attempts of a user", auth: authPermission, permission: rbac.UsersUnlock, status: http.StatusNoContent},
+	{method: "PUT", path: "/users/{id}/roles/{role}", tag: "Users", summary: "Grant a role", auth: authPermission, permission: rbac.UsersManageRoles, status: http.StatusNoContent},
+	{method: "DELETE", path: "/users/{id}/roles/{role}", tag: "Users", summary: "Revoke a role", auth: authPermission, permission: rbac.UsersManageRoles, status: http.StatusNoContent},
+	{method: "GET", path: "/users/{id}/sessions", tag: "Users", summary: "List the sessions of a user", auth: authPermission, permission: rbac.SessionsManage, status: http.StatusOK, response: ListSessionsResponse{}},
+	{method: "DELETE", path: "/users/{id}/sessions", tag: "Users", summary: "Revoke all sessions of a user", auth: authPermission, permission: rbac.SessionsManage, status: http.StatusNoContent},
+	{method: "DELETE", path: "/users/{id}/sessions/{sessionID}", tag: "Users", summary: "Revoke a session of a user", auth: authPermission, permission: rbac.SessionsManage, status: http.StatusNoContent},
+
+	{method: "POST", path: "/users/login", tag: "Authentication", summary: "Log in with email and password", request: LoginUserRequest{}, status: http.StatusOK, response: oneOf{LoginUserResponse{}, MFAChallengeResponse{}}},
+	{method: "POST", path: "/users/login/mfa", tag: "Authentication", summary: "Finish a login with a two-factor code", request: LoginMFARequest{}, status: http.StatusOK, response: LoginUserResponse{}},
+	{method: "POST", path: "/users/logout", tag: "Authentication", summary: "End the current session", auth: authSession, status: http.StatusNoContent},
+	{method: "POST", path: "/users/password/forgot", tag: "Authentication", summary: "Email a password reset link", request: ForgotPasswordRequest{}, status: http.StatusAccepted},
+	{method: "POST", path: "/users/password/reset", tag: "Authentication", summary: "Choose a new password with a reset token", request: ResetPasswordRequest{}, status: http.StatusNoContent},
+	{method: "GET", path: "/users/verify", tag: "Authentication", summary: "Verify the email address from the emailed link", query: []apiParam{{name: "token", required: true}}, status: http.StatusOK, response: UserResponse{}},
+	{method: "POST", path: "/users/verify", tag: "Authentication", summary: "Verify the email address", request: VerifyEmailRequest{}, status: http.StatusOK, response: UserResponse{}},
+	{method: "POST", path: "/users/verify/resend", tag: "Authentication", summary: "Send the verification email again", auth: authSession, status: http.StatusAccepted},
+	{method: "GET", path: "/users/oidc/{provider}/login", tag: "Authentication", summary: "Sign in with an OpenID Connect provider", status: http.StatusFound, redirect: true},
+	{method: "GET", path: "/users/oidc/{provider}/callback", tag: "Authentication", summary: "Finish signing in with an OpenID Connect provider", query: []apiParam{{name: "code"}, {name: "state", required: true}, {name: "error"}}, status: http.StatusOK, response: oneOf{LoginUserResponse{}, MFAChallengeResponse{}, IdentityResponse{}}},
+	{method: "POST", path: "/tokens/renew", tag: "Authentication", summary: "Get a new access token with a refresh token", auth: authSession, request: RenewAccessTokenRequest{}, status: http.StatusOK, response: RenewAccessTokenResponse{}},
+	{method: "POST", path: "/tokens/revoke", tag: "Authentication", summary: "Revoke the current session", auth: authSession, status: http.StatusNoContent},
+
+	{method: "GET", path: "/me/sessions", tag: "Account", summary: "List the caller's sessions", auth: authSession, status: http.StatusOK, response: ListSessionsResponse{}},
+	{method: "DELETE", path: "/me/sessions", tag: "Account", summary: "Revoke all other sessions of the caller", auth: authSession, status: http.StatusNoContent},
+	{method: "DELETE", path: "/me/sessions/{sessionID}", tag: "Account", summary: "Revoke a session of the caller", auth: authSession, status: http.StatusNoContent},
+	{method: "GET", path: "/me/identities", tag: "Account", summary: "List linked OpenID Connect identities", auth: authSession, status: http.StatusOK, response: ListIdentitiesResponse{}},
+	{method: "POST", path: "/me/identities/{provider}", tag: "Account", summary: "Start linking an OpenID Connect identity", auth: authSession, status: http.StatusOK, response: LinkIdentityResponse{}},
+	{method: "DELETE", path: "/me/identities/{provider}", tag: "Account", summary: "Unlink an OpenID Connect identity", auth: authSession, status: http.StatusNoContent},
+	{method: "POST", path: "/me/2fa/totp", tag: "Account", summary: "Start enrolling an authenticator app", auth: authSession, status: http.StatusCreated, response: TOTPEnrollResponse{}},
+	{method: "POST", path: "/me/2fa/totp/verify", tag: "Account", summary: "Confirm the authenticator app enrollment", auth: authSession, request: TOTPCodeRequest{}, status: http.StatusOK, response: RecoveryCodesResponse{}},
+	{method: "DELETE", path: "/me/2fa/totp", tag: "Account", summary: "Disable two-factor authentication", auth: authSession, request: TOTPCodeRequest{}, status: http.StatusNoContent},
+	{method: "POST", path: "/me/2fa/recovery-codes", tag: "Account", summary: "Replace the recovery codes", auth: authSession, request: TOTPCodeRequest{}, status: http.StatusOK, response: RecoveryCodesResponse{}},
+
+	{method: "POST", path: "/api-keys", tag: "API keys", summary: "Create an API key, the key is only returned once", auth: authPermission, permission: rbac.APIKeysManage, request: CreateAPIKeyRequest{}, status: http.StatusCreated, response: CreateAPIKeyResponse{}},
+	{method: "GET", path: "/api-keys", tag: "API keys", summary: "List API keys", auth: authPermission, permission: rbac.APIKeysManage, status: http.StatusOK, response: ListAPIKeysResponse{}},
+	{method: "DELETE", path: "/api-keys/{id}", tag: "API keys", summary: "Revoke an API key", auth: authPermission, permission: rbac.APIKeysManage, status: http.StatusNoContent},
+
+	{method: "GET", path: "/oauth/authorize", tag: "OAuth", summary: "Show the consent page to the user", query: oauthAuthorizeParams, status: http.StatusOK, html: true},
+	{method: "POST", path: "/oauth/authorize", tag: "OAuth", summary: "Approve or deny the consent page", query: oauthAuthorizeParams, request: OAuthConsentForm{}, form: true, status: http.StatusFound, redirect: true},
+	{method: "POST", path: "/oauth/token", tag: "OAuth", summary: "Exchange a grant for tokens", request: OAuthTokenForm{}, form: true, status: http.StatusOK, response: OAuthTokenResponse{}, oauthErrors: true},
+	{method: "POST", path: "/oauth/revoke", tag: "OAuth", summary: "Revoke a token (RFC 7009)", request: OAuthRevocationForm{}, form: true, status: http.StatusOK, oauthErrors: true},
+	{method: "POST", path: "/oauth/introspect", tag: "OAuth", summary: "Inspect a token (RFC 7662)", request: OAuthRevocationForm{}, form: true, status: http.StatusOK, response: IntrospectionResponse{}, oauthErrors: true},
+	{method: "POST", path: "/oauth/clients", tag: "OAuth", summary: "Register a third-party app, the secret is only returned once", auth: authPermission, permission: rbac.OAuthClientsManage, request: CreateOAuthClientRequest{}, status: http.StatusCreated, response: CreateOAuthClientResponse{}},
+	{method: "GET", path: "/oauth/clients", tag: "OAuth", summary: "List third-party apps", auth: authPermission, permission: rbac.OAuthClientsManage, status: http.StatusOK, response: ListOAuthClientsResponse{}},
+	{method: "DELETE", path: "/oauth/clients/{id}", tag: "OAuth", summary: "Revoke a third-party app and all its tokens", auth: authPermission, permission: rbac.OAuthClientsManage, pathParams: map[string]string{"id": "string"}, status: http.StatusNoContent},
+}
+
+var oauthAuthorizeParams = []apiParam{
+	{name: "response_type", required: true, description: "Must be code"},
+	{name: "client_id", required: true},
+	{name: "redirect_uri", required: true},
+	{name: "scope", description: "Permissions separated by spaces"},
+	{name: "state"},
+	{name: "code_challenge", required: true},
+	{name: "code_challenge_method", required: true, description: "Must be S256"},
+}
+
+// openAPIDocument is built once, it only depends on the tables above.
+var openAPIDocument = sync.OnceValues(func() ([]byte, error) {
+	return json.Marshal(newOpenAPIDocument())
+})
+
+// /openapi.json
+func (h *Handler) openAPI(w http.ResponseWriter, r *http.Request) {
+	doc, err := openAPIDocument()
+	if err != nil {
+		writeError(w, err, "Failed to build OpenAPI document")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
+
+const swaggerUIScript = `
+window.onload = () => { window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" }); };
+`
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>ecomm API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+<script>` + swaggerUIScript + `</script>
+</body>
+</html>
+`
+
+// swaggerUICSP allows Swagger UI from unpkg, its inline styles and the inline
+// script that starts it.
+var swaggerUICSP = "default-src 'none'; script-src https://unpkg.com " + scriptHash(swaggerUIScript) +
+	"; style-src https://unpkg.com 'unsafe-inline'; img-src 'self' data:; connect-src 'self'; frame-ancestors 'none'"
+
+// /docs
+func (h *Handler) swaggerUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", swaggerUICSP)
+	w.Write([]byte(swaggerUIPage))
+}
+
+func newOpenAPIDocument() map[string]any {
+	b := &schemaBuilder{schemas: map[string]any{}}
+	problem := b.schema(reflect.TypeOf(Problem{}))
+	oauthError := b.schema(reflect.TypeOf(OAuthErrorResponse{}))
+	b.schemas["JSONPatch"] = map[string]any{
+		"type": "array",
+		"items": map[string]any{
+			"type":     "object",
+			"required": []string{"op", "path"},
+			"properties": map[string]any{
+				"op":    map[string]any{"type": "string", "enum": []string{"add", "remove", "replace", "move", "copy", "test"}},
+				"path":  map[string]any{"type": "string"},
+				"from":  map[string]any{"type": "string"},
+				"value": map[string]any{},
+			},
+		},
+	}
+
+	paths := map[string]map[string]any{}
+	for _, op := range apiOperations {
+		o := map[string]any{
+			"tags":        []string{op.tag},
+			"summary":     op.summary,
+			"operationId": operationID(op),
+		}
+		var params []any
+		for _, name := range pathParamNames(op.path) {
+			typ := "string"
+			if name == "id" {
+				typ = "integer"
+			}
+			if t, ok := op.pathParams[name]; ok {
+				typ = t
+			}
+			s := map[string]any{"type": typ}
+			if name == "role" {
+				s["enum"] = rbac.Roles
+			}
+			params = append(params, map[string]any{"name": name, "in": "path", "required": true, "schema": s})
+		}
+		for _, p := range op.query {
+			param := map[string]any{"name": p.name, "in": "query", "required": p.required, "schema": map[string]any{"type": "string"}}
+			if p.description != "" {
+				param["description"] = p.description
+			}
+			params = append(params, param)
+		}
+		if op.idempotent {
+			params = append(params, map[string]any{
+				"name":        idempotencyKeyHeader,
+				"in":          "header",
+				"description": "Retries with the same key get the response of the first request back instead of running it again, for 24 hours. The key must not be reused for a different request.",
+				"schema":      map[string]any{"type": "string", "maxLength": maxIdempotencyKeyLength},
+			})
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+
+		if op.request != nil {
+			s := b.schema(reflect.TypeOf(op.request))
+			content := map[string]any{"application/json": map[string]any{"schema": s}}
+			switch {
+			case op.form:
+				content = map[string]any{"application/x-www-form-urlencoded": map[string]any{"schema": s}}
+			case op.patch:
+				content = map[string]any{
+					mergePatchType: map[string]any{"schema": b.mergePatchSchema(reflect.TypeOf(op.request))},
+					jsonPatchType:  map[string]any{"schema": ref("JSONPatch")},
+				}
+			}
+			o["requestBody"] = map[string]any{"required": true, "content": content}
+		}
+
+		res := map[string]any{"description": http.StatusText(op.status)}
+		switch {
+		case op.html:
+			res["content"] = map[string]any{"text/html": map[string]any{"schema": map[string]any{"type": "string"}}}
+		case op.text:
+			res["content"] = map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}}
+		case op.redirect:
+			res["headers"] = map[string]any{"Location": map[string]any{"schema": map[string]any{"type": "string"}}}
+		case op.response != nil:
+			res["content"] = map[string]any{"application/json": map[string]any{"schema": b.responseSchema(op.response)}}
+		}
+		errRes := map[string]any{"description": "Error", "content": map[string]any{"application/problem+json": map[string]any{"schema": problem}}}
+		if op.oauthErrors {
+			errRes["content"] = map[string]any{"application/json": map[string]any{"schema": oauthError}}
+		}
+		o["responses"] = map[string]any{strconv.Itoa(op.status): res, "default": errRes}
+
+		switch op.auth {
+		case authSession:
+			o["security"] = []any{map[string]any{"bearerAuth": []string{}}}
+			o["description"] = "Only accepts access tokens of the user's own session, not API keys or tokens of third-party apps."
+		case authPermission:
+			scopes := []string{string(op.permission)}
+			o["security"] = []any{
+				map[string]any{"bearerAuth": scopes},
+				map[string]any{"apiKeyAuth": scopes},
+				map[string]any{"oauth2": scopes},
+			}
+			o["x-required-permission"] = op.permission
+		}
+
+		if op.unversioned {
+			addOperation(paths, op.path, op.method, o)
+			continue
+		}
+		addOperation(paths, apiV1+op.path, op.method, o)
+		legacy := maps.Clone(o)
+		legacy["operationId"] = o["operationId"].(string) + "Unversioned"
+		legacy["deprecated"] = true
+		description, _ := o["description"].(string)
+		legacy["description"] = strings.TrimSpace(fmt.Sprintf("Deprecated alias of %s%s. %s", apiV1, op.path, description))
+		addOperation(paths, op.path, op.method, legacy)
+	}
+
+	scopes := map[string]string{}
+	for _, p := range rbac.Permissions {
+		scopes[string(p)] = fmt.Sprintf("The %s permission", p)
+	}
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "ecomm API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+					"description":  "Access token from " + apiV1 + "/users/login or " + apiV1 + "/oauth/token",
+				},
+				"apiKeyAuth": map[string]any{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "Authorization",
+					"description": `API key sent as "ApiKey <key>"`,
+				},
+				"oauth2": map[string]any{
+					"type": "oauth2",
+					"flows": map[string]any{
+						"authorizationCode": map[string]any{
+							"authorizationUrl": apiV1 + "/oauth/authorize",
+							"tokenUrl":         apiV1 + "/oauth/token",
+							"refreshUrl":       apiV1 + "/oauth/token",
+							"scopes":           scopes,
+						},
+						"clientCredentials": map[string]any{
+							"tokenUrl": apiV1 + "/oauth/token",
+							"scopes":   scopes,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func addOperation(paths map[string]map[string]any, path, method string, o map[string]any) {
+	if paths[path] == nil {
+		paths[path] = map[string]any{}
+	}
+	paths[path][strings.ToLower(method)] = o
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+func pathParamNames(path string) []string {
+	var names []string
+	for _, m := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+// operationID turns "DELETE /users/{id}/roles/{role}" into
+// "deleteUsersIdRolesRole".
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.method)
+	for _, part := range strings.FieldsFunc(op.path, func(r rune) bool {
+		return r == '/' || r == '{' || r == '}' || r == '-' || r == '.' || r == '_'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+func ref(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+// schemaBuilder turns Go types into JSON schemas. Named structs become
+// components, json tags give the property names and validate tags the
+// constraints.
+type schemaBuilder struct {
+	schemas map[string]any
+}
+
+func (b *schemaBuilder) responseSchema(v any) map[string]any {
+	if alts, ok := v.(oneOf); ok {
+		var schemas []any
+		for _, alt := range alts {
+			schemas = append(schemas, b.schema(reflect.TypeOf(alt)))
+		}
+		return map[string]any{"oneOf": schemas}
+	}
+	return b.schema(reflect.TypeOf(v))
+}
+
+// mergePatchSchema is the object schema of t without required fields, as
+// merge patches only contain the fields they change.
+func (b *schemaBuilder) mergePatchSchema(t reflect.Type) map[string]any {
+	name := strings.TrimSuffix(strings.TrimSuffix(t.Name(), "Request"), "Patch") + "MergePatch"
+	if _, ok := b.schemas[name]; !ok {
+		s := b.object(t)
+		delete(s, "required")
+		b.schemas[name] = s
+	}
+	return ref(name)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		s := b.schema(t.Elem())
+		if typ, ok := s["type"].(string); ok {
+			s["type"] = []string{typ, "null"}
+			return s
+		}
+		return map[string]any{"oneOf": []any{s, map[string]any{"type": "null"}}}
+	case t.Kind() == reflect.Struct:
+		if _, ok := b.schemas[t.Name()]; !ok {
+			// reserve the name first so that recursive types terminate
+			b.schemas[t.Name()] = map[string]any{}
+			b.schemas[t.Name()] = b.object(t)
+		}
+		return ref(t.Name())
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]any{"type": "number"}
+	}
+	return map[string]any{}
+}
+
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				addFields(f.Type)
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			s := b.schema(f.Type)
+			if applyRules(s, f.Tag.Get("validate")) {
+				required = append(required, name)
+			}
+			props[name] = s
+		}
+	}
+	addFields(t)
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+// applyRules adds the constraints of a validate tag to s and reports whether
+// the field is required. Rules after dive apply to the items of a list.
+func applyRules(s map[string]any, tag string) bool {
+	if tag == "" {
+		return false
+	}
+	rules, itemRules, dive := strings.Cut(tag, ",dive")
+	if dive {
+		if items, ok := s["items"].(map[string]any); ok {
+			applyRules(items, strings.TrimPrefix(itemRules, ","))
+		}
+	}
+	required := false
+	typ, _ := s["type"].(string)
+	for _, rule := range strings.Split(rules, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		n, _ := strconv.ParseFloat(param, 64)
+		switch name {
+		case "required":
+			required = true
+		case "email":
+			s["format"] = "email"
+		case "url":
+			s["format"] = "uri"
+		case "oneof":
+			s["enum"] = strings.Fields(param)
+		case "min", "max":
+			key := map[string]string{"string": "Length", "array": "Items"}[typ]
+			if key == "" {
+				s[map[string]string{"min": "minimum", "max": "maximum"}[name]] = n
+			} else {
+				s[name+key] = n
+			}
+		case "gt":
+			s["exclusiveMinimum"] = n
+		case "gte":
+			s["minimum"] = n
+		case "lt":
+			s["exclusiveMaximum"] = n
+		case "lte":
+			s["maximum"] = n
+		}
+	}
+	return required
+}
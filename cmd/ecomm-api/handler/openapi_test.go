@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOpenAPICoversRoutes fails when a route is registered without being
+// documented in apiOperations, or documented without being registered.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	registered := map[string]bool{}
+	err := chi.Walk(RegisterRoutes(&Handler{}), func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if route != "/" {
+			route = strings.TrimSuffix(route, "/")
+		}
+		registered[method+" "+route] = true
+		return nil
+	})
+	require.NoError(t, err)
+
+	raw, err := openAPIDocument()
+	require.NoError(t, err)
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(raw, &doc))
+	documented := map[string]bool{}
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	for route := range registered {
+		require.True(t, documented[route], "%s is missing from apiOperations", route)
+	}
+	for route := range documented {
+		require.True(t, registered[route], "%s is documented but not registered", route)
+	}
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	raw, err := openAPIDocument()
+	require.NoError(t, err)
+	var doc struct {
+		Components struct {
+			Schemas map[string]struct {
+				Required   []string                  `json:"required"`
+				Properties map[string]map[string]any `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.Unmarshal(raw, &doc))
+
+	user := doc.Components.Schemas["UserRequest"]
+	require.Equal(t, []string{"email", "name", "password"}, user.Required)
+	require.Equal(t, "email", user.Properties["email"]["format"])
+	require.Equal(t, float64(128), user.Properties["password"]["maxLength"])
+
+	order := doc.Components.Schemas["OrderReq"]
+	require.Equal(t, float64(1), order.Properties["items"]["minItems"])
+
+	// embedded structs are flattened
+	key := doc.Components.Schemas["CreateAPIKeyResponse"]
+	require.Contains(t, key.Properties, "key")
+	require.Contains(t, key.Properties, "prefix")
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/mailer"
+	"github.com/hellwind2019/ecomm/util"
+)
+
+const passwordResetTTL = 30 * time.Minute
+
+// passwordResetSendTimeout bounds the background work of a reset request,
+// which no longer has the request's deadline.
+const passwordResetSendTimeout = 30 * time.Second
+
+// passwordResetInterval is the minimum time between two reset emails to the
+// same account, so nobody can flood an inbox from many IPs.
+const passwordResetInterval = 5 * time.Minute
+
+// /users/password/forgot
+// The response is the same whether or not the email belongs to an account:
+// the reset mail is sent in the background and failures are only logged, so
+// neither the status nor the response time gives the account away. Requests
+// for an account that got a reset email recently are dropped the same way.
+func (h *Handler) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if !decodeAndValidate(w, r, &req) {
+		return
+	}
+	ctx := context.WithoutCancel(r.Context())
+	queued := h.background.enqueue(func() {
+		ctx, cancel := context.WithTimeout(ctx, passwordResetSendTimeout)
+		defer cancel()
+		if err := h.sendPasswordReset(ctx, req.Email); err != nil {
+			slog.ErrorContext(ctx, "failed to send password reset", "error", err)
+		}
+	})
+	if !queued {
+		slog.WarnContext(ctx, "dropped password reset, background queue is full")
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendPasswordReset mails a reset link to the account with the given email,
+// if there is one.
+func (h *Handler) sendPasswordReset(ctx context.Context, email string) error {
+	user, err := h.server.GetUser(ctx, email)
+	if errors.Is(err, storer.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ok, err := h.server.MarkPasswordResetSent(ctx, user.ID, passwordResetInterval)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		slog.InfoContext(ctx, "skipped password reset, one was sent recently", "user_id", user.ID)
+		return nil
+	}
+	resetToken, err := util.RandomToken(32)
+	if err != nil {
+		return err
+	}
+	_, err = h.server.CreatePasswordReset(ctx, &storer.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: util.HashToken(resetToken),
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+	return h.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password. It expires in %d minutes and can only be used once.\n\n%s/reset-password?token=%s\n\nIf you didn't ask for a password reset you can ignore this email.\n",
+			user.Name, int(passwordResetTTL.Minutes()), h.publicURL, url.QueryEscape(resetToken)),
+	})
+}
+
+// /users/password/reset
+func (h *Handler) resetPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req ResetPasswordRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if errs := h.checkPassword(validationErrors(&req), req.Password, ""); len(errs) > 0 {
+		writeValidationProblem(w, errs)
+		return
+	}
+	pr, err := h.server.GetPasswordReset(ctx, util.HashToken(req.Token))
+	if errors.Is(err, storer.ErrInvalidToken) {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidToken, "Invalid or expired token")
+		return
+	}
+	if err != nil {
+		writeError(w, err, "Failed to get reset token")
+		return
+	}
+	hashed, err := hashPassword(ctx, req.Password)
+	if err != nil {
+		writeError(w, err, "Failed to hash password")
+		return
+	}
+	err = h.server.ResetPassword(ctx, pr, hashed)
+	if errors.Is(err, storer.ErrInvalidToken) {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidToken, "Invalid or expired token")
+		return
+	}
+	if err != nil {
+		writeError(w, err, "Failed to reset password")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkPassword adds a password policy violation to errs unless the password
+// is empty or already failed its validate tags.
+func (h *Handler) checkPassword(errs []FieldError, password, email string) []FieldError {
+	if password == "" || slices.ContainsFunc(errs, func(e FieldError) bool { return e.Field == "password" }) {
+		return errs
+	}
+	if err := h.passwordPolicy.Validate(password, email); err != nil {
+		errs = append(errs, FieldError{Field: "password", Code: "password_policy", Message: err.Error()})
+	}
+	return errs
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/server"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/mailer"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+// failingMailer reports every message on sent and fails to deliver it.
+type failingMailer struct {
+	sent chan mailer.Message
+}
+
+func (m failingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.sent <- msg
+	return errors.New("smtp server unavailable")
+}
+
+func TestForgotPassword(t *testing.T) {
+	markResetSent := `
+		UPDATE users SET password_reset_sent_at = NOW()
+		WHERE id = ? AND (password_reset_sent_at IS NULL OR password_reset_sent_at < NOW() - INTERVAL ? SECOND)
+	`
+	userColumns := []string{"id", "name", "email", "password", "is_admin", "created_at", "updated_at", "email_verified_at", "email_verification_sent_at"}
+	tcs := []struct {
+		name string
+		mock func(sqlmock.Sqlmock)
+		mail bool
+	}{
+		{
+			name: "unknown email",
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT * FROM users WHERE email = ?").WithArgs("john@example.com").WillReturnError(storer.ErrNotFound)
+			},
+		},
+		{
+			name: "sent recently",
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT * FROM users WHERE email = ?").WithArgs("john@example.com").
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "john", "john@example.com", "hash", false, time.Now(), nil, nil, nil))
+				mock.ExpectExec(markResetSent).WithArgs(1, 300).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+		},
+		{
+			name: "mail fails",
+			mock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT * FROM users WHERE email = ?").WithArgs("john@example.com").
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "john", "john@example.com", "hash", false, time.Now(), nil, nil, nil))
+				mock.ExpectExec(markResetSent).WithArgs(1, 300).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (?, ?, ?)").
+					WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			mail: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			require.NoError(t, err)
+			defer mockDB.Close()
+			tc.mock(mock)
+			m := failingMailer{sent: make(chan mailer.Message, 1)}
+			h := NewHandler(server.NewServer(storer.NewMySQLStorer(sqlx.NewDb(mockDB, "sqlmock"))), Config{Mailer: m})
+
+			w := httptest.NewRecorder()
+			h.forgotPassword(w, httptest.NewRequest(http.MethodPost, "/users/password/forgot", strings.NewReader(`{"email":"john@example.com"}`)))
+			require.Equal(t, http.StatusAccepted, w.Code)
+			require.Empty(t, w.Body.String())
+
+			require.NoError(t, h.Drain(context.Background()))
+			if tc.mail {
+				require.Len(t, m.sent, 1)
+				require.Equal(t, "john@example.com", (<-m.sent).To)
+			} else {
+				require.Empty(t, m.sent)
+			}
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/hellwind2019/ecomm/rbac"
+	"github.com/hellwind2019/ecomm/token"
+)
+
+// PATCH endpoints accept RFC 7396 merge patches and RFC 6902 JSON patches.
+// Plain application/json is treated as a merge patch.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// productPatchFields lists the product fields each permission allows to
+// patch. Ratings follow from reviews, only moderators may correct them.
+var productPatchFields = map[rbac.Permission][]string{
+	rbac.ProductsWrite:    {"name", "image", "category", "description", "price", "count_in_stock"},
+	rbac.ProductsModerate: {"rating", "num_reviews"},
+}
+
+// userPatchFields lists the fields of other accounts each permission allows
+// to patch through /users/{id}. Passwords are only ever changed by their
+// owner.
+var userPatchFields = map[rbac.Permission][]string{
+	rbac.UsersManageRoles: {"name", "email", "is_admin"},
+}
+
+// ownUserPatchFields are the fields users may patch on their own account.
+var ownUserPatchFields = []string{"name", "email", "password"}
+
+// allowedPatchFields returns the fields any of the caller's permissions allows
+// to patch. Permissions rather than roles decide, since API keys and
+// third-party apps carry their owner's roles but only their scopes as
+// permissions.
+func allowedPatchFields(claims *token.UserClaims, byPermission map[rbac.Permission][]string) []string {
+	var fields []string
+	for _, p := range claims.Permissions {
+		for _, f := range byPermission[rbac.Permission(p)] {
+			if !slices.Contains(fields, f) {
+				fields = append(fields, f)
+			}
+		}
+	}
+	return fields
+}
+
+// decodePatch applies the patch in the request body to doc, which holds the
+// current state of the resource. A field that the patch leaves out keeps its
+// value, a field set to null or removed is reset to its zero value. Only
+// top-level fields in allowed may be changed. decodePatch writes the problem
+// response itself and returns false when the patch is rejected, the caller
+// still has to validate doc.
+func decodePatch(w http.ResponseWriter, r *http.Request, doc any, allowed []string) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != jsonPatchType && mediaType != "application/json" {
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		writeProblem(w, http.StatusUnsupportedMediaType, CodeUnsupportedMedia, fmt.Sprintf("Content-Type must be %s or %s", mergePatchType, jsonPatchType))
+		return false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeProblem(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("Request body must not be larger than %d bytes", maxBodyBytes))
+		return false
+	}
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Failed to read request body")
+		return false
+	}
+	current, err := json.Marshal(doc)
+	if err != nil {
+		writeError(w, err, "Failed to encode resource")
+		return false
+	}
+
+	var patched []byte
+	if mediaType == jsonPatchType {
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidPatch, "Request body is not a valid JSON patch")
+			return false
+		}
+		patched, err = patch.Apply(current)
+		if errors.Is(err, jsonpatch.ErrTestFailed) {
+			writeProblem(w, http.StatusConflict, CodePatchTestFailed, "A test operation failed, the resource was not changed")
+			return false
+		}
+		if err != nil {
+			writeProblem(w, http.StatusUnprocessableEntity, CodeInvalidPatch, "The patch cannot be applied to the resource")
+			return false
+		}
+	} else {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(body, &obj); err != nil || obj == nil {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidPatch, "Request body must be a JSON object")
+			return false
+		}
+		patched, err = jsonpatch.MergePatch(current, body)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidPatch, "Request body is not a valid merge patch")
+			return false
+		}
+	}
+
+	// Fields are compared rather than read off the patch, so sending a field
+	// with its current value is fine. Unknown fields are left to decodeJSON.
+	var before, after map[string]any
+	if err := json.Unmarshal(current, &before); err != nil {
+		writeError(w, err, "Failed to encode resource")
+		return false
+	}
+	if err := json.Unmarshal(patched, &after); err != nil {
+		writeProblem(w, http.StatusUnprocessableEntity, CodeInvalidPatch, "The patched resource must be a JSON object")
+		return false
+	}
+	var errs []FieldError
+	for f, v := range before {
+		if !reflect.DeepEqual(v, after[f]) && !slices.Contains(allowed, f) {
+			errs = append(errs, FieldError{Field: f, Code: "not_allowed", Message: "may not be changed by you"})
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		writeProblemWithErrors(w, http.StatusForbidden, CodeFieldNotAllowed, "The patch changes fields you may not change", errs)
+		return false
+	}
+
+	reflect.ValueOf(doc).Elem().SetZero()
+	return decodeJSON(w, bytes.NewReader(patched), doc)
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hellwind2019/ecomm/rbac"
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodePatch(t *testing.T) {
+	current := ProductRequest{
+		Name:         "book",
+		Category:     "books",
+		Description:  "a book",
+		Rating:       4,
+		Price:        10,
+		CountInStock: 5,
+	}
+	catalogManager := allowedPatchFields(&token.UserClaims{Permissions: []string{string(rbac.OrdersCreate), string(rbac.ProductsWrite)}}, productPatchFields)
+
+	tcs := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		want        ProductRequest
+	}{
+		{
+			name:        "merge patch distinguishes absent, null and zero",
+			contentType: mergePatchType,
+			body:        `{"description":null,"count_in_stock":0}`,
+			status:      http.StatusOK,
+			want:        ProductRequest{Name: "book", Category: "books", Rating: 4, Price: 10},
+		},
+		{
+			name:        "plain json is a merge patch",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"name":"novel"}`,
+			status:      http.StatusOK,
+			want:        ProductRequest{Name: "novel", Category: "books", Description: "a book", Rating: 4, Price: 10, CountInStock: 5},
+		},
+		{
+			name:        "json patch",
+			contentType: jsonPatchType,
+			body:        `[{"op":"test","path":"/count_in_stock","value":5},{"op":"replace","path":"/count_in_stock","value":0},{"op":"remove","path":"/description"}]`,
+			status:      http.StatusOK,
+			want:        ProductRequest{Name: "book", Category: "books", Rating: 4, Price: 10},
+		},
+		{
+			name:        "failed test operation",
+			contentType: jsonPatchType,
+			body:        `[{"op":"test","path":"/count_in_stock","value":3},{"op":"replace","path":"/count_in_stock","value":0}]`,
+			status:      http.StatusConflict,
+		},
+		{
+			name:        "field not allowed for role",
+			contentType: mergePatchType,
+			body:        `{"rating":5}`,
+			status:      http.StatusForbidden,
+		},
+		{
+			name:        "unchanged field not allowed for role",
+			contentType: mergePatchType,
+			body:        `{"rating":4,"price":12}`,
+			status:      http.StatusOK,
+			want:        ProductRequest{Name: "book", Category: "books", Description: "a book", Rating: 4, Price: 12, CountInStock: 5},
+		},
+		{
+			name:        "unknown field",
+			contentType: mergePatchType,
+			body:        `{"discount":5}`,
+			status:      http.StatusBadRequest,
+		},
+		{
+			name:        "unsupported content type",
+			contentType: "text/plain",
+			body:        `{"name":"novel"}`,
+			status:      http.StatusUnsupportedMediaType,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.contentType)
+			doc := current
+			ok := decodePatch(w, r, &doc, catalogManager)
+			require.Equal(t, tc.status, w.Code)
+			require.Equal(t, tc.status == http.StatusOK, ok)
+			if ok {
+				require.Equal(t, tc.want, doc)
+			}
+		})
+	}
+}
+
+func TestAllowedPatchFields(t *testing.T) {
+	admin := &token.UserClaims{
+		Roles:       []string{rbac.RoleAdmin},
+		Permissions: []string{string(rbac.ProductsWrite), string(rbac.ProductsModerate), string(rbac.UsersManageRoles)},
+	}
+	require.Contains(t, allowedPatchFields(admin, productPatchFields), "rating")
+
+	// an admin's key scoped to products:write only gets the catalog fields
+	scopedKey := &token.UserClaims{
+		Roles:       []string{rbac.RoleAdmin},
+		Permissions: []string{string(rbac.ProductsWrite)},
+		APIKeyID:    1,
+	}
+	require.ElementsMatch(t, []string{"name", "image", "category", "description", "price", "count_in_stock"}, allowedPatchFields(scopedKey, productPatchFields))
+	require.Empty(t, allowedPatchFields(scopedKey, userPatchFields))
+}
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hellwind2019/ecomm/token"
+)
+
+// RateLimitPolicy allows bursts of Requests, refilled evenly over Per. A zero
+// Requests disables the policy.
+type RateLimitPolicy struct {
+	Name     string
+	Requests int
+	Per      time.Duration
+}
+
+// Names of the policies RegisterRoutes applies.
+const (
+	// RateLimitDefault covers every route, keyed by client IP.
+	RateLimitDefault = "default"
+	// RateLimitAuth covers the routes that check passwords or send mail.
+	RateLimitAuth = "auth"
+	// RateLimitOrders covers placing orders, keyed by user.
+	RateLimitOrders = "orders"
+)
+
+// DefaultRateLimits are used for the policies Config.RateLimits leaves out.
+var DefaultRateLimits = map[string]RateLimitPolicy{
+	RateLimitDefault: {Name: RateLimitDefault, Requests: 600, Per: time.Minute},
+	RateLimitAuth:    {Name: RateLimitAuth, Requests: 10, Per: time.Minute},
+	RateLimitOrders:  {Name: RateLimitOrders, Requests: 20, Per: time.Minute},
+}
+
+// ParseRateLimits parses policies written as name=requests/period separated
+// by commas, e.g. "auth=5/1m,orders=0/1m".
+func ParseRateLimits(s string) (map[string]RateLimitPolicy, error) {
+	limits := map[string]RateLimitPolicy{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(f, "=")
+		requests, period, ok2 := strings.Cut(spec, "/")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid rate limit %q, want name=requests/period", f)
+		}
+		n, err := strconv.Atoi(requests)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid request count in rate limit %q", f)
+		}
+		per, err := time.ParseDuration(period)
+		if err != nil || per <= 0 {
+			return nil, fmt.Errorf("invalid period in rate limit %q", f)
+		}
+		limits[name] = RateLimitPolicy{Name: name, Requests: n, Per: per}
+	}
+	return limits, nil
+}
+
+// RateLimitResult is the state of a bucket after taking a token.
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, zero when
+	// it already is.
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the token buckets. MemoryRateLimitStore only limits a
+// single instance, a shared store such as Redis limits them all together.
+type RateLimitStore interface {
+	// Take takes a token from the bucket of key, which policy p refills.
+	Take(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error)
+}
+
+// RateLimit rejects requests over policy with 429 and sets the RateLimit
+// headers on every response. Requests are counted per user, or per API key,
+// once authenticated and per client IP before, so it goes after
+// RequirePermission to limit users. A failing store lets requests through.
+func RateLimit(store RateLimitStore, policy RateLimitPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if policy.Requests == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// probes must never be turned away, an instance would drop
+			// out of the load balancer
+			if quietRoutes[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			res, err := store.Take(r.Context(), policy.Name+":"+rateLimitKey(r), policy)
+			if err != nil {
+				slog.WarnContext(r.Context(), "rate limit store failed", "policy", policy.Name, "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Requests, int(policy.Per.Seconds())))
+			h.Set("RateLimit-Limit", strconv.Itoa(policy.Requests))
+			h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+			if !res.Allowed {
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+				writeProblem(w, http.StatusTooManyRequests, CodeTooManyRequests, "Rate limit exceeded, try again later")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimit applies the configured policy called name.
+func (h *Handler) rateLimit(name string) func(http.Handler) http.Handler {
+	return RateLimit(h.rateLimitStore, h.rateLimits[name])
+}
+
+func rateLimitKey(r *http.Request) string {
+	if claims, ok := r.Context().Value(authKey{}).(*token.UserClaims); ok {
+		if claims.APIKeyID != 0 {
+			return "apikey:" + strconv.FormatInt(claims.APIKeyID, 10)
+		}
+		return "user:" + strconv.FormatInt(claims.ID, 10)
+	}
+	return "ip:" + clientIP(r)
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// MemoryRateLimitStore keeps the buckets in memory, full buckets are dropped
+// once a minute.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	fullAt time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, p RateLimitPolicy) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if !now.Before(b.fullAt) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	capacity := float64(p.Requests)
+	perToken := p.Per / time.Duration(p.Requests)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = min(capacity, b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+
+	res := RateLimitResult{Allowed: b.tokens >= 1}
+	if res.Allowed {
+		b.tokens--
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((capacity - b.tokens) * float64(perToken))
+	b.fullAt = now.Add(res.Reset)
+	return res, nil
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := NewMemoryRateLimitStore()
+	s.now = func() time.Time { return now }
+	p := RateLimitPolicy{Name: "test", Requests: 2, Per: 10 * time.Second}
+
+	take := func() RateLimitResult {
+		res, err := s.Take(context.Background(), "k", p)
+		require.NoError(t, err)
+		return res
+	}
+	require.Equal(t, RateLimitResult{Allowed: true, Remaining: 1, Reset: 5 * time.Second}, take())
+	require.Equal(t, RateLimitResult{Allowed: true, Remaining: 0, Reset: 10 * time.Second}, take())
+	require.Equal(t, RateLimitResult{Allowed: false, Remaining: 0, Reset: 10 * time.Second, RetryAfter: 5 * time.Second}, take())
+
+	// a token is refilled every 5s
+	now = now.Add(5 * time.Second)
+	require.True(t, take().Allowed)
+	require.False(t, take().Allowed)
+
+	// full buckets are dropped
+	now = now.Add(time.Hour)
+	take()
+	require.Len(t, s.buckets, 1)
+	require.Equal(t, 1.0, s.buckets["k"].tokens)
+}
+
+func TestRateLimit(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limited := RateLimit(store, RateLimitPolicy{Name: "test", Requests: 1, Per: time.Minute})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(remoteAddr string, claims *token.UserClaims) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/orders", nil)
+		r.RemoteAddr = remoteAddr
+		if claims != nil {
+			r = r.WithContext(context.WithValue(r.Context(), authKey{}, claims))
+		}
+		w := httptest.NewRecorder()
+		limited.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("10.0.0.1:1234", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	require.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	require.Equal(t, "60", w.Header().Get("RateLimit-Reset"))
+	require.Equal(t, "1;w=60", w.Header().Get("RateLimit-Policy"))
+
+	w = do("10.0.0.1:1234", nil)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "60", w.Header().Get("Retry-After"))
+	require.Contains(t, w.Body.String(), CodeTooManyRequests)
+
+	// other clients, users and API keys have their own buckets
+	require.Equal(t, http.StatusOK, do("10.0.0.2:1234", nil).Code)
+	require.Equal(t, http.StatusOK, do("10.0.0.1:1234", &token.UserClaims{ID: 1}).Code)
+	require.Equal(t, http.StatusOK, do("10.0.0.1:1234", &token.UserClaims{ID: 1, APIKeyID: 3}).Code)
+	require.Equal(t, http.StatusTooManyRequests, do("10.0.0.3:1234", &token.UserClaims{ID: 1}).Code)
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("auth=5/1m, orders=0/1h")
+	require.NoError(t, err)
+	require.Equal(t, map[string]RateLimitPolicy{
+		"auth":   {Name: "auth", Requests: 5, Per: time.Minute},
+		"orders": {Name: "orders", Requests: 0, Per: time.Hour},
+	}, limits)
+
+	for _, s := range []string{"auth", "auth=5", "auth=x/1m", "auth=5/0s"} {
+		_, err := ParseRateLimits(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	var got string
+	h := TrustedProxies(proxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientIP(r)
+	}))
+	tcs := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:1234", xff: "198.51.100.1", want: "203.0.113.7"},
+		{name: "via proxy", remoteAddr: "10.0.0.5:1234", xff: "203.0.113.7", want: "203.0.113.7"},
+		{name: "spoofed entries are skipped", remoteAddr: "10.0.0.5:1234", xff: "198.51.100.1, 203.0.113.7, 10.0.0.6", want: "203.0.113.7"},
+		{name: "no header", remoteAddr: "10.0.0.5:1234", want: "10.0.0.5"},
+		{name: "garbage", remoteAddr: "10.0.0.5:1234", xff: "nonsense", want: "10.0.0.5"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.xff != "" {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hellwind2019/ecomm/rbac"
+	"github.com/hellwind2019/ecomm/token"
+)
+
+// /users/{id}/roles/{role}
+func (h *Handler) grantUserRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	role := chi.URLParam(r, "role")
+	if !rbac.IsRole(role) {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Unknown role")
+		return
+	}
+	user, ok := h.userFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	err := h.server.GrantRole(ctx, user.ID, role, &claims.ID)
+	if err != nil {
+		writeError(w, err, "Failed to grant role")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+func (h *Handler) revokeUserRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	role := chi.URLParam(r, "role")
+	if !rbac.IsRole(role) {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Unknown role")
+		return
+	}
+	user, ok := h.userFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	err := h.server.RevokeRole(ctx, user.ID, role, &claims.ID)
+	if err != nil {
+		writeError(w, err, "Failed to revoke role")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,68 +2,155 @@ package handler
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/hellwind2019/ecomm/rbac"
 )
 
-var r *chi.Mux
+// catalogReadTimeout is shorter than the default request timeout, the public
+// catalog is cheap to serve and anonymous clients shouldn't hold connections.
+const catalogReadTimeout = 3 * time.Second
 
 func RegisterRoutes(handler *Handler) *chi.Mux {
-	r = chi.NewRouter()
-	tokenMaker := handler.TokenMaker
+	r := chi.NewRouter()
+	r.Use(TrustedProxies(handler.trustedProxies))
+	r.Use(RequestID)
+	r.Use(Tracing)
+	r.Use(AccessLog)
+	r.Use(Metrics)
+	r.Use(SecurityHeaders(handler.hsts))
+	r.Use(CORS(handler.cors))
+	r.Use(Timeout(handler.requestTimeout))
+	r.Use(handler.rateLimit(RateLimitDefault))
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, http.StatusNotFound, CodeNotFound, "No route matches the request")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "The method is not allowed for this route")
+	})
+	r.Get("/healthz", handler.healthz)
+	r.Get("/readyz", handler.readyz)
+	r.Get("/version", handler.version)
+	r.With(RequirePermission(handler, rbac.MetricsRead)).Get("/metrics", handler.metrics)
+	r.Get("/openapi.json", handler.openAPI)
+	r.Get("/docs", handler.swaggerUI)
+	r.Route(apiV1, func(r chi.Router) {
+		routesV1(r, handler)
+	})
+	// the paths of before versioning stay as aliases of v1 for the mobile
+	// app versions still using them
+	r.Group(func(r chi.Router) {
+		r.Use(Deprecated(Deprecation{Since: legacyRoutesDeprecatedAt, Sunset: handler.legacyRoutesSunset, Successor: apiV1}))
+		routesV1(r, handler)
+	})
+
+	return r
+}
+
+// routesV1 registers the routes of version 1 of the API.
+func routesV1(r chi.Router, handler *Handler) {
 	r.Route("/products", func(r chi.Router) {
-		r.With(GetAdminMiddlewareFunc(tokenMaker)).Post("/", handler.createProduct)
-		r.Get("/", handler.listProducts)
+		r.With(RequirePermission(handler, rbac.ProductsWrite), handler.idempotent).Post("/", handler.createProduct)
+		r.With(Timeout(catalogReadTimeout)).Get("/", handler.listProducts)
 
 		r.Route("/{id}", func(r chi.Router) {
-			r.Get("/", handler.getProduct)
+			r.With(Timeout(catalogReadTimeout)).Get("/", handler.getProduct)
 			r.Group(func(r chi.Router) {
-				r.Use(GetAdminMiddlewareFunc(tokenMaker))
+				r.Use(RequirePermission(handler, rbac.ProductsWrite), handler.idempotent)
 				r.Patch("/", handler.updateProduct)
 				r.Delete("/", handler.deleteProduct)
 			})
 		})
 	})
-	r.Group(func(r chi.Router) {
-		r.Use(GetAdminMiddlewareFunc(tokenMaker))
-		r.Get("/myorder", handler.getOrder)
-		r.Route("/orders", func(r chi.Router) {
-
-			r.Post("/", handler.createOrder)
-			r.With(GetAdminMiddlewareFunc(tokenMaker)).Get("/", handler.listOrders)
+	r.With(RequirePermission(handler, rbac.OrdersRead)).Get("/myorder", handler.getOrder)
+	r.Route("/orders", func(r chi.Router) {
+		r.With(RequirePermission(handler, rbac.OrdersCreate), handler.rateLimit(RateLimitOrders), handler.idempotent).Post("/", handler.createOrder)
+		r.With(RequirePermission(handler, rbac.OrdersReadAll)).Get("/", handler.listOrders)
 
-			r.Route("/{id}", func(r chi.Router) {
-				// r.Delete("/", handler.deleteOrder)
-			})
+		r.Route("/{id}", func(r chi.Router) {
+			// r.With(RequirePermission(handler, rbac.OrdersWrite)).Delete("/", handler.deleteOrder)
 		})
 	})
 	r.Route("/users", func(r chi.Router) {
-		r.Post("/", handler.createUser)
-		r.Post("/login", handler.loginUser)
 		r.Group(func(r chi.Router) {
-			r.Use(GetAdminMiddlewareFunc(tokenMaker))
-			r.Get("/", handler.listUsers)
-			r.Route("/{id}", func(r chi.Router) {
-				r.Delete("/", handler.deleteUser)
+			r.Use(handler.rateLimit(RateLimitAuth))
+			r.Post("/", handler.createUser)
+			r.Post("/login", handler.loginUser)
+			r.Post("/login/mfa", handler.loginMFA)
+			r.Post("/password/forgot", handler.forgotPassword)
+			r.Post("/password/reset", handler.resetPassword)
+		})
+		r.Get("/verify", handler.verifyEmail)
+		r.Get("/oidc/{provider}/login", handler.oidcLogin)
+		r.Get("/oidc/{provider}/callback", handler.oidcCallback)
+		r.Post("/verify", handler.verifyEmail)
+		r.With(RequireSession(handler)).Post("/verify/resend", handler.resendVerificationEmail)
+		r.With(RequirePermission(handler, rbac.UsersRead)).Get("/", handler.listUsers)
+		r.Route("/{id}", func(r chi.Router) {
+			r.With(RequirePermission(handler, rbac.UsersDelete)).Delete("/", handler.deleteUser)
+			r.With(RequirePermission(handler, rbac.UsersManageRoles)).Patch("/", handler.patchUser)
+			r.Group(func(r chi.Router) {
+				r.Use(RequirePermission(handler, rbac.SessionsManage))
+				r.Get("/sessions", handler.listUserSessions)
+				r.Delete("/sessions", handler.revokeUserSessions)
+				r.Delete("/sessions/{sessionID}", handler.revokeUserSession)
+			})
+			r.With(RequirePermission(handler, rbac.UsersUnlock)).Delete("/lockout", handler.unlockUser)
+			r.Group(func(r chi.Router) {
+				r.Use(RequirePermission(handler, rbac.UsersManageRoles))
+				r.Put("/roles/{role}", handler.grantUserRole)
+				r.Delete("/roles/{role}", handler.revokeUserRole)
 			})
 		})
 		r.Group(func(r chi.Router) {
-			r.Use(GetAuthMiddlewareFunc(tokenMaker))
+			r.Use(RequireSession(handler))
 			r.Patch("/", handler.updateUser)
 			r.Post("/logout", handler.logoutUser)
 		})
 
 	})
+	r.Route("/api-keys", func(r chi.Router) {
+		r.Use(RequirePermission(handler, rbac.APIKeysManage))
+		r.Post("/", handler.createAPIKey)
+		r.Get("/", handler.listAPIKeys)
+		r.Delete("/{id}", handler.revokeAPIKey)
+	})
+	r.Route("/oauth", func(r chi.Router) {
+		r.Get("/authorize", handler.oauthAuthorize)
+		r.With(handler.rateLimit(RateLimitAuth)).Post("/authorize", handler.oauthApprove)
+		r.With(handler.rateLimit(RateLimitAuth)).Post("/token", handler.oauthToken)
+		r.Post("/revoke", handler.oauthRevoke)
+		r.Post("/introspect", handler.oauthIntrospect)
+		r.Route("/clients", func(r chi.Router) {
+			r.Use(RequirePermission(handler, rbac.OAuthClientsManage))
+			r.Post("/", handler.createOAuthClient)
+			r.Get("/", handler.listOAuthClients)
+			r.Delete("/{id}", handler.revokeOAuthClient)
+		})
+	})
+	r.Route("/me", func(r chi.Router) {
+		r.Use(RequireSession(handler))
+		r.Get("/sessions", handler.listMySessions)
+		r.Delete("/sessions", handler.revokeMyOtherSessions)
+		r.Delete("/sessions/{sessionID}", handler.revokeMySession)
+		r.Route("/identities", func(r chi.Router) {
+			r.Get("/", handler.listMyIdentities)
+			r.Post("/{provider}", handler.startLinkIdentity)
+			r.Delete("/{provider}", handler.unlinkMyIdentity)
+		})
+		r.Route("/2fa", func(r chi.Router) {
+			r.Post("/totp", handler.enrollTOTP)
+			r.Post("/totp/verify", handler.confirmTOTP)
+			r.Delete("/totp", handler.disableTOTP)
+			r.Post("/recovery-codes", handler.regenerateRecoveryCodes)
+		})
+	})
 	r.Group(func(r chi.Router) {
-		r.Use(GetAuthMiddlewareFunc(tokenMaker))
+		r.Use(RequireSession(handler))
 		r.Route("/tokens", func(r chi.Router) {
 			r.Post("/renew", handler.renewAccessToken)
 			r.Post("/revoke", handler.revokeSession)
 		})
 	})
-
-	return r
-}
-func Start(addr string) error {
-	return http.ListenAndServe(addr, r)
 }
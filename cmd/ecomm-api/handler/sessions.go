@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/token"
+)
+
+// /me/sessions
+func (h *Handler) listMySessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	h.writeSessions(ctx, w, claims.Email, claims.SessionID)
+}
+func (h *Handler) revokeMySession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	h.revokeOwnedSession(ctx, w, claims.Email, chi.URLParam(r, "sessionID"))
+}
+
+// revokeMyOtherSessions signs the user out everywhere except the current session.
+func (h *Handler) revokeMyOtherSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	err := h.server.RevokeUserSessions(ctx, claims.Email, claims.SessionID)
+	if err != nil {
+		writeError(w, err, "Failed to revoke sessions")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// /users/{id}/sessions
+func (h *Handler) listUserSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := h.userFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	h.writeSessions(ctx, w, user.Email, "")
+}
+func (h *Handler) revokeUserSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := h.userFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	h.revokeOwnedSession(ctx, w, user.Email, chi.URLParam(r, "sessionID"))
+}
+func (h *Handler) revokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, ok := h.userFromURLParam(w, r)
+	if !ok {
+		return
+	}
+	err := h.server.RevokeUserSessions(ctx, user.Email, "")
+	if err != nil {
+		writeError(w, err, "Failed to revoke sessions")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) userFromURLParam(w http.ResponseWriter, r *http.Request) (*storer.User, bool) {
+	ctx := r.Context()
+	i, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Error parsing ID")
+		return nil, false
+	}
+	user, err := h.server.GetUserByID(ctx, i)
+	if err != nil {
+		writeError(w, err, "Failed to get user")
+		return nil, false
+	}
+	return user, true
+}
+func (h *Handler) writeSessions(ctx context.Context, w http.ResponseWriter, email string, currentID string) {
+	sessions, err := h.server.ListSessions(ctx, email)
+	if err != nil {
+		writeError(w, err, "Failed to list sessions")
+		return
+	}
+	res := ListSessionsResponse{Sessions: []SessionResponse{}}
+	for _, s := range sessions {
+		res.Sessions = append(res.Sessions, toSessionResponse(s, currentID))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// revokeOwnedSession revokes a session only if it belongs to email, so users
+// can't probe or revoke each other's sessions by ID.
+func (h *Handler) revokeOwnedSession(ctx context.Context, w http.ResponseWriter, email string, id string) {
+	session, err := h.server.GetSession(ctx, id)
+	if err != nil && !errors.Is(err, storer.ErrNotFound) {
+		writeError(w, err, "Failed to get session")
+		return
+	}
+	// another user's session is reported like a missing one
+	if err != nil || session.UserEmail != email {
+		writeProblem(w, http.StatusNotFound, CodeNotFound, "Session not found")
+		return
+	}
+	err = h.server.RevokeSession(ctx, session.ID)
+	if err != nil {
+		writeError(w, err, "Failed to revoke session")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+func toSessionResponse(s storer.Session, currentID string) SessionResponse {
+	return SessionResponse{
+		ID:         s.ID,
+		UserAgent:  s.UserAgent,
+		IPAddress:  s.IPAddress,
+		Current:    s.ID == currentID,
+		CreatedAt:  s.CreatedAt,
+		LastUsedAt: s.LastUsedAt,
+		ExpiresAt:  s.ExpiresAt,
+	}
+}
+
+// clientIP returns the IP address of the remote end of the connection, or of
+// the client behind it once TrustedProxies rewrote RemoteAddr.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
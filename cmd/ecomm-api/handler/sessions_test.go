@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/server"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/hellwind2019/ecomm/util"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+var sessionColumns = []string{"id", "user_email", "refresh_token", "is_revoked", "created_at", "expires_at", "user_agent", "ip_address", "last_used_at"}
+
+func newSessionTestHandler(t *testing.T) (*Handler, sqlmock.Sqlmock) {
+	mockDB, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	t.Cleanup(func() { mockDB.Close() })
+	h := NewHandler(server.NewServer(storer.NewMySQLStorer(sqlx.NewDb(mockDB, "sqlmock"))), Config{SecretKey: "0123456789012345678901234567890123456789"})
+	return h, mock
+}
+
+func expectSession(mock sqlmock.Sqlmock, id, email, refreshToken string, revoked bool) {
+	now := time.Now()
+	mock.ExpectQuery("SELECT * FROM sessions WHERE id = ?").WithArgs(id).
+		WillReturnRows(sqlmock.NewRows(sessionColumns).AddRow(id, email, util.HashToken(refreshToken), revoked, now, now.Add(time.Hour), "", "", now))
+}
+
+func TestAuthenticateSession(t *testing.T) {
+	h, _ := newSessionTestHandler(t)
+	refreshToken, refreshClaims, err := h.TokenMaker.CreateToken(token.TokenTypeRefresh, 1, "john@example.com", nil, nil, "", time.Hour)
+	require.NoError(t, err)
+	accessToken, _, err := h.TokenMaker.CreateToken(token.TokenTypeAccess, 1, "john@example.com", nil, nil, refreshClaims.SessionID, time.Minute)
+	require.NoError(t, err)
+
+	tcs := []struct {
+		name    string
+		token   string
+		mock    func(sqlmock.Sqlmock)
+		wantErr bool
+	}{
+		{
+			name:  "active session",
+			token: accessToken,
+			mock: func(mock sqlmock.Sqlmock) {
+				expectSession(mock, refreshClaims.SessionID, "john@example.com", refreshToken, false)
+			},
+		},
+		{
+			name:  "revoked session",
+			token: accessToken,
+			mock: func(mock sqlmock.Sqlmock) {
+				expectSession(mock, refreshClaims.SessionID, "john@example.com", refreshToken, true)
+			},
+			wantErr: true,
+		},
+		{
+			name:    "refresh token",
+			token:   refreshToken,
+			mock:    func(sqlmock.Sqlmock) {},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			h, mock := newSessionTestHandler(t)
+			tc.mock(mock)
+			r := httptest.NewRequest(http.MethodGet, "/me/sessions", nil)
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+			_, err := h.Authenticate(r)
+			if tc.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRevokeMySession(t *testing.T) {
+	h, mock := newSessionTestHandler(t)
+	refreshToken, refreshClaims, err := h.TokenMaker.CreateToken(token.TokenTypeRefresh, 1, "john@example.com", nil, nil, "", time.Hour)
+	require.NoError(t, err)
+	accessToken, _, err := h.TokenMaker.CreateToken(token.TokenTypeAccess, 1, "john@example.com", nil, nil, refreshClaims.SessionID, time.Minute)
+	require.NoError(t, err)
+
+	// the session exists but belongs to someone else
+	expectSession(mock, refreshClaims.SessionID, "john@example.com", refreshToken, false)
+	expectSession(mock, "other", "jane@example.com", "jane's token", false)
+
+	r := httptest.NewRequest(http.MethodDelete, "/v1/me/sessions/other", nil)
+	r.Header.Set("Authorization", "Bearer "+accessToken)
+	w := httptest.NewRecorder()
+	RegisterRoutes(h).ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Contains(t, w.Body.String(), CodeNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeMySessionStorerError(t *testing.T) {
+	h, mock := newSessionTestHandler(t)
+	refreshToken, refreshClaims, err := h.TokenMaker.CreateToken(token.TokenTypeRefresh, 1, "john@example.com", nil, nil, "", time.Hour)
+	require.NoError(t, err)
+	accessToken, _, err := h.TokenMaker.CreateToken(token.TokenTypeAccess, 1, "john@example.com", nil, nil, refreshClaims.SessionID, time.Minute)
+	require.NoError(t, err)
+
+	expectSession(mock, refreshClaims.SessionID, "john@example.com", refreshToken, false)
+	mock.ExpectQuery("SELECT * FROM sessions WHERE id = ?").WithArgs("other").WillReturnError(errors.New("connection refused"))
+
+	r := httptest.NewRequest(http.MethodDelete, "/v1/me/sessions/other", nil)
+	r.Header.Set("Authorization", "Bearer "+accessToken)
+	w := httptest.NewRecorder()
+	RegisterRoutes(h).ServeHTTP(w, r)
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Contains(t, w.Body.String(), CodeInternal)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRenewAccessTokenRevokedSession(t *testing.T) {
+	h, mock := newSessionTestHandler(t)
+	refreshToken, refreshClaims, err := h.TokenMaker.CreateToken(token.TokenTypeRefresh, 1, "john@example.com", nil, nil, "", time.Hour)
+	require.NoError(t, err)
+	expectSession(mock, refreshClaims.SessionID, "john@example.com", refreshToken, true)
+
+	r := httptest.NewRequest(http.MethodPost, "/tokens/renew", strings.NewReader(`{"refresh_token":"`+refreshToken+`"}`))
+	w := httptest.NewRecorder()
+	h.renewAccessToken(w, r)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Contains(t, w.Body.String(), CodeInvalidToken)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,326 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/sso"
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/hellwind2019/ecomm/util"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcLoginCookie = "oidc_login"
+	oidcLoginTTL    = 10 * time.Minute
+)
+
+// oidcLoginState is kept in a signed cookie between sending the user to the
+// provider and the callback. The PKCE verifier never leaves our side.
+type oidcLoginState struct {
+	Provider     string `json:"provider"`
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	// LinkUserID is set when a signed in user links another provider.
+	LinkUserID int64 `json:"link_user_id,omitempty"`
+}
+
+// /users/oidc/{provider}/login
+func (h *Handler) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.oidcProvider(w, r)
+	if !ok {
+		return
+	}
+	authURL, err := h.startOIDCLogin(w, p, 0)
+	if err != nil {
+		writeError(w, err, "Failed to start login")
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// /users/oidc/{provider}/callback
+// oidcCallback signs the user in with a linked identity, or creates an account
+// for an unknown one. An identity is never linked to an existing account by
+// email alone, since a provider could claim any address. Those users have to
+// sign in and link the provider from /me/identities.
+func (h *Handler) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	p, ok := h.oidcProvider(w, r)
+	if !ok {
+		return
+	}
+	state, ok := h.finishOIDCLogin(w, r, p)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("error") != "" {
+		writeProblem(w, http.StatusUnauthorized, CodeUnauthorized, "Login was denied by the provider")
+		return
+	}
+	identity, err := p.Exchange(ctx, r.URL.Query().Get("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		writeProblem(w, http.StatusUnauthorized, CodeInvalidToken, "Failed to verify login with provider")
+		return
+	}
+	if state.LinkUserID != 0 {
+		h.linkIdentity(ctx, w, state.LinkUserID, identity)
+		return
+	}
+
+	user, err := h.server.GetUserByIdentity(ctx, identity.Provider, identity.Subject)
+	if errors.Is(err, storer.ErrNotFound) {
+		user, ok = h.createOIDCUser(ctx, w, identity)
+		if !ok {
+			return
+		}
+	} else if err != nil {
+		writeError(w, err, "Failed to get user")
+		return
+	}
+	mfaEnabled, err := h.totpEnabled(ctx, user.ID)
+	if err != nil {
+		writeError(w, err, "Failed to get two-factor status")
+		return
+	}
+	if mfaEnabled {
+		h.writeMFAChallenge(w, user)
+		return
+	}
+	h.startSession(w, r, user)
+}
+
+// /me/identities
+func (h *Handler) listMyIdentities(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	identities, err := h.server.ListUserIdentities(ctx, claims.ID)
+	if err != nil {
+		writeError(w, err, "Failed to list identities")
+		return
+	}
+	res := ListIdentitiesResponse{Identities: []IdentityResponse{}}
+	for _, ui := range identities {
+		res.Identities = append(res.Identities, toIdentityResponse(&ui))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// /me/identities/{provider}
+// startLinkIdentity returns the provider URL to send the user to. The
+// callback links the identity instead of signing in.
+func (h *Handler) startLinkIdentity(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	p, ok := h.oidcProvider(w, r)
+	if !ok {
+		return
+	}
+	authURL, err := h.startOIDCLogin(w, p, claims.ID)
+	if err != nil {
+		writeError(w, err, "Failed to start linking")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(LinkIdentityResponse{AuthorizationURL: authURL})
+}
+
+func (h *Handler) unlinkMyIdentity(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	err := h.server.DeleteUserIdentity(ctx, claims.ID, chi.URLParam(r, "provider"))
+	if errors.Is(err, storer.ErrNotFound) {
+		writeProblem(w, http.StatusNotFound, CodeNotFound, "Identity not found")
+		return
+	}
+	if err != nil {
+		writeError(w, err, "Failed to unlink identity")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) oidcProvider(w http.ResponseWriter, r *http.Request) (*sso.Provider, bool) {
+	p, ok := h.oidcProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		writeProblem(w, http.StatusNotFound, CodeNotFound, "Unknown provider")
+		return nil, false
+	}
+	return p, true
+}
+
+// startOIDCLogin sets the state cookie and returns the provider URL.
+func (h *Handler) startOIDCLogin(w http.ResponseWriter, p *sso.Provider, linkUserID int64) (string, error) {
+	state, err := util.RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := util.RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	s := oidcLoginState{
+		Provider:     p.Name(),
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		LinkUserID:   linkUserID,
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	cookie, err := h.TokenMaker.CreatePurposeToken(token.PurposeOIDCLogin, string(b), oidcLoginTTL)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, h.oidcLoginCookie(p, cookie, oidcLoginTTL))
+	return p.AuthCodeURL(s.State, s.Nonce, s.CodeVerifier), nil
+}
+
+// finishOIDCLogin checks the callback against the state cookie and clears it,
+// so a callback can only be used once.
+func (h *Handler) finishOIDCLogin(w http.ResponseWriter, r *http.Request, p *sso.Provider) (*oidcLoginState, bool) {
+	cookie, err := r.Cookie(oidcLoginCookie)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Login expired, please try again")
+		return nil, false
+	}
+	http.SetCookie(w, h.oidcLoginCookie(p, "", -1))
+	subject, err := h.TokenMaker.VerifyPurposeToken(token.PurposeOIDCLogin, cookie.Value)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Login expired, please try again")
+		return nil, false
+	}
+	var s oidcLoginState
+	if err := json.Unmarshal([]byte(subject), &s); err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Login expired, please try again")
+		return nil, false
+	}
+	if s.Provider != p.Name() || !util.TokensEqual(s.State, r.URL.Query().Get("state")) {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid login state")
+		return nil, false
+	}
+	return &s, true
+}
+
+// oidcLoginCookie is only sent to the callback of p, which may be under /v1 or
+// the unversioned alias.
+func (h *Handler) oidcLoginCookie(p *sso.Provider, value string, maxAge time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    value,
+		Path:     p.CallbackPath(),
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.publicURL, "https://"),
+		// Lax so the cookie comes along on the redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// createOIDCUser creates an account for a new identity. It writes the error
+// response itself when the account can't be created.
+func (h *Handler) createOIDCUser(ctx context.Context, w http.ResponseWriter, identity *sso.Identity) (*storer.User, bool) {
+	if identity.Email == "" || !identity.EmailVerified {
+		writeProblem(w, http.StatusForbidden, CodeEmailNotVerified, "The provider did not confirm a verified email address")
+		return nil, false
+	}
+	_, err := h.server.GetUser(ctx, identity.Email)
+	if err == nil {
+		writeProblem(w, http.StatusConflict, CodeConflict, "An account with this email already exists, sign in and link the provider to it")
+		return nil, false
+	}
+	if !errors.Is(err, storer.ErrNotFound) {
+		writeError(w, err, "Failed to get user")
+		return nil, false
+	}
+	// the account has no usable password until the user resets it
+	password, err := util.RandomToken(32)
+	if err != nil {
+		writeError(w, err, "Failed to create user")
+		return nil, false
+	}
+	hashed, err := hashPassword(ctx, password)
+	if err != nil {
+		writeError(w, err, "Failed to create user")
+		return nil, false
+	}
+	name := identity.Name
+	if name == "" {
+		name = identity.Email
+	}
+	now := time.Now()
+	user, err := h.server.CreateUserWithIdentity(ctx, &storer.User{
+		Name:            name,
+		Email:           identity.Email,
+		Password:        hashed,
+		EmailVerifiedAt: &now,
+	}, &storer.UserIdentity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		writeError(w, err, "Failed to create user")
+		return nil, false
+	}
+	return user, true
+}
+func (h *Handler) linkIdentity(ctx context.Context, w http.ResponseWriter, userID int64, identity *sso.Identity) {
+	linked, err := h.server.GetUserByIdentity(ctx, identity.Provider, identity.Subject)
+	if err == nil {
+		if linked.ID == userID {
+			writeProblem(w, http.StatusConflict, CodeConflict, "Identity is already linked to this account")
+			return
+		}
+		writeProblem(w, http.StatusConflict, CodeConflict, "Identity is linked to another account")
+		return
+	}
+	if !errors.Is(err, storer.ErrNotFound) {
+		writeError(w, err, "Failed to get user")
+		return
+	}
+	identities, err := h.server.ListUserIdentities(ctx, userID)
+	if err != nil {
+		writeError(w, err, "Failed to list identities")
+		return
+	}
+	for _, ui := range identities {
+		if ui.Provider == identity.Provider {
+			writeProblem(w, http.StatusConflict, CodeConflict, "Another identity at this provider is already linked")
+			return
+		}
+	}
+	ui := &storer.UserIdentity{
+		UserID:   userID,
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	}
+	if err := h.server.CreateUserIdentity(ctx, ui); err != nil {
+		writeError(w, err, "Failed to link identity")
+		return
+	}
+	ui.CreatedAt = time.Now()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(toIdentityResponse(ui))
+}
+func toIdentityResponse(ui *storer.UserIdentity) IdentityResponse {
+	return IdentityResponse{
+		ID:        ui.ID,
+		Provider:  ui.Provider,
+		Email:     ui.Email,
+		CreatedAt: ui.CreatedAt,
+	}
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/hellwind2019/ecomm/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/hellwind2019/ecomm/cmd/ecomm-api/handler")
+
+// Tracing starts a server span for every request, continuing the trace of a
+// W3C traceparent header. The span is named after the chi route pattern once
+// the request has been routed.
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("client.address", clientIP(r)),
+		))
+		defer span.End()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		r = r.WithContext(ctx)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := routePattern(r)
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(
+			attribute.String("http.route", route),
+			attribute.Int("http.response.status_code", status),
+		)
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// hashPassword and checkPasswordHash trace the password hasher, which takes
+// a noticeable share of signups and logins.
+func hashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracer.Start(ctx, "util.HashPassword")
+	defer span.End()
+	return util.HashPassword(password)
+}
+
+func checkPasswordHash(ctx context.Context, password, hash string) error {
+	_, span := tracer.Start(ctx, "util.CheckPasswordHash")
+	defer span.End()
+	return util.CheckPasswordHash(password, hash)
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/server"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanRecorder installs the global tracer provider once, the tracers of the
+// packages are bound to the first one.
+var spanRecorder = sync.OnceValue(func() *tracetest.InMemoryExporter {
+	exp := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return exp
+})
+
+func TestTracingSpans(t *testing.T) {
+	exp := spanRecorder()
+	exp.Reset()
+
+	mockDB, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer mockDB.Close()
+	mock.ExpectQuery("SELECT * FROM products WHERE id = ?").WithArgs(1).WillReturnError(sql.ErrNoRows)
+	st := storer.NewMySQLStorer(sqlx.NewDb(mockDB, "sqlmock"))
+	h := NewHandler(server.NewServer(st), Config{SecretKey: "0123456789012345678901234567890123456789"})
+
+	req := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	RegisterRoutes(h).ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, s := range exp.GetSpans() {
+		spans[s.Name] = s
+	}
+	require.Len(t, spans, 3)
+	root, srv, query := spans["GET /products/{id}"], spans["Server.GetProduct"], spans["MySQLStorer.GetProduct"]
+
+	// the incoming trace is continued
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.SpanContext.TraceID().String())
+	require.True(t, root.Parent.IsRemote())
+	require.Equal(t, trace.SpanKindServer, root.SpanKind)
+	require.Contains(t, root.Attributes, attribute.String("http.route", "/products/{id}"))
+	require.Contains(t, root.Attributes, attribute.Int("http.response.status_code", http.StatusNotFound))
+	require.Len(t, root.Events, 1, "the storer error is recorded")
+
+	require.Equal(t, root.SpanContext.SpanID(), srv.Parent.SpanID())
+	require.Equal(t, srv.SpanContext.SpanID(), query.Parent.SpanID())
+	require.Equal(t, trace.SpanKindClient, query.SpanKind)
+	require.Contains(t, query.Attributes, attribute.String("db.system", "mysql"))
+}
@@ -2,16 +2,19 @@ package handler
 
 import "time"
 
+// Request types are validated with their validate tags, see validate.go.
+
 type ProductRequest struct {
-	Name         string  `json:"name"`
-	Image        string  `json:"image"`
-	Category     string  `json:"category"`
-	Description  string  `json:"description"`
-	Rating       int64   `json:"rating"`
-	NumReviews   int64   `json:"num_reviews"`
-	Price        float64 `json:"price"`
-	CountInStock int64   `json:"count_in_stock"`
+	Name         string  `json:"name" validate:"required,max=255"`
+	Image        string  `json:"image" validate:"max=2048"`
+	Category     string  `json:"category" validate:"required,max=255"`
+	Description  string  `json:"description" validate:"max=10000"`
+	Rating       int64   `json:"rating" validate:"gte=0,lte=5"`
+	NumReviews   int64   `json:"num_reviews" validate:"gte=0"`
+	Price        float64 `json:"price" validate:"gt=0,lte=1000000"`
+	CountInStock int64   `json:"count_in_stock" validate:"gte=0,lte=1000000"`
 }
+
 type ProductResponse struct {
 	ID           int64      `json:"id"`
 	Name         string     `json:"name"`
@@ -28,19 +31,19 @@ type ProductResponse struct {
 
 type OrderReq struct {
 	ID            int64       `json:"id"`
-	Items         []OrderItem `json:"items"`
-	PaymentMethod string      `json:"payment_method"`
-	TaxPrice      float32     `json:"tax_price"`
-	ShippingPrice float32     `json:"shipping_price"`
-	TotalPrice    float32     `json:"total_price"`
+	Items         []OrderItem `json:"items" validate:"required,min=1,max=100,dive"`
+	PaymentMethod string      `json:"payment_method" validate:"required,max=64"`
+	TaxPrice      float32     `json:"tax_price" validate:"gte=0"`
+	ShippingPrice float32     `json:"shipping_price" validate:"gte=0"`
+	TotalPrice    float32     `json:"total_price" validate:"gt=0"`
 }
 
 type OrderItem struct {
-	Name      string  `json:"name"`
-	Quantity  int64   `json:"quantity"`
-	Image     string  `json:"image"`
-	Price     float32 `json:"price"`
-	ProductID int64   `json:"product_id"`
+	Name      string  `json:"name" validate:"required,max=255"`
+	Quantity  int64   `json:"quantity" validate:"gt=0,lte=1000"`
+	Image     string  `json:"image" validate:"max=2048"`
+	Price     float32 `json:"price" validate:"gt=0,lte=1000000"`
+	ProductID int64   `json:"product_id" validate:"gt=0"`
 }
 
 type OrderResponse struct {
@@ -54,23 +57,37 @@ type OrderResponse struct {
 	UpdatedAt     *time.Time  `json:"updated_at"`
 }
 
+// UserRequest deliberately has no privilege fields, roles are granted through
+// the /users/{id}/roles endpoints only.
+// The password is additionally checked against the password policy.
 type UserRequest struct {
-	Name     string `json:"name"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Name     string `json:"name" validate:"required,max=255"`
+	Email    string `json:"email" validate:"required,email,max=255"`
+	Password string `json:"password" validate:"required,max=128"`
+}
+
+// UserPatch is the document PATCH /users and PATCH /users/{id} apply patches
+// to. Password is always empty in the current state, setting it changes the
+// password and is additionally checked against the password policy.
+type UserPatch struct {
+	Name     string `json:"name" validate:"required,max=255"`
+	Email    string `json:"email" validate:"required,email,max=255"`
+	Password string `json:"password" validate:"max=128"`
 	IsAdmin  bool   `json:"is_admin"`
 }
 type UserResponse struct {
-	Name    string `json:"name"`
-	Email   string `json:"email"`
-	IsAdmin bool   `json:"is_admin"`
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	IsAdmin       bool   `json:"is_admin"`
 }
 type ListUserResponse struct {
 	Users []UserResponse `json:"users"`
 }
 type LoginUserRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string `json:"email" validate:"required,max=255"`
+	Password string `json:"password" validate:"required,max=1024"`
 }
 type LoginUserResponse struct {
 	SessionID             string       `json:"session_id"`
@@ -79,11 +96,203 @@ type LoginUserResponse struct {
 	AccessTokenExpiresAt  time.Time    `json:"access_token_expires_at"`
 	RefreshTokenExpiresAt time.Time    `json:"refresh_token_expires_at"`
 	User                  UserResponse `json:"user"`
+	// MFAEnrollmentRequired is set for admins that must enable two-factor
+	// authentication before their permissions are granted.
+	MFAEnrollmentRequired bool `json:"mfa_enrollment_required,omitempty"`
 }
 type RenewAccessTokenRequest struct {
-	RefreshToken string `json:"refresh_token"`
+	RefreshToken string `json:"refresh_token" validate:"required"`
 }
 type RenewAccessTokenResponse struct {
 	AccessToken          string    `json:"access_token"`
 	AccessTokenExpiresAt time.Time `json:"access_token_expires_at"`
 }
+type SessionResponse struct {
+	ID         string     `json:"id"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	Current    bool       `json:"current"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+}
+type ListSessionsResponse struct {
+	Sessions []SessionResponse `json:"sessions"`
+}
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email,max=255"`
+}
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required,max=256"`
+	Password string `json:"password" validate:"required,max=128"`
+}
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required,max=2048"`
+}
+
+// MFAChallengeResponse is returned by /users/login instead of tokens when the
+// account has two-factor authentication enabled.
+type MFAChallengeResponse struct {
+	MFARequired  bool      `json:"mfa_required"`
+	MFAToken     string    `json:"mfa_token"`
+	MFAExpiresAt time.Time `json:"mfa_token_expires_at"`
+}
+type LoginMFARequest struct {
+	MFAToken string `json:"mfa_token" validate:"required,max=2048"`
+	// Code is a code from the authenticator app or an unused recovery code.
+	Code string `json:"code" validate:"required,max=32"`
+}
+type TOTPEnrollResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+type TOTPCodeRequest struct {
+	Code string `json:"code" validate:"required,max=32"`
+}
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+type CreateAPIKeyRequest struct {
+	Name string `json:"name" validate:"required,max=255"`
+	// OwnerID is the user the key acts as, it defaults to the caller.
+	OwnerID   int64      `json:"owner_id" validate:"gte=0"`
+	Scopes    []string   `json:"scopes" validate:"max=50"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+type APIKeyResponse struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	OwnerID    int64      `json:"owner_id"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CreateAPIKeyResponse is the only response that contains the key itself.
+type CreateAPIKeyResponse struct {
+	APIKeyResponse
+	Key string `json:"key"`
+}
+type ListAPIKeysResponse struct {
+	APIKeys []APIKeyResponse `json:"api_keys"`
+}
+type IdentityResponse struct {
+	ID        int64     `json:"id"`
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+type ListIdentitiesResponse struct {
+	Identities []IdentityResponse `json:"identities"`
+}
+type LinkIdentityResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+}
+type CreateOAuthClientRequest struct {
+	Name         string   `json:"name" validate:"required,max=255"`
+	RedirectURIs []string `json:"redirect_uris" validate:"required,min=1,max=10,dive,max=2048"`
+	Scopes       []string `json:"scopes" validate:"max=50"`
+	// OwnerID is the user client credentials tokens act as, it defaults to
+	// the caller.
+	OwnerID int64 `json:"owner_id" validate:"gte=0"`
+	// Confidential clients get a secret, public ones such as mobile apps
+	// rely on PKCE alone.
+	Confidential bool `json:"confidential"`
+}
+type OAuthClientResponse struct {
+	ID           string     `json:"client_id"`
+	Name         string     `json:"name"`
+	RedirectURIs []string   `json:"redirect_uris"`
+	Scopes       []string   `json:"scopes"`
+	OwnerID      int64      `json:"owner_id"`
+	Confidential bool       `json:"confidential"`
+	RevokedAt    *time.Time `json:"revoked_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// CreateOAuthClientResponse is the only response that contains the secret.
+type CreateOAuthClientResponse struct {
+	OAuthClientResponse
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+type ListOAuthClientsResponse struct {
+	Clients []OAuthClientResponse `json:"clients"`
+}
+
+// OAuthTokenResponse and OAuthErrorResponse follow RFC 6749 section 5.
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// IntrospectionResponse follows RFC 7662, only Active is set for inactive tokens.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// The OAuth endpoints take form encoded bodies, the types below only describe
+// their fields in the OpenAPI document.
+type OAuthConsentForm struct {
+	Consent  string `json:"consent" validate:"required"`
+	Decision string `json:"decision" validate:"required,oneof=approve deny"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// Code is a code from the authenticator app or a recovery code, required
+	// when the account has two-factor authentication enabled.
+	Code string `json:"code"`
+}
+type OAuthTokenForm struct {
+	GrantType    string `json:"grant_type" validate:"required,oneof=authorization_code refresh_token client_credentials"`
+	Code         string `json:"code"`
+	RedirectURI  string `json:"redirect_uri"`
+	CodeVerifier string `json:"code_verifier"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	// ClientID and ClientSecret may be sent with HTTP Basic authentication
+	// instead.
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// OAuthRevocationForm is the body of both /oauth/revoke and /oauth/introspect.
+type OAuthRevocationForm struct {
+	Token        string `json:"token" validate:"required"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+type ReadinessResponse struct {
+	Status string `json:"status"`
+	// Checks maps each dependency to ok.
+	Checks map[string]string `json:"checks"`
+}
+
+// VersionResponse fields are empty when the binary was built without VCS
+// information, e.g. with go run.
+type VersionResponse struct {
+	Commit     string `json:"commit"`
+	CommitTime string `json:"commit_time"`
+	Modified   bool   `json:"modified"`
+	BuildTime  string `json:"build_time"`
+	GoVersion  string `json:"go_version"`
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// maxBodyBytes limits JSON request bodies, none of the request types comes
+// close to it.
+const maxBodyBytes = 1 << 20
+
+// validate checks the validate tags on the request types in types.go. Field
+// errors are reported with the JSON names of the fields.
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}
+
+// FieldError describes one invalid field of a request body. Field is a path
+// such as items[0].quantity, Code is the failed rule.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// decodeAndValidate decodes the JSON body into v and validates it. It writes
+// the problem response itself and returns false when the body is rejected.
+func decodeAndValidate(w http.ResponseWriter, r *http.Request, v any) bool {
+	if !decodeBody(w, r, v) {
+		return false
+	}
+	if errs := validationErrors(v); len(errs) > 0 {
+		writeValidationProblem(w, errs)
+		return false
+	}
+	return true
+}
+
+// decodeBody decodes a single JSON value into v, rejecting unknown fields and
+// bodies over maxBodyBytes.
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	_, span := tracer.Start(r.Context(), "decodeBody")
+	defer span.End()
+	return decodeJSON(w, http.MaxBytesReader(w, r.Body, maxBodyBytes), v)
+}
+func decodeJSON(w http.ResponseWriter, body io.Reader, v any) bool {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("body must contain a single JSON value")
+	}
+	var (
+		maxBytesErr *http.MaxBytesError
+		syntaxErr   *json.SyntaxError
+		typeErr     *json.UnmarshalTypeError
+	)
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &maxBytesErr):
+		writeProblem(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("Request body must not be larger than %d bytes", maxBodyBytes))
+	case errors.Is(err, io.EOF):
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Request body must not be empty")
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Request body is not valid JSON")
+	case errors.As(err, &typeErr):
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("Field %s must be of type %s", typeErr.Field, typeErr.Type))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("Unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field ")))
+	default:
+		writeProblem(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+	}
+	return false
+}
+
+// validationErrors returns every failed validate tag of v.
+func validationErrors(v any) []FieldError {
+	err := validate.Struct(v)
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return nil
+	}
+	errs := make([]FieldError, 0, len(verrs))
+	for _, fe := range verrs {
+		// the namespace starts with the struct name
+		_, field, _ := strings.Cut(fe.Namespace(), ".")
+		errs = append(errs, FieldError{Field: field, Code: fe.Tag(), Message: fieldErrorMessage(fe)})
+	}
+	return errs
+}
+func fieldErrorMessage(fe validator.FieldError) string {
+	isString := fe.Kind() == reflect.String
+	isList := fe.Kind() == reflect.Slice || fe.Kind() == reflect.Map
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "url":
+		return "must be a valid URL"
+	case "min":
+		if isString {
+			return fmt.Sprintf("must be at least %s characters long", fe.Param())
+		}
+		if isList {
+			return fmt.Sprintf("must contain at least %s items", fe.Param())
+		}
+		return fmt.Sprintf("must be at least %s", fe.Param())
+	case "max":
+		if isString {
+			return fmt.Sprintf("must be at most %s characters long", fe.Param())
+		}
+		if isList {
+			return fmt.Sprintf("must contain at most %s items", fe.Param())
+		}
+		return fmt.Sprintf("must be at most %s", fe.Param())
+	case "gt":
+		return fmt.Sprintf("must be greater than %s", fe.Param())
+	case "gte":
+		return fmt.Sprintf("must be at least %s", fe.Param())
+	case "lte":
+		return fmt.Sprintf("must be at most %s", fe.Param())
+	}
+	return fmt.Sprintf("failed the %s rule", fe.Tag())
+}
+func writeValidationProblem(w http.ResponseWriter, errs []FieldError) {
+	writeProblemWithErrors(w, http.StatusUnprocessableEntity, CodeValidationFailed, "The request body has invalid fields", errs)
+}
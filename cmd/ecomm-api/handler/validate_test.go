@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/server"
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/token"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidationErrors(t *testing.T) {
+	tcs := []struct {
+		name  string
+		req   any
+		codes map[string]string
+	}{
+		{
+			name: "valid order",
+			req: &OrderReq{
+				Items:         []OrderItem{{Name: "book", Quantity: 1, Price: 10, ProductID: 1}},
+				PaymentMethod: "card",
+				TotalPrice:    10,
+			},
+		},
+		{
+			name:  "empty order",
+			req:   &OrderReq{PaymentMethod: "card", TotalPrice: 10},
+			codes: map[string]string{"items": "required"},
+		},
+		{
+			name: "invalid order item",
+			req: &OrderReq{
+				Items:         []OrderItem{{Name: "book", Quantity: 0, Price: -1, ProductID: 1}},
+				PaymentMethod: "card",
+				TotalPrice:    10,
+			},
+			codes: map[string]string{"items[0].quantity": "gt", "items[0].price": "gt"},
+		},
+		{
+			name:  "invalid product",
+			req:   &ProductRequest{Name: "book", Category: "books", Rating: 6, Price: 0, CountInStock: -1},
+			codes: map[string]string{"rating": "lte", "price": "gt", "count_in_stock": "gte"},
+		},
+		{
+			name:  "invalid user",
+			req:   &UserRequest{Name: "john", Email: "not an email", Password: strings.Repeat("a", 129)},
+			codes: map[string]string{"email": "email", "password": "max"},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			codes := map[string]string{}
+			for _, fe := range validationErrors(tc.req) {
+				codes[fe.Field] = fe.Code
+			}
+			if tc.codes == nil {
+				tc.codes = map[string]string{}
+			}
+			require.Equal(t, tc.codes, codes)
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	tcs := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "valid", body: `{"email":"john@example.com"}`, status: http.StatusOK},
+		{name: "empty", body: ``, status: http.StatusBadRequest},
+		{name: "unknown field", body: `{"email":"john@example.com","is_admin":true}`, status: http.StatusBadRequest},
+		{name: "trailing data", body: `{"email":"a@b.c"}{}`, status: http.StatusBadRequest},
+		{name: "too large", body: `{"email":"` + strings.Repeat("a", maxBodyBytes) + `"}`, status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			var req ForgotPasswordRequest
+			ok := decodeBody(w, r, &req)
+			require.Equal(t, tc.status == http.StatusOK, ok)
+			require.Equal(t, tc.status, w.Code)
+		})
+	}
+}
+
+func TestCreateOrderValidation(t *testing.T) {
+	tcs := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{
+			name:   "no items",
+			body:   `{"items":[],"payment_method":"card","total_price":10}`,
+			status: http.StatusUnprocessableEntity,
+			code:   CodeValidationFailed,
+		},
+		{
+			name:   "zero quantity",
+			body:   `{"items":[{"name":"book","quantity":0,"price":10,"product_id":1}],"payment_method":"card","total_price":10}`,
+			status: http.StatusUnprocessableEntity,
+			code:   CodeValidationFailed,
+		},
+		{
+			name:   "negative quantity",
+			body:   `{"items":[{"name":"book","quantity":-2,"price":10,"product_id":1}],"payment_method":"card","total_price":10}`,
+			status: http.StatusUnprocessableEntity,
+			code:   CodeValidationFailed,
+		},
+		{
+			name:   "unknown field",
+			body:   `{"items":[{"name":"book","quantity":1,"price":10,"product_id":1}],"payment_method":"card","total_price":10,"user_id":2}`,
+			status: http.StatusBadRequest,
+			code:   CodeInvalidRequest,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			// no queries are expected, invalid orders never reach the storer
+			mockDB, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer mockDB.Close()
+			h := NewHandler(server.NewServer(storer.NewMySQLStorer(sqlx.NewDb(mockDB, "sqlmock"))), Config{})
+
+			r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(tc.body))
+			r = r.WithContext(context.WithValue(r.Context(), authKey{}, &token.UserClaims{ID: 1}))
+			w := httptest.NewRecorder()
+			h.createOrder(w, r)
+			require.Equal(t, tc.status, w.Code)
+			require.Contains(t, w.Body.String(), tc.code)
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"github.com/hellwind2019/ecomm/mailer"
+	"github.com/hellwind2019/ecomm/token"
+)
+
+const (
+	emailVerificationTTL = 48 * time.Hour
+	// verificationResendInterval is the minimum time between two
+	// verification emails to the same account.
+	verificationResendInterval = time.Minute
+)
+
+var errVerificationRateLimited = errors.New("verification email was sent recently")
+
+// /users/verify
+// GET takes the token from the emailed link, POST from the request body.
+func (h *Handler) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tokenStr := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		var req VerifyEmailRequest
+		if !decodeAndValidate(w, r, &req) {
+			return
+		}
+		tokenStr = req.Token
+	}
+	email, err := h.TokenMaker.VerifyPurposeToken(token.PurposeEmailVerification, tokenStr)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidToken, "Invalid or expired token")
+		return
+	}
+	// the token is bound to the email, so it stops working once the email changes
+	user, err := h.server.GetUser(ctx, email)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidToken, "Invalid or expired token")
+		return
+	}
+	if err := h.server.VerifyEmail(ctx, user.ID); err != nil {
+		writeError(w, err, "Failed to verify email")
+		return
+	}
+	if user.EmailVerifiedAt == nil {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	res := toUserResponse(user)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// /users/verify/resend
+func (h *Handler) resendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+	user, err := h.server.GetUserByID(ctx, claims.ID)
+	if err != nil {
+		writeError(w, err, "Failed to get user")
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		writeProblem(w, http.StatusConflict, CodeConflict, "Email is already verified")
+		return
+	}
+	err = h.sendVerificationEmail(ctx, user)
+	if errors.Is(err, errVerificationRateLimited) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(verificationResendInterval.Seconds())))
+		writeProblem(w, http.StatusTooManyRequests, CodeTooManyRequests, "Verification email was sent recently, try again later")
+		return
+	}
+	if err != nil {
+		writeError(w, err, "Failed to send verification email")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) sendVerificationEmail(ctx context.Context, user *storer.User) error {
+	ok, err := h.server.MarkVerificationSent(ctx, user.ID, verificationResendInterval)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errVerificationRateLimited
+	}
+	verifyToken, err := h.TokenMaker.CreatePurposeToken(token.PurposeEmailVerification, user.Email, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+	return h.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below. It expires in %d hours.\n\n%s%s/users/verify?token=%s\n",
+			user.Name, int(emailVerificationTTL.Hours()), h.publicURL, apiV1, url.QueryEscape(verifyToken)),
+	})
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// apiV1 is the path prefix of version 1 of the API. Breaking changes, such as
+// a changed response type, go into a new version mounted next to it in
+// RegisterRoutes, e.g. /v2, while v1 keeps working until it is retired with
+// Deprecated.
+const apiV1 = "/v1"
+
+// legacyRoutesDeprecatedAt is when the unversioned paths the API was served
+// under before apiV1 were deprecated.
+var legacyRoutesDeprecatedAt = time.Date(2025, time.August, 12, 0, 0, 0, 0, time.UTC)
+
+// Deprecation describes routes that are being retired.
+type Deprecation struct {
+	// Since is when the routes were deprecated.
+	Since time.Time
+	// Sunset is when they stop working, unannounced when zero.
+	Sunset time.Time
+	// Successor is the version prefix, such as /v2, serving the same paths,
+	// none when empty.
+	Successor string
+}
+
+// Deprecated sends the Deprecation (RFC 9745) and Sunset (RFC 8594) headers
+// and links the same path under the successor version. Once the sunset has
+// passed requests fail with 410.
+func Deprecated(d Deprecation) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("Deprecation", "@"+strconv.FormatInt(d.Since.Unix(), 10))
+			successor := ""
+			if d.Successor != "" {
+				successor = d.Successor + unversionedPath(r.URL.Path)
+				h.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+			}
+			if !d.Sunset.IsZero() {
+				h.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+				if !time.Now().Before(d.Sunset) {
+					detail := "This endpoint was retired"
+					if successor != "" {
+						detail += ", use " + successor + " instead"
+					}
+					writeProblem(w, http.StatusGone, CodeEndpointRetired, detail)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+var versionPrefixPattern = regexp.MustCompile(`^/v[0-9]+(/|$)`)
+
+// unversionedPath strips the version prefix, if any, from path.
+func unversionedPath(path string) string {
+	if loc := versionPrefixPattern.FindStringIndex(path); loc != nil {
+		return "/" + path[loc[1]:]
+	}
+	return path
+}
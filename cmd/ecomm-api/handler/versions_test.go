@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionedRoutes(t *testing.T) {
+	sunset := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	do := func(h *Handler, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		RegisterRoutes(h).ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		return w
+	}
+
+	t.Run("v1", func(t *testing.T) {
+		w := do(&Handler{legacyRoutesSunset: sunset}, "/v1/orders")
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.Empty(t, w.Header().Get("Deprecation"))
+		require.Empty(t, w.Header().Get("Sunset"))
+	})
+	t.Run("unversioned alias", func(t *testing.T) {
+		w := do(&Handler{legacyRoutesSunset: sunset}, "/orders")
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.Equal(t, "@1754956800", w.Header().Get("Deprecation"))
+		require.Equal(t, sunset.UTC().Format(http.TimeFormat), w.Header().Get("Sunset"))
+		require.Equal(t, `</v1/orders>; rel="successor-version"`, w.Header().Get("Link"))
+	})
+	t.Run("without sunset", func(t *testing.T) {
+		w := do(&Handler{}, "/orders")
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.NotEmpty(t, w.Header().Get("Deprecation"))
+		require.Empty(t, w.Header().Get("Sunset"))
+	})
+	t.Run("after sunset", func(t *testing.T) {
+		w := do(&Handler{legacyRoutesSunset: time.Now().Add(-time.Hour)}, "/orders")
+		require.Equal(t, http.StatusGone, w.Code)
+		require.Contains(t, w.Body.String(), CodeEndpointRetired)
+		require.Contains(t, w.Body.String(), "/v1/orders")
+	})
+	t.Run("unversioned routes", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		RegisterRoutes(&Handler{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Empty(t, w.Header().Get("Deprecation"))
+	})
+}
+
+func TestUnversionedPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/v1":             "/",
+		"/v1/orders":      "/orders",
+		"/v12/products/1": "/products/1",
+		"/orders":         "/orders",
+		"/version":        "/version",
+	} {
+		require.Equal(t, want, unversionedPath(path), path)
+	}
+}
@@ -1,33 +1,303 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/hellwind2019/ecomm/cmd/ecomm-api/handler"
 	"github.com/hellwind2019/ecomm/cmd/ecomm-api/server"
 	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
 	"github.com/hellwind2019/ecomm/db"
+	"github.com/hellwind2019/ecomm/logging"
+	"github.com/hellwind2019/ecomm/mailer"
+	"github.com/hellwind2019/ecomm/metrics"
+	"github.com/hellwind2019/ecomm/sso"
+	"github.com/hellwind2019/ecomm/tracing"
+	"github.com/hellwind2019/ecomm/util"
 	"github.com/ianschenck/envflag"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const minSecretKeyLength = 32
 
 func main() {
-	var secretKey = envflag.String("SECRET_KEY", "0123456789012345678901234567890123456789019", "Secret key for JWT signing")
+	var (
+		secretKey    = envflag.String("SECRET_KEY", "0123456789012345678901234567890123456789019", "Secret key for JWT signing")
+		publicURL    = envflag.String("PUBLIC_URL", "http://localhost:8080", "Base URL the storefront and API are served under, used for links in emails")
+		smtpAddr     = envflag.String("SMTP_ADDR", "", "SMTP server host:port, mail is written to the outbox when empty")
+		smtpUsername = envflag.String("SMTP_USERNAME", "", "SMTP username")
+		smtpPassword = envflag.String("SMTP_PASSWORD", "", "SMTP password")
+		mailFrom     = envflag.String("MAIL_FROM", "no-reply@ecomm.local", "Sender address of outgoing mail")
+		mailOutbox   = envflag.String("MAIL_OUTBOX", "", "File that outgoing mail is appended to when SMTP is not configured, mail is dropped when neither is set")
+
+		requireVerifiedEmail = envflag.Bool("REQUIRE_VERIFIED_EMAIL", false, "Block placing orders until the user's email is verified")
+		requireAdminMFA      = envflag.Bool("REQUIRE_ADMIN_MFA", false, "Withhold admin permissions until two-factor authentication is enabled")
+
+		passwordHasher    = envflag.String("PASSWORD_HASHER", "argon2id", "Algorithm for new password hashes: argon2id or bcrypt")
+		passwordMinLength = envflag.Int("PASSWORD_MIN_LENGTH", util.DefaultMinPasswordLength, "Minimum length of new passwords")
+		breachedPasswords = envflag.String("BREACHED_PASSWORDS_FILE", "", "File with one breached password per line that new passwords are checked against")
+
+		oidcProvidersFile = envflag.String("OIDC_PROVIDERS_FILE", "", "JSON file listing the OpenID Connect providers users can sign in with")
+
+		httpAddr              = envflag.String("HTTP_ADDR", ":8080", "Address the API listens on")
+		httpReadTimeout       = envflag.Duration("HTTP_READ_TIMEOUT", 15*time.Second, "Deadline for reading a whole request")
+		httpReadHeaderTimeout = envflag.Duration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second, "Deadline for reading request headers")
+		httpWriteTimeout      = envflag.Duration("HTTP_WRITE_TIMEOUT", 30*time.Second, "Deadline for writing a response, must exceed REQUEST_TIMEOUT")
+		httpIdleTimeout       = envflag.Duration("HTTP_IDLE_TIMEOUT", 60*time.Second, "How long idle keep-alive connections stay open")
+		httpMaxHeaderBytes    = envflag.Int("HTTP_MAX_HEADER_BYTES", 64<<10, "Maximum size of request headers")
+		shutdownTimeout       = envflag.Duration("SHUTDOWN_TIMEOUT", 20*time.Second, "How long in-flight requests may take to finish on SIGTERM")
+		shutdownDelay         = envflag.Duration("SHUTDOWN_DELAY", 5*time.Second, "How long /readyz fails on SIGTERM before the server stops accepting connections")
+
+		requestTimeout = envflag.Duration("REQUEST_TIMEOUT", handler.DefaultRequestTimeout, "Deadline of each request, exceeding it returns 504")
+		queryTimeout   = envflag.Duration("QUERY_TIMEOUT", storer.DefaultQueryTimeout, "Deadline of each database call, 0 disables it")
+
+		idempotencyCleanupInterval = envflag.Duration("IDEMPOTENCY_CLEANUP_INTERVAL", 10*time.Minute, "How often expired idempotency keys are deleted, 0 disables it")
+
+		logLevel  = envflag.String("LOG_LEVEL", "info", "Minimum level of log records: debug, info, warn or error")
+		logFormat = envflag.String("LOG_FORMAT", "json", "Format of log records: json or text")
+
+		rateLimits     = envflag.String("RATE_LIMITS", "", "Overrides of the rate limit policies default, auth and orders as name=requests/period, e.g. auth=5/1m, 0 requests disables a policy")
+		trustedProxies = envflag.String("TRUSTED_PROXIES", "", "Comma separated IPs or CIDRs of load balancers whose X-Forwarded-For is trusted")
+
+		tlsCertFile          = envflag.String("TLS_CERT_FILE", "", "Certificate chain to serve HTTPS with, reloaded on SIGHUP")
+		tlsKeyFile           = envflag.String("TLS_KEY_FILE", "", "Private key of TLS_CERT_FILE")
+		hsts                 = envflag.Bool("HSTS", false, "Send Strict-Transport-Security, implied by TLS_CERT_FILE; set it when a load balancer terminates HTTPS")
+		corsAllowedOrigins   = envflag.String("CORS_ALLOWED_ORIGINS", "", "Comma separated origins browsers may call the API from, * allows any")
+		corsAllowCredentials = envflag.Bool("CORS_ALLOW_CREDENTIALS", false, "Allow credentialed cross-origin requests")
+		corsMaxAge           = envflag.Duration("CORS_MAX_AGE", 10*time.Minute, "How long browsers cache preflight responses")
+
+		legacyRoutesSunset = envflag.String("LEGACY_ROUTES_SUNSET", "", "RFC 3339 time after which the unversioned aliases of the /v1 routes answer 410, they are kept when empty")
+
+		traceExporter = envflag.String("TRACE_EXPORTER", tracing.ExporterNone, "Where spans are sent: otlp, stdout or none, otlp is configured with the OTEL_EXPORTER_OTLP_* variables")
+	)
+	envflag.Parse()
+	logger, err := logging.New(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fatal("failed to configure logging", err)
+	}
+	// also routes the log package, e.g. the errors of net/http, through it
+	slog.SetDefault(logger)
+	shutdownTracing, err := tracing.Setup(context.Background(), *traceExporter, "ecomm-api", handler.BuildInfo().Commit)
+	if err != nil {
+		fatal("failed to configure tracing", err)
+	}
+	defer func() {
+		// flushes the spans of the drained requests
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("failed to flush spans", "error", err)
+		}
+	}()
 	if len(*secretKey) < minSecretKeyLength {
-		log.Fatalf("Secret key must be at least %d characters long", minSecretKeyLength)
+		fatal("secret key is too short", fmt.Errorf("must be at least %d characters long", minSecretKeyLength))
+	}
+	switch *passwordHasher {
+	case "argon2id":
+		util.SetPasswordHasher(util.NewArgon2idHasher(util.DefaultArgon2idParams))
+	case "bcrypt":
+		util.SetPasswordHasher(util.NewBcryptHasher(bcrypt.DefaultCost))
+	default:
+		fatal("failed to configure password hashing", fmt.Errorf("unknown password hasher %q", *passwordHasher))
+	}
+	passwordPolicy, err := util.NewPasswordPolicy(*passwordMinLength, *breachedPasswords)
+	if err != nil {
+		fatal("failed to load password policy", err)
+	}
+	rateLimitPolicies, err := handler.ParseRateLimits(*rateLimits)
+	if err != nil {
+		fatal("failed to parse rate limits", err)
+	}
+	proxies, err := parsePrefixes(*trustedProxies)
+	if err != nil {
+		fatal("failed to parse trusted proxies", err)
+	}
+	corsAllowedOriginList := splitList(*corsAllowedOrigins)
+	if *corsAllowCredentials && slices.Contains(corsAllowedOriginList, "*") {
+		fatal("invalid CORS configuration", fmt.Errorf("CORS_ALLOW_CREDENTIALS needs exact origins in CORS_ALLOWED_ORIGINS, not *"))
+	}
+	var sunset time.Time
+	if *legacyRoutesSunset != "" {
+		sunset, err = time.Parse(time.RFC3339, *legacyRoutesSunset)
+		if err != nil {
+			fatal("failed to parse legacy routes sunset", err)
+		}
+	}
+	var certs *handler.CertReloader
+	if *tlsCertFile != "" {
+		certs, err = handler.NewCertReloader(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			fatal("failed to load TLS certificate", err)
+		}
 	}
 	db, err := db.NewDatabase()
 	if err != nil {
-		log.Fatalf("failed to connect to database: %v", err)
+		fatal("failed to connect to database", err)
 	}
 	defer db.Close()
-	log.Println("Database connection established successfully")
+	slog.Info("database connection established")
+	metrics.RegisterDB(db.GetDB().DB, "ecomm")
 
 	st := storer.NewMySQLStorer(db.GetDB())
+	st.SetQueryTimeout(*queryTimeout)
+	st.SetCallObserver(metrics.ObserveStorerCall)
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap-admin" {
+		if err := bootstrapAdmin(context.Background(), st, passwordPolicy, os.Args[2:]); err != nil {
+			fatal("failed to bootstrap admin", err)
+		}
+		slog.Info("admin user created")
+		return
+	}
+
+	var m mailer.Mailer
+	switch {
+	case *smtpAddr != "":
+		m, err = mailer.NewSMTPMailer(*smtpAddr, *smtpUsername, *smtpPassword, *mailFrom)
+		if err != nil {
+			fatal("failed to configure mailer", err)
+		}
+	case *mailOutbox != "":
+		f, err := os.OpenFile(*mailOutbox, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			fatal("failed to open mail outbox", err)
+		}
+		defer f.Close()
+		m = mailer.NewOutboxMailer(f)
+	default:
+		slog.Warn("neither SMTP_ADDR nor MAIL_OUTBOX is set, outgoing mail will be dropped")
+		m = mailer.DiscardMailer{}
+	}
+
+	var oidcProviders map[string]*sso.Provider
+	if *oidcProvidersFile != "" {
+		oidcProviders, err = sso.LoadProviders(context.Background(), *oidcProvidersFile)
+		if err != nil {
+			fatal("failed to load oidc providers", err)
+		}
+	}
+
 	srv := server.NewServer(st)
-	hdl := handler.NewHandler(srv, *secretKey)
-	handler.RegisterRoutes(hdl)
-	handler.Start(":8080")
+	hdl := handler.NewHandler(srv, handler.Config{
+		SecretKey: *secretKey,
+		PublicURL: *publicURL,
+		Mailer:    m,
+
+		RequireVerifiedEmail: *requireVerifiedEmail,
+		RequireAdminMFA:      *requireAdminMFA,
+		PasswordPolicy:       passwordPolicy,
+		OIDCProviders:        oidcProviders,
+		RequestTimeout:       *requestTimeout,
+		Database:             db,
+		RateLimits:           rateLimitPolicies,
+		TrustedProxies:       proxies,
+		CORS: handler.CORSConfig{
+			AllowedOrigins:   corsAllowedOriginList,
+			AllowCredentials: *corsAllowCredentials,
+			MaxAge:           *corsMaxAge,
+		},
+		HSTS:               *hsts || certs != nil,
+		LegacyRoutesSunset: sunset,
+	})
+	if err := sealTOTPSecrets(context.Background(), srv, hdl.TokenMaker); err != nil {
+		slog.Error("failed to encrypt plaintext totp secrets, they are encrypted on the next start", "error", err)
+	}
+	httpServer := handler.NewHTTPServer(handler.RegisterRoutes(hdl), handler.ServerConfig{
+		Addr:              *httpAddr,
+		ReadTimeout:       *httpReadTimeout,
+		ReadHeaderTimeout: *httpReadHeaderTimeout,
+		WriteTimeout:      *httpWriteTimeout,
+		IdleTimeout:       *httpIdleTimeout,
+		MaxHeaderBytes:    *httpMaxHeaderBytes,
+		Certificates:      certs,
+	})
+	ln, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		fatal("failed to listen", err)
+	}
+	if certs != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := certs.Reload(); err != nil {
+					slog.Error("failed to reload TLS certificate, keeping the previous one", "error", err)
+					continue
+				}
+				slog.Info("reloaded TLS certificate")
+			}
+		}()
+	}
+	sig, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-sig.Done()
+		// give the load balancer time to see /readyz fail before the
+		// listener closes
+		hdl.StartShutdown()
+		slog.Info("shutting down", "delay", *shutdownDelay)
+		time.Sleep(*shutdownDelay)
+		cancel()
+	}()
+	if *idempotencyCleanupInterval > 0 {
+		go deleteExpiredIdempotencyKeys(ctx, srv, *idempotencyCleanupInterval)
+	}
+	slog.Info("listening", "addr", ln.Addr().String(), "tls", certs != nil)
+	if err := handler.Serve(ctx, httpServer, ln, *shutdownTimeout); err != nil {
+		fatal("server stopped", err)
+	}
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancelDrain()
+	if err := hdl.Drain(drainCtx); err != nil {
+		slog.Error("background work did not finish", "error", err)
+	}
+	// the deferred db.Close runs once the requests are drained
+	slog.Info("server stopped")
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+// parsePrefixes parses a comma separated list of IPs and CIDRs.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, f := range splitList(s) {
+		if !strings.Contains(f, "/") {
+			addr, err := netip.ParseAddr(f)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(f)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
 
+// fatal logs err and exits, deferred calls don't run.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -2,10 +2,14 @@ package server
 
 import (
 	"context"
+	"time"
 
 	"github.com/hellwind2019/ecomm/cmd/ecomm-api/storer"
+	"go.opentelemetry.io/otel"
 )
 
+var tracer = otel.Tracer("github.com/hellwind2019/ecomm/cmd/ecomm-api/server")
+
 type Server struct {
 	storer *storer.MySQLStorer
 }
@@ -16,57 +20,378 @@ func NewServer(storer *storer.MySQLStorer) *Server {
 	}
 }
 func (s *Server) CreateProduct(ctx context.Context, p *storer.Product) (*storer.Product, error) {
+	ctx, span := tracer.Start(ctx, "Server.CreateProduct")
+	defer span.End()
 	return s.storer.CreateProduct(ctx, p)
 }
 func (s *Server) GetProduct(ctx context.Context, id int64) (*storer.Product, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetProduct")
+	defer span.End()
 	return s.storer.GetProduct(ctx, id)
 }
 func (s *Server) ListProducts(ctx context.Context) ([]storer.Product, error) {
+	ctx, span := tracer.Start(ctx, "Server.ListProducts")
+	defer span.End()
 	return s.storer.ListProducts(ctx)
 }
 func (s *Server) UpdateProduct(ctx context.Context, p *storer.Product) (*storer.Product, error) {
+	ctx, span := tracer.Start(ctx, "Server.UpdateProduct")
+	defer span.End()
 	return s.storer.UpdateProduct(ctx, p)
 }
 func (s *Server) DeleteProduct(ctx context.Context, id int64) error {
+	ctx, span := tracer.Start(ctx, "Server.DeleteProduct")
+	defer span.End()
 	return s.storer.DeleteProduct(ctx, id)
 }
 
 func (s *Server) CreateOrder(ctx context.Context, o *storer.Order) (*storer.Order, error) {
+	ctx, span := tracer.Start(ctx, "Server.CreateOrder")
+	defer span.End()
 	return s.storer.CreateOrder(ctx, o)
 }
 func (s *Server) GetOrder(ctx context.Context, id int64) (*storer.Order, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetOrder")
+	defer span.End()
 	return s.storer.GetOrder(ctx, id)
 }
 func (s *Server) ListOrders(ctx context.Context) ([]storer.Order, error) {
+	ctx, span := tracer.Start(ctx, "Server.ListOrders")
+	defer span.End()
 	return s.storer.ListOrders(ctx)
 }
 func (s *Server) DeleteOrder(ctx context.Context, id int64) error {
+	ctx, span := tracer.Start(ctx, "Server.DeleteOrder")
+	defer span.End()
 	return s.storer.DeleteOrder(ctx, id)
 }
 func (s *Server) CreateUser(ctx context.Context, u *storer.User) (*storer.User, error) {
+	ctx, span := tracer.Start(ctx, "Server.CreateUser")
+	defer span.End()
 	return s.storer.CreateUser(ctx, u)
 }
+func (s *Server) GetUserByID(ctx context.Context, id int64) (*storer.User, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetUserByID")
+	defer span.End()
+	return s.storer.GetUserByID(ctx, id)
+}
 func (s *Server) GetUser(ctx context.Context, email string) (*storer.User, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetUser")
+	defer span.End()
 	return s.storer.GetUser(ctx, email)
 }
 func (s *Server) ListUsers(ctx context.Context) ([]storer.User, error) {
+	ctx, span := tracer.Start(ctx, "Server.ListUsers")
+	defer span.End()
 	return s.storer.ListUsers(ctx)
 }
-func (s *Server) UpdateUser(ctx context.Context, u *storer.User) (*storer.User, error) {
-	return s.storer.UpdateUser(ctx, u)
+func (s *Server) UpdateUser(ctx context.Context, u *storer.User, actorID *int64) (*storer.User, error) {
+	ctx, span := tracer.Start(ctx, "Server.UpdateUser")
+	defer span.End()
+	return s.storer.UpdateUser(ctx, u, actorID)
 }
 func (s *Server) DeleteUser(ctx context.Context, id int64) error {
+	ctx, span := tracer.Start(ctx, "Server.DeleteUser")
+	defer span.End()
 	return s.storer.DeleteUser(ctx, id)
 }
 func (s *Server) CreateSession(ctx context.Context, session *storer.Session) (*storer.Session, error) {
+	ctx, span := tracer.Start(ctx, "Server.CreateSession")
+	defer span.End()
 	return s.storer.CreateSession(ctx, session)
 }
 func (s *Server) GetSession(ctx context.Context, id string) (*storer.Session, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetSession")
+	defer span.End()
 	return s.storer.GetSession(ctx, id)
 }
 func (s *Server) RevokeSession(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "Server.RevokeSession")
+	defer span.End()
 	return s.storer.RevokeSession(ctx, id)
 }
 func (s *Server) DeleteSession(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "Server.DeleteSession")
+	defer span.End()
 	return s.storer.DeleteSession(ctx, id)
 }
+func (s *Server) ListSessions(ctx context.Context, email string) ([]storer.Session, error) {
+	ctx, span := tracer.Start(ctx, "Server.ListSessions")
+	defer span.End()
+	return s.storer.ListSessions(ctx, email)
+}
+func (s *Server) TouchSession(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "Server.TouchSession")
+	defer span.End()
+	return s.storer.TouchSession(ctx, id)
+}
+func (s *Server) RevokeUserSessions(ctx context.Context, email string, exceptID string) error {
+	ctx, span := tracer.Start(ctx, "Server.RevokeUserSessions")
+	defer span.End()
+	return s.storer.RevokeUserSessions(ctx, email, exceptID)
+}
+func (s *Server) ListUserRoles(ctx context.Context, userID int64) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "Server.ListUserRoles")
+	defer span.End()
+	return s.storer.ListUserRoles(ctx, userID)
+}
+func (s *Server) ListUserPermissions(ctx context.Context, userID int64) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "Server.ListUserPermissions")
+	defer span.End()
+	return s.storer.ListUserPermissions(ctx, userID)
+}
+func (s *Server) GrantRole(ctx context.Context, userID int64, role string, actorID *int64) error {
+	ctx, span := tracer.Start(ctx, "Server.GrantRole")
+	defer span.End()
+	return s.storer.GrantRole(ctx, userID, role, actorID)
+}
+func (s *Server) RevokeRole(ctx context.Context, userID int64, role string, actorID *int64) error {
+	ctx, span := tracer.Start(ctx, "Server.RevokeRole")
+	defer span.End()
+	return s.storer.RevokeRole(ctx, userID, role, actorID)
+}
+func (s *Server) MarkPasswordResetSent(ctx context.Context, id int64, interval time.Duration) (bool, error) {
+	ctx, span := tracer.Start(ctx, "Server.MarkPasswordResetSent")
+	defer span.End()
+	return s.storer.MarkPasswordResetSent(ctx, id, interval)
+}
+func (s *Server) CreatePasswordReset(ctx context.Context, pr *storer.PasswordReset) (*storer.PasswordReset, error) {
+	ctx, span := tracer.Start(ctx, "Server.CreatePasswordReset")
+	defer span.End()
+	return s.storer.CreatePasswordReset(ctx, pr)
+}
+func (s *Server) GetPasswordReset(ctx context.Context, tokenHash string) (*storer.PasswordReset, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetPasswordReset")
+	defer span.End()
+	return s.storer.GetPasswordReset(ctx, tokenHash)
+}
+func (s *Server) ResetPassword(ctx context.Context, pr *storer.PasswordReset, passwordHash string) error {
+	ctx, span := tracer.Start(ctx, "Server.ResetPassword")
+	defer span.End()
+	return s.storer.ResetPassword(ctx, pr, passwordHash)
+}
+func (s *Server) UpdateUserPassword(ctx context.Context, id int64, passwordHash string) error {
+	ctx, span := tracer.Start(ctx, "Server.UpdateUserPassword")
+	defer span.End()
+	return s.storer.UpdateUserPassword(ctx, id, passwordHash)
+}
+func (s *Server) VerifyEmail(ctx context.Context, id int64) error {
+	ctx, span := tracer.Start(ctx, "Server.VerifyEmail")
+	defer span.End()
+	return s.storer.VerifyEmail(ctx, id)
+}
+func (s *Server) MarkVerificationSent(ctx context.Context, id int64, interval time.Duration) (bool, error) {
+	ctx, span := tracer.Start(ctx, "Server.MarkVerificationSent")
+	defer span.End()
+	return s.storer.MarkVerificationSent(ctx, id, interval)
+}
+func (s *Server) SaveTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	ctx, span := tracer.Start(ctx, "Server.SaveTOTPSecret")
+	defer span.End()
+	return s.storer.SaveTOTPSecret(ctx, userID, secret)
+}
+func (s *Server) GetUserTOTP(ctx context.Context, userID int64) (*storer.UserTOTP, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetUserTOTP")
+	defer span.End()
+	return s.storer.GetUserTOTP(ctx, userID)
+}
+func (s *Server) ListUserTOTP(ctx context.Context) ([]storer.UserTOTP, error) {
+	ctx, span := tracer.Start(ctx, "Server.ListUserTOTP")
+	defer span.End()
+	return s.storer.ListUserTOTP(ctx)
+}
+func (s *Server) ReplaceTOTPSecret(ctx context.Context, userID int64, old, secret string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "Server.ReplaceTOTPSecret")
+	defer span.End()
+	return s.storer.ReplaceTOTPSecret(ctx, userID, old, secret)
+}
+func (s *Server) EnableTOTP(ctx context.Context, userID int64, step int64, codeHashes []string) error {
+	ctx, span := tracer.Start(ctx, "Server.EnableTOTP")
+	defer span.End()
+	return s.storer.EnableTOTP(ctx, userID, step, codeHashes)
+}
+func (s *Server) UseTOTPStep(ctx context.Context, userID int64, step int64) (bool, error) {
+	ctx, span := tracer.Start(ctx, "Server.UseTOTPStep")
+	defer span.End()
+	return s.storer.UseTOTPStep(ctx, userID, step)
+}
+func (s *Server) DisableTOTP(ctx context.Context, userID int64) error {
+	ctx, span := tracer.Start(ctx, "Server.DisableTOTP")
+	defer span.End()
+	return s.storer.DisableTOTP(ctx, userID)
+}
+func (s *Server) UseRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "Server.UseRecoveryCode")
+	defer span.End()
+	return s.storer.UseRecoveryCode(ctx, userID, codeHash)
+}
+func (s *Server) ReplaceRecoveryCodes(ctx context.Context, userID int64, codeHashes []string) error {
+	ctx, span := tracer.Start(ctx, "Server.ReplaceRecoveryCodes")
+	defer span.End()
+	return s.storer.ReplaceRecoveryCodes(ctx, userID, codeHashes)
+}
+func (s *Server) GetLoginThrottle(ctx context.Context, kind, key string) (*storer.LoginThrottle, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetLoginThrottle")
+	defer span.End()
+	return s.storer.GetLoginThrottle(ctx, kind, key)
+}
+func (s *Server) RecordLoginFailure(ctx context.Context, kind, key string, window time.Duration) (*storer.LoginThrottle, error) {
+	ctx, span := tracer.Start(ctx, "Server.RecordLoginFailure")
+	defer span.End()
+	return s.storer.RecordLoginFailure(ctx, kind, key, window)
+}
+func (s *Server) LockLogin(ctx context.Context, kind, key string, until time.Time) error {
+	ctx, span := tracer.Start(ctx, "Server.LockLogin")
+	defer span.End()
+	return s.storer.LockLogin(ctx, kind, key, until)
+}
+func (s *Server) ClearLoginThrottle(ctx context.Context, kind, key string) error {
+	ctx, span := tracer.Start(ctx, "Server.ClearLoginThrottle")
+	defer span.End()
+	return s.storer.ClearLoginThrottle(ctx, kind, key)
+}
+func (s *Server) UnlockAccount(ctx context.Context, u *storer.User, actorID *int64) error {
+	ctx, span := tracer.Start(ctx, "Server.UnlockAccount")
+	defer span.End()
+	return s.storer.UnlockAccount(ctx, u, actorID)
+}
+func (s *Server) CreateAPIKey(ctx context.Context, k *storer.APIKey) (*storer.APIKey, error) {
+	ctx, span := tracer.Start(ctx, "Server.CreateAPIKey")
+	defer span.End()
+	return s.storer.CreateAPIKey(ctx, k)
+}
+func (s *Server) GetAPIKey(ctx context.Context, id int64) (*storer.APIKey, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetAPIKey")
+	defer span.End()
+	return s.storer.GetAPIKey(ctx, id)
+}
+func (s *Server) GetAPIKeyByPrefix(ctx context.Context, prefix string) (*storer.APIKey, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetAPIKeyByPrefix")
+	defer span.End()
+	return s.storer.GetAPIKeyByPrefix(ctx, prefix)
+}
+func (s *Server) ListAPIKeys(ctx context.Context) ([]storer.APIKey, error) {
+	ctx, span := tracer.Start(ctx, "Server.ListAPIKeys")
+	defer span.End()
+	return s.storer.ListAPIKeys(ctx)
+}
+func (s *Server) RevokeAPIKey(ctx context.Context, k *storer.APIKey, actorID *int64) error {
+	ctx, span := tracer.Start(ctx, "Server.RevokeAPIKey")
+	defer span.End()
+	return s.storer.RevokeAPIKey(ctx, k, actorID)
+}
+func (s *Server) TouchAPIKey(ctx context.Context, id int64) error {
+	ctx, span := tracer.Start(ctx, "Server.TouchAPIKey")
+	defer span.End()
+	return s.storer.TouchAPIKey(ctx, id)
+}
+func (s *Server) CreateUserWithIdentity(ctx context.Context, u *storer.User, ui *storer.UserIdentity) (*storer.User, error) {
+	ctx, span := tracer.Start(ctx, "Server.CreateUserWithIdentity")
+	defer span.End()
+	return s.storer.CreateUserWithIdentity(ctx, u, ui)
+}
+func (s *Server) CreateUserIdentity(ctx context.Context, ui *storer.UserIdentity) error {
+	ctx, span := tracer.Start(ctx, "Server.CreateUserIdentity")
+	defer span.End()
+	return s.storer.CreateUserIdentity(ctx, ui)
+}
+func (s *Server) GetUserByIdentity(ctx context.Context, provider, subject string) (*storer.User, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetUserByIdentity")
+	defer span.End()
+	return s.storer.GetUserByIdentity(ctx, provider, subject)
+}
+func (s *Server) ListUserIdentities(ctx context.Context, userID int64) ([]storer.UserIdentity, error) {
+	ctx, span := tracer.Start(ctx, "Server.ListUserIdentities")
+	defer span.End()
+	return s.storer.ListUserIdentities(ctx, userID)
+}
+func (s *Server) DeleteUserIdentity(ctx context.Context, userID int64, provider string) error {
+	ctx, span := tracer.Start(ctx, "Server.DeleteUserIdentity")
+	defer span.End()
+	return s.storer.DeleteUserIdentity(ctx, userID, provider)
+}
+func (s *Server) CreateOAuthClient(ctx context.Context, c *storer.OAuthClient) (*storer.OAuthClient, error) {
+	ctx, span := tracer.Start(ctx, "Server.CreateOAuthClient")
+	defer span.End()
+	return s.storer.CreateOAuthClient(ctx, c)
+}
+func (s *Server) GetOAuthClient(ctx context.Context, id string) (*storer.OAuthClient, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetOAuthClient")
+	defer span.End()
+	return s.storer.GetOAuthClient(ctx, id)
+}
+func (s *Server) ListOAuthClients(ctx context.Context) ([]storer.OAuthClient, error) {
+	ctx, span := tracer.Start(ctx, "Server.ListOAuthClients")
+	defer span.End()
+	return s.storer.ListOAuthClients(ctx)
+}
+func (s *Server) RevokeOAuthClient(ctx context.Context, c *storer.OAuthClient, actorID *int64) error {
+	ctx, span := tracer.Start(ctx, "Server.RevokeOAuthClient")
+	defer span.End()
+	return s.storer.RevokeOAuthClient(ctx, c, actorID)
+}
+func (s *Server) CreateOAuthAuthorizationCode(ctx context.Context, code *storer.OAuthAuthorizationCode) error {
+	ctx, span := tracer.Start(ctx, "Server.CreateOAuthAuthorizationCode")
+	defer span.End()
+	return s.storer.CreateOAuthAuthorizationCode(ctx, code)
+}
+func (s *Server) GetOAuthAuthorizationCode(ctx context.Context, codeHash string) (*storer.OAuthAuthorizationCode, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetOAuthAuthorizationCode")
+	defer span.End()
+	return s.storer.GetOAuthAuthorizationCode(ctx, codeHash)
+}
+func (s *Server) UseOAuthAuthorizationCode(ctx context.Context, id int64, clientID string) error {
+	ctx, span := tracer.Start(ctx, "Server.UseOAuthAuthorizationCode")
+	defer span.End()
+	return s.storer.UseOAuthAuthorizationCode(ctx, id, clientID)
+}
+func (s *Server) CreateOAuthGrant(ctx context.Context, g *storer.OAuthGrant, rt *storer.OAuthRefreshToken) error {
+	ctx, span := tracer.Start(ctx, "Server.CreateOAuthGrant")
+	defer span.End()
+	return s.storer.CreateOAuthGrant(ctx, g, rt)
+}
+func (s *Server) ClientCredentialsGrant(ctx context.Context, g *storer.OAuthGrant) (*storer.OAuthGrant, error) {
+	ctx, span := tracer.Start(ctx, "Server.ClientCredentialsGrant")
+	defer span.End()
+	return s.storer.ClientCredentialsGrant(ctx, g)
+}
+func (s *Server) GetOAuthGrant(ctx context.Context, id string) (*storer.OAuthGrant, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetOAuthGrant")
+	defer span.End()
+	return s.storer.GetOAuthGrant(ctx, id)
+}
+func (s *Server) GetOAuthRefreshToken(ctx context.Context, tokenHash string) (*storer.OAuthRefreshToken, error) {
+	ctx, span := tracer.Start(ctx, "Server.GetOAuthRefreshToken")
+	defer span.End()
+	return s.storer.GetOAuthRefreshToken(ctx, tokenHash)
+}
+func (s *Server) RotateOAuthRefreshToken(ctx context.Context, oldHash string, next *storer.OAuthRefreshToken) (*storer.OAuthGrant, error) {
+	ctx, span := tracer.Start(ctx, "Server.RotateOAuthRefreshToken")
+	defer span.End()
+	return s.storer.RotateOAuthRefreshToken(ctx, oldHash, next)
+}
+func (s *Server) RevokeOAuthGrant(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "Server.RevokeOAuthGrant")
+	defer span.End()
+	return s.storer.RevokeOAuthGrant(ctx, id)
+}
+func (s *Server) ClaimIdempotencyKey(ctx context.Context, k *storer.IdempotencyKey, now time.Time) (*storer.IdempotencyKey, bool, error) {
+	ctx, span := tracer.Start(ctx, "Server.ClaimIdempotencyKey")
+	defer span.End()
+	return s.storer.ClaimIdempotencyKey(ctx, k, now)
+}
+func (s *Server) DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time, limit int) (int64, error) {
+	ctx, span := tracer.Start(ctx, "Server.DeleteExpiredIdempotencyKeys")
+	defer span.End()
+	return s.storer.DeleteExpiredIdempotencyKeys(ctx, now, limit)
+}
+func (s *Server) SaveIdempotentResponse(ctx context.Context, k *storer.IdempotencyKey) error {
+	ctx, span := tracer.Start(ctx, "Server.SaveIdempotentResponse")
+	defer span.End()
+	return s.storer.SaveIdempotentResponse(ctx, k)
+}
+func (s *Server) ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	ctx, span := tracer.Start(ctx, "Server.ReleaseIdempotencyKey")
+	defer span.End()
+	return s.storer.ReleaseIdempotencyKey(ctx, scope, key)
+}
@@ -0,0 +1,57 @@
+package storer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Domain errors returned by the storer. The original database error stays
+// wrapped for logging, handlers only look at these.
+var (
+	// ErrNotFound is returned when the requested row doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a unique key would be duplicated, or a row
+	// is still referenced and can't be deleted.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidReference is returned when a row refers to another row that
+	// doesn't exist.
+	ErrInvalidReference = errors.New("invalid reference")
+	// ErrInvalidToken is returned when a single-use token is unknown, expired or
+	// already used.
+	ErrInvalidToken = errors.New("invalid or expired token")
+	// ErrLastAdmin is returned when a change would leave the store without an
+	// admin.
+	ErrLastAdmin = errors.New("last admin")
+)
+
+// MySQL error numbers mapped to domain errors.
+const (
+	mysqlDuplicateEntry     = 1062
+	mysqlRowIsReferenced    = 1451
+	mysqlNoReferencedRow    = 1452
+	mysqlRowIsReferenced2   = 1217
+	mysqlNoReferencedRowOld = 1216
+)
+
+// dbError maps a database error to a domain error, keeping the original
+// wrapped. Errors that are already domain errors or unknown pass through.
+func dbError(err error) error {
+	var me *mysql.MySQLError
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrConflict), errors.Is(err, ErrInvalidReference), errors.Is(err, ErrInvalidToken), errors.Is(err, ErrLastAdmin):
+		return err
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case errors.As(err, &me):
+		switch me.Number {
+		case mysqlDuplicateEntry, mysqlRowIsReferenced, mysqlRowIsReferenced2:
+			return fmt.Errorf("%w: %w", ErrConflict, err)
+		case mysqlNoReferencedRow, mysqlNoReferencedRowOld:
+			return fmt.Errorf("%w: %w", ErrInvalidReference, err)
+		}
+	}
+	return err
+}
@@ -2,54 +2,114 @@ package storer
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/hellwind2019/ecomm/rbac"
 	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// DefaultQueryTimeout bounds every storer call unless SetQueryTimeout
+// changes it.
+const DefaultQueryTimeout = 5 * time.Second
+
+var tracer = otel.Tracer("github.com/hellwind2019/ecomm/cmd/ecomm-api/storer")
+
+var dbSystem = attribute.String("db.system", "mysql")
+
 type MySQLStorer struct {
-	db *sqlx.DB
+	db           *sqlx.DB
+	queryTimeout time.Duration
+	observeCall  func(method string, d time.Duration)
 }
 
 func NewMySQLStorer(db *sqlx.DB) *MySQLStorer {
 	return &MySQLStorer{
-		db: db,
+		db:           db,
+		queryTimeout: DefaultQueryTimeout,
+	}
+}
+
+// SetQueryTimeout sets the deadline of each storer call, including all
+// queries of its transaction. Zero disables it and only the caller's context
+// applies.
+func (s *MySQLStorer) SetQueryTimeout(d time.Duration) {
+	s.queryTimeout = d
+}
+
+// SetCallObserver sets a function that is told the duration of every storer
+// call, such as a metrics histogram.
+func (s *MySQLStorer) SetCallObserver(fn func(method string, d time.Duration)) {
+	s.observeCall = fn
+}
+
+// startCall derives the context the queries of one storer call run
+// with. The driver aborts a running query when it is done. The call is traced
+// as a span and done also reports its duration to the call observer.
+func (s *MySQLStorer) startCall(ctx context.Context, method string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "MySQLStorer."+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(dbSystem))
+	cancel := context.CancelFunc(func() {})
+	if s.queryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.queryTimeout)
+	}
+	return ctx, func() {
+		cancel()
+		span.End()
+		if s.observeCall != nil {
+			s.observeCall(method, time.Since(start))
+		}
 	}
 }
 
 func (s *MySQLStorer) CreateProduct(ctx context.Context, p *Product) (*Product, error) {
+	ctx, done := s.startCall(ctx, "CreateProduct")
+	defer done()
 	query := `INSERT INTO products (name, image, category, description, rating, num_reviews, price, count_in_stock) VALUES (:name, :image, :category, :description, :rating, :num_reviews, :price, :count_in_stock)`
 
 	res, err := s.db.NamedExecContext(ctx, query, p)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create product: %w", err)
+		return nil, fmt.Errorf("failed to create product: %w", dbError(err))
 	}
 	id, err := res.LastInsertId()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+		return nil, fmt.Errorf("failed to get last insert id: %w", dbError(err))
 	}
 	p.ID = id
 	return p, nil
 }
 
 func (s *MySQLStorer) GetProduct(ctx context.Context, id int64) (*Product, error) {
+	ctx, done := s.startCall(ctx, "GetProduct")
+	defer done()
 	var p Product
 	err := s.db.GetContext(ctx, &p, "SELECT * FROM products WHERE id = ?", id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get product: %w", err)
+		return nil, fmt.Errorf("failed to get product: %w", dbError(err))
 	}
 	return &p, nil
 }
 func (s *MySQLStorer) ListProducts(ctx context.Context) ([]Product, error) {
+	ctx, done := s.startCall(ctx, "ListProducts")
+	defer done()
 	var products []Product
 	err := s.db.SelectContext(ctx, &products, "SELECT * FROM products")
 	if err != nil {
-		return nil, fmt.Errorf("failed to list products: %w", err)
+		return nil, fmt.Errorf("failed to list products: %w", dbError(err))
 	}
 	return products, nil
 }
 
 func (s *MySQLStorer) UpdateProduct(ctx context.Context, p *Product) (*Product, error) {
+	ctx, done := s.startCall(ctx, "UpdateProduct")
+	defer done()
 	query := `
 		UPDATE products SET
 			name = :name,
@@ -66,36 +126,40 @@ func (s *MySQLStorer) UpdateProduct(ctx context.Context, p *Product) (*Product,
 
 	_, err := s.db.NamedExecContext(ctx, query, p)
 	if err != nil {
-		return nil, fmt.Errorf("failed to update product: %w", err)
+		return nil, fmt.Errorf("failed to update product: %w", dbError(err))
 	}
 	return p, nil
 }
 func (s *MySQLStorer) DeleteProduct(ctx context.Context, id int64) error {
+	ctx, done := s.startCall(ctx, "DeleteProduct")
+	defer done()
 	_, err := s.db.ExecContext(ctx, "DELETE FROM products WHERE id = ?", id)
 	if err != nil {
-		return fmt.Errorf("failed to delete product: %w", err)
+		return fmt.Errorf("failed to delete product: %w", dbError(err))
 	}
 	return nil
 }
 func (s *MySQLStorer) CreateOrder(ctx context.Context, o *Order) (*Order, error) {
+	ctx, done := s.startCall(ctx, "CreateOrder")
+	defer done()
 	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
 		//insert into orders
 		order, err := createOrder(ctx, tx, o)
 		if err != nil {
-			return fmt.Errorf("failed to create order: %w", err)
+			return fmt.Errorf("failed to create order: %w", dbError(err))
 		}
 		for _, oi := range o.Items {
 			oi.OrderID = order.ID // Set the OrderID for each OrderItem
 			err = createOrderItems(ctx, tx, oi)
 			if err != nil {
-				return fmt.Errorf("failed to create order item: %w", err)
+				return fmt.Errorf("failed to create order item: %w", dbError(err))
 			}
 		}
 		return nil
 		//insert into order_items
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create order: %w", err)
+		return nil, fmt.Errorf("failed to create order: %w", dbError(err))
 	}
 	return o, nil
 	//start a transaction
@@ -132,10 +196,18 @@ func createOrderItems(ctx context.Context, tx *sqlx.Tx, oi OrderItem) error {
 	return nil
 }
 
-func (s *MySQLStorer) execTx(ctx context.Context, fn func(*sqlx.Tx) error) error {
+func (s *MySQLStorer) execTx(ctx context.Context, fn func(*sqlx.Tx) error) (err error) {
+	ctx, span := tracer.Start(ctx, "MySQLStorer.execTx", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(dbSystem))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "transaction rolled back")
+		}
+		span.End()
+	}()
 	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", dbError(err))
 	}
 	defer tx.Rollback() // Rollback if fn returns an error
 
@@ -144,15 +216,17 @@ func (s *MySQLStorer) execTx(ctx context.Context, fn func(*sqlx.Tx) error) error
 	}
 
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return fmt.Errorf("failed to commit transaction: %w", dbError(err))
 	}
 	return nil
 }
 func (s *MySQLStorer) ListOrders(ctx context.Context) ([]Order, error) {
+	ctx, done := s.startCall(ctx, "ListOrders")
+	defer done()
 	var orders []Order
 	err := s.db.SelectContext(ctx, &orders, "SELECT * FROM orders")
 	if err != nil {
-		return nil, fmt.Errorf("failed to list orders: %w", err)
+		return nil, fmt.Errorf("failed to list orders: %w", dbError(err))
 	}
 
 	// Fetch order items for each order
@@ -160,7 +234,7 @@ func (s *MySQLStorer) ListOrders(ctx context.Context) ([]Order, error) {
 		var items []OrderItem
 		err = s.db.SelectContext(ctx, &items, "SELECT * FROM order_items WHERE order_id = ?", orders[i].ID)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get order items for order %d: %w", orders[i].ID, err)
+			return nil, fmt.Errorf("failed to get order items for order %d: %w", orders[i].ID, dbError(err))
 		}
 		orders[i].Items = items
 	}
@@ -171,126 +245,1238 @@ func (s *MySQLStorer) ListOrders(ctx context.Context) ([]Order, error) {
 
 // DeleteOrder
 func (s *MySQLStorer) GetOrder(ctx context.Context, userId int64) (*Order, error) {
+	ctx, done := s.startCall(ctx, "GetOrder")
+	defer done()
 	var o Order
 	err := s.db.GetContext(ctx, &o, "SELECT * FROM orders WHERE user_id = ?", userId)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get order: %w", err)
+		return nil, fmt.Errorf("failed to get order: %w", dbError(err))
 	}
 
 	// Fetch order items
 	var items []OrderItem
 	err = s.db.SelectContext(ctx, &o.Items, "SELECT * FROM order_items WHERE order_id = ?", o.ID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get order items: %w", err)
+		return nil, fmt.Errorf("failed to get order items: %w", dbError(err))
 	}
 	o.Items = items
 	return &o, nil
 }
 
 func (s *MySQLStorer) DeleteOrder(ctx context.Context, id int64) error {
+	ctx, done := s.startCall(ctx, "DeleteOrder")
+	defer done()
 	// Start a transaction
 	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", dbError(err))
 	}
 	defer tx.Rollback() // Rollback if any error occurs
 
 	// Delete order items
 	_, err = tx.ExecContext(ctx, "DELETE FROM order_items WHERE order_id = ?", id)
 	if err != nil {
-		return fmt.Errorf("failed to delete order items: %w", err)
+		return fmt.Errorf("failed to delete order items: %w", dbError(err))
 	}
 
 	// Delete the order
 	_, err = tx.ExecContext(ctx, "DELETE FROM orders WHERE id = ?", id)
 	if err != nil {
-		return fmt.Errorf("failed to delete order: %w", err)
+		return fmt.Errorf("failed to delete order: %w", dbError(err))
 	}
 
 	// Commit the transaction
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return fmt.Errorf("failed to commit transaction: %w", dbError(err))
 	}
 	return nil
 }
+
+// CreateUser inserts the user and grants it the customer role.
 func (s *MySQLStorer) CreateUser(ctx context.Context, u *User) (*User, error) {
+	ctx, done := s.startCall(ctx, "CreateUser")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		return createUser(ctx, tx, u)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", dbError(err))
+	}
+	return u, nil
+}
+
+// CreateFirstAdmin creates a user with the admin role. It fails with
+// ErrConflict once an admin exists.
+func (s *MySQLStorer) CreateFirstAdmin(ctx context.Context, u *User) (*User, error) {
+	ctx, done := s.startCall(ctx, "CreateFirstAdmin")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		admins, err := lockAdmins(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(admins) > 0 {
+			return fmt.Errorf("an admin already exists: %w", ErrConflict)
+		}
+		if err := createUser(ctx, tx, u); err != nil {
+			return err
+		}
+		if err := grantRole(ctx, tx, u.ID, rbac.RoleAdmin, nil); err != nil {
+			return err
+		}
+		u.IsAdmin = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create admin: %w", dbError(err))
+	}
+	return u, nil
+}
+
+// createUser inserts the user and grants it the customer role.
+func createUser(ctx context.Context, tx *sqlx.Tx, u *User) error {
 	query := `INSERT INTO users (name, email, password, is_admin) VALUES (:name, :email, :password, :is_admin)`
-	res, err := s.db.NamedExecContext(ctx, query, u)
+	res, err := tx.NamedExecContext(ctx, query, u)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create user: %w", err)
+		return fmt.Errorf("error inserting user: %w", err)
 	}
 	id, err := res.LastInsertId()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get last insert id: %w", err)
+		return fmt.Errorf("error getting last insert id: %w", err)
 	}
 	u.ID = id
-	return u, nil
+	return assignRole(ctx, tx, u.ID, rbac.RoleCustomer)
+}
+func (s *MySQLStorer) GetUserByID(ctx context.Context, id int64) (*User, error) {
+	ctx, done := s.startCall(ctx, "GetUserByID")
+	defer done()
+	var u User
+	err := s.db.GetContext(ctx, &u, "SELECT * FROM users WHERE id = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", dbError(err))
+	}
+	return &u, nil
 }
 func (s *MySQLStorer) GetUser(ctx context.Context, email string) (*User, error) {
+	ctx, done := s.startCall(ctx, "GetUser")
+	defer done()
 	var u User
 	err := s.db.GetContext(ctx, &u, "SELECT * FROM users WHERE email = ?", email)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user: %w", err)
+		return nil, fmt.Errorf("failed to get user: %w", dbError(err))
 	}
 	return &u, nil
 }
-func (s *MySQLStorer) UpdateUser(ctx context.Context, u *User) (*User, error) {
-	query := `
+
+// UpdateUser saves u and, in the same transaction, grants or revokes the
+// admin role to match u.IsAdmin, recording actorID in the audit log. Revoking
+// the last admin fails with ErrLastAdmin.
+func (s *MySQLStorer) UpdateUser(ctx context.Context, u *User, actorID *int64) (*User, error) {
+	ctx, done := s.startCall(ctx, "UpdateUser")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		var isAdmin bool
+		err := tx.GetContext(ctx, &isAdmin, "SELECT EXISTS (SELECT 1 FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = ? AND r.name = ?)", u.ID, rbac.RoleAdmin)
+		if err != nil {
+			return fmt.Errorf("error checking admin role: %w", err)
+		}
+		query := `
 		UPDATE users SET
 			name = :name,
 			email = :email,
 			password = :password,
-			is_admin = :is_admin,
-			updated_at = :updated_at
+			updated_at = :updated_at,
+			email_verified_at = :email_verified_at
 		WHERE id = :id
 	`
-	_, err := s.db.NamedExecContext(ctx, query, u)
+		if _, err := tx.NamedExecContext(ctx, query, u); err != nil {
+			return fmt.Errorf("error updating user: %w", err)
+		}
+		switch {
+		case u.IsAdmin && !isAdmin:
+			return grantRole(ctx, tx, u.ID, rbac.RoleAdmin, actorID)
+		case !u.IsAdmin && isAdmin:
+			return revokeRole(ctx, tx, u.ID, rbac.RoleAdmin, actorID)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to update user: %w", err)
+		return nil, fmt.Errorf("failed to update user: %w", dbError(err))
 	}
 	return u, nil
 }
+func (s *MySQLStorer) UpdateUserPassword(ctx context.Context, id int64, passwordHash string) error {
+	ctx, done := s.startCall(ctx, "UpdateUserPassword")
+	defer done()
+	_, err := s.db.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", passwordHash, id)
+	if err != nil {
+		return fmt.Errorf("failed to update user password: %w", dbError(err))
+	}
+	return nil
+}
+func (s *MySQLStorer) VerifyEmail(ctx context.Context, id int64) error {
+	ctx, done := s.startCall(ctx, "VerifyEmail")
+	defer done()
+	_, err := s.db.ExecContext(ctx, "UPDATE users SET email_verified_at = NOW() WHERE id = ? AND email_verified_at IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("failed to verify email: %w", dbError(err))
+	}
+	return nil
+}
+
+// MarkVerificationSent records that a verification email is being sent. It
+// returns false without changing anything when the previous one was sent less
+// than interval ago.
+func (s *MySQLStorer) MarkVerificationSent(ctx context.Context, id int64, interval time.Duration) (bool, error) {
+	ctx, done := s.startCall(ctx, "MarkVerificationSent")
+	defer done()
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users SET email_verification_sent_at = NOW()
+		WHERE id = ? AND (email_verification_sent_at IS NULL OR email_verification_sent_at < NOW() - INTERVAL ? SECOND)
+	`, id, int64(interval.Seconds()))
+	if err != nil {
+		return false, fmt.Errorf("failed to mark verification sent: %w", dbError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", dbError(err))
+	}
+	return n == 1, nil
+}
+
+// MarkPasswordResetSent records that a reset email is being sent to the user.
+// It returns false without changing anything if one was sent within interval.
+func (s *MySQLStorer) MarkPasswordResetSent(ctx context.Context, id int64, interval time.Duration) (bool, error) {
+	ctx, done := s.startCall(ctx, "MarkPasswordResetSent")
+	defer done()
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users SET password_reset_sent_at = NOW()
+		WHERE id = ? AND (password_reset_sent_at IS NULL OR password_reset_sent_at < NOW() - INTERVAL ? SECOND)
+	`, id, int64(interval.Seconds()))
+	if err != nil {
+		return false, fmt.Errorf("failed to mark password reset sent: %w", dbError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", dbError(err))
+	}
+	return n == 1, nil
+}
 func (s *MySQLStorer) DeleteUser(ctx context.Context, id int64) error {
-	_, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id)
+	ctx, done := s.startCall(ctx, "DeleteUser")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		if err := keepAdmin(ctx, tx, id); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to delete user: %w", err)
+		return fmt.Errorf("failed to delete user: %w", dbError(err))
 	}
 	return nil
 }
 func (s *MySQLStorer) ListUsers(ctx context.Context) ([]User, error) {
+	ctx, done := s.startCall(ctx, "ListUsers")
+	defer done()
 	var users []User
 	err := s.db.SelectContext(ctx, &users, "SELECT * FROM users")
 	if err != nil {
-		return nil, fmt.Errorf("failed to list users: %w", err)
+		return nil, fmt.Errorf("failed to list users: %w", dbError(err))
 	}
 	return users, nil
 }
 func (s *MySQLStorer) CreateSession(ctx context.Context, session *Session) (*Session, error) {
-	_, err := s.db.NamedExecContext(ctx, `INSERT INTO sessions (id, user_email, refresh_token, is_revoked, expires_at) VALUES (:id, :user_email, :refresh_token, :is_revoked, :expires_at)`, session)
+	ctx, done := s.startCall(ctx, "CreateSession")
+	defer done()
+	_, err := s.db.NamedExecContext(ctx, `INSERT INTO sessions (id, user_email, refresh_token, is_revoked, expires_at, user_agent, ip_address, last_used_at) VALUES (:id, :user_email, :refresh_token, :is_revoked, :expires_at, :user_agent, :ip_address, :last_used_at)`, session)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create session: %w", err)
+		return nil, fmt.Errorf("failed to create session: %w", dbError(err))
 	}
 	return session, nil
 }
 func (s *MySQLStorer) GetSession(ctx context.Context, id string) (*Session, error) {
+	ctx, done := s.startCall(ctx, "GetSession")
+	defer done()
 	var session Session
 	err := s.db.GetContext(ctx, &session, "SELECT * FROM sessions WHERE id = ?", id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get session: %w", err)
+		return nil, fmt.Errorf("failed to get session: %w", dbError(err))
 	}
 	return &session, nil
 }
 func (s *MySQLStorer) RevokeSession(ctx context.Context, id string) error {
+	ctx, done := s.startCall(ctx, "RevokeSession")
+	defer done()
 	_, err := s.db.ExecContext(ctx, "UPDATE sessions SET is_revoked = TRUE WHERE id = ?", id)
 	if err != nil {
-		return fmt.Errorf("failed to revoke session: %w", err)
+		return fmt.Errorf("failed to revoke session: %w", dbError(err))
 	}
 	return nil
 }
 func (s *MySQLStorer) DeleteSession(ctx context.Context, id string) error {
+	ctx, done := s.startCall(ctx, "DeleteSession")
+	defer done()
 	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", id)
 	if err != nil {
-		return fmt.Errorf("failed to delete session: %w", err)
+		return fmt.Errorf("failed to delete session: %w", dbError(err))
+	}
+	return nil
+}
+
+// ListSessions returns the sessions of a user that are neither revoked nor expired.
+func (s *MySQLStorer) ListSessions(ctx context.Context, email string) ([]Session, error) {
+	ctx, done := s.startCall(ctx, "ListSessions")
+	defer done()
+	var sessions []Session
+	err := s.db.SelectContext(ctx, &sessions, "SELECT * FROM sessions WHERE user_email = ? AND is_revoked = FALSE AND expires_at > NOW() ORDER BY created_at DESC", email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", dbError(err))
+	}
+	return sessions, nil
+}
+func (s *MySQLStorer) TouchSession(ctx context.Context, id string) error {
+	ctx, done := s.startCall(ctx, "TouchSession")
+	defer done()
+	_, err := s.db.ExecContext(ctx, "UPDATE sessions SET last_used_at = NOW() WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to touch session: %w", dbError(err))
+	}
+	return nil
+}
+
+// RevokeUserSessions revokes every session of a user except exceptID, which
+// may be empty to revoke all of them.
+func (s *MySQLStorer) RevokeUserSessions(ctx context.Context, email string, exceptID string) error {
+	ctx, done := s.startCall(ctx, "RevokeUserSessions")
+	defer done()
+	_, err := s.db.ExecContext(ctx, "UPDATE sessions SET is_revoked = TRUE WHERE user_email = ? AND id <> ?", email, exceptID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", dbError(err))
+	}
+	return nil
+}
+func (s *MySQLStorer) ListUserRoles(ctx context.Context, userID int64) ([]string, error) {
+	ctx, done := s.startCall(ctx, "ListUserRoles")
+	defer done()
+	roles := []string{}
+	err := s.db.SelectContext(ctx, &roles, "SELECT r.name FROM roles r JOIN user_roles ur ON ur.role_id = r.id WHERE ur.user_id = ? ORDER BY r.name", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list user roles: %w", dbError(err))
+	}
+	return roles, nil
+}
+func (s *MySQLStorer) ListUserPermissions(ctx context.Context, userID int64) ([]string, error) {
+	ctx, done := s.startCall(ctx, "ListUserPermissions")
+	defer done()
+	permissions := []string{}
+	err := s.db.SelectContext(ctx, &permissions, "SELECT DISTINCT rp.permission FROM role_permissions rp JOIN user_roles ur ON ur.role_id = rp.role_id WHERE ur.user_id = ? ORDER BY rp.permission", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list user permissions: %w", dbError(err))
+	}
+	return permissions, nil
+}
+
+// GrantRole assigns a role to a user and records who did it in the audit log.
+func (s *MySQLStorer) GrantRole(ctx context.Context, userID int64, role string, actorID *int64) error {
+	ctx, done := s.startCall(ctx, "GrantRole")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		return grantRole(ctx, tx, userID, role, actorID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to grant role: %w", dbError(err))
+	}
+	return nil
+}
+
+// RevokeRole removes a role from a user and records who did it in the audit
+// log. Revoking the last admin fails with ErrLastAdmin.
+func (s *MySQLStorer) RevokeRole(ctx context.Context, userID int64, role string, actorID *int64) error {
+	ctx, done := s.startCall(ctx, "RevokeRole")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		return revokeRole(ctx, tx, userID, role, actorID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke role: %w", dbError(err))
+	}
+	return nil
+}
+func grantRole(ctx context.Context, tx *sqlx.Tx, userID int64, role string, actorID *int64) error {
+	if err := assignRole(ctx, tx, userID, role); err != nil {
+		return err
+	}
+	if err := syncIsAdmin(ctx, tx, userID); err != nil {
+		return err
+	}
+	return createAuditLog(ctx, tx, &AuditLog{ActorID: actorID, Action: "role.grant", TargetUserID: &userID, Details: role})
+}
+func revokeRole(ctx context.Context, tx *sqlx.Tx, userID int64, role string, actorID *int64) error {
+	if role == rbac.RoleAdmin {
+		if err := keepAdmin(ctx, tx, userID); err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx, "DELETE ur FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = ? AND r.name = ?", userID, role)
+	if err != nil {
+		return fmt.Errorf("error removing role %q: %w", role, err)
+	}
+	if err := syncIsAdmin(ctx, tx, userID); err != nil {
+		return err
+	}
+	return createAuditLog(ctx, tx, &AuditLog{ActorID: actorID, Action: "role.revoke", TargetUserID: &userID, Details: role})
+}
+
+// lockAdmins returns the IDs of the admins and locks their role rows until the
+// transaction ends, so concurrent demotions and deletions are checked one
+// after the other.
+func lockAdmins(ctx context.Context, tx *sqlx.Tx) ([]int64, error) {
+	admins := []int64{}
+	err := tx.SelectContext(ctx, &admins, "SELECT ur.user_id FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE r.name = ? FOR UPDATE", rbac.RoleAdmin)
+	if err != nil {
+		return nil, fmt.Errorf("error locking admins: %w", err)
+	}
+	return admins, nil
+}
+
+// keepAdmin fails with ErrLastAdmin when userID is the only admin left.
+func keepAdmin(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	admins, err := lockAdmins(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if len(admins) == 1 && admins[0] == userID {
+		return ErrLastAdmin
+	}
+	return nil
+}
+func createAuditLog(ctx context.Context, tx *sqlx.Tx, l *AuditLog) error {
+	res, err := tx.NamedExecContext(ctx, `INSERT INTO audit_logs (actor_id, action, target_user_id, details) VALUES (:actor_id, :action, :target_user_id, :details)`, l)
+	if err != nil {
+		return fmt.Errorf("error inserting audit log: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error getting last insert id for audit log: %w", err)
+	}
+	l.ID = id
+	return nil
+}
+
+// syncIsAdmin keeps the legacy users.is_admin column in step with the admin role.
+func syncIsAdmin(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE users SET is_admin = EXISTS (
+			SELECT 1 FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = users.id AND r.name = ?
+		) WHERE id = ?`, rbac.RoleAdmin, userID)
+	if err != nil {
+		return fmt.Errorf("error syncing is_admin: %w", err)
+	}
+	return nil
+}
+func assignRole(ctx context.Context, tx *sqlx.Tx, userID int64, role string) error {
+	_, err := tx.ExecContext(ctx, "INSERT IGNORE INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE name = ?", userID, role)
+	if err != nil {
+		return fmt.Errorf("error assigning role %q: %w", role, err)
+	}
+	return nil
+}
+func (s *MySQLStorer) CreatePasswordReset(ctx context.Context, pr *PasswordReset) (*PasswordReset, error) {
+	ctx, done := s.startCall(ctx, "CreatePasswordReset")
+	defer done()
+	res, err := s.db.NamedExecContext(ctx, `INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (:user_id, :token_hash, :expires_at)`, pr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create password reset: %w", dbError(err))
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert id: %w", dbError(err))
+	}
+	pr.ID = id
+	return pr, nil
+}
+
+// GetPasswordReset returns the unused, unexpired reset with the given token hash.
+func (s *MySQLStorer) GetPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	ctx, done := s.startCall(ctx, "GetPasswordReset")
+	defer done()
+	var pr PasswordReset
+	err := s.db.GetContext(ctx, &pr, "SELECT * FROM password_resets WHERE token_hash = ? AND used_at IS NULL AND expires_at > NOW()", tokenHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, fmt.Errorf("failed to get password reset: %w", dbError(err))
+	}
+	return &pr, nil
+}
+
+// ResetPassword consumes the reset, stores the new password hash and revokes
+// every session of the user. All outstanding resets of the user are consumed
+// too, so an older link can't be used afterwards.
+func (s *MySQLStorer) ResetPassword(ctx context.Context, pr *PasswordReset, passwordHash string) error {
+	ctx, done := s.startCall(ctx, "ResetPassword")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, "UPDATE password_resets SET used_at = NOW() WHERE id = ? AND used_at IS NULL AND expires_at > NOW()", pr.ID)
+		if err != nil {
+			return fmt.Errorf("error consuming password reset: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("error getting rows affected: %w", err)
+		}
+		if n == 0 {
+			return ErrInvalidToken
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE password_resets SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL", pr.UserID)
+		if err != nil {
+			return fmt.Errorf("error consuming password resets: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE users SET password = ?, updated_at = NOW() WHERE id = ?", passwordHash, pr.UserID)
+		if err != nil {
+			return fmt.Errorf("error updating password: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE sessions SET is_revoked = TRUE WHERE user_email = (SELECT email FROM users WHERE id = ?)", pr.UserID)
+		if err != nil {
+			return fmt.Errorf("error revoking sessions: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reset password: %w", dbError(err))
+	}
+	return nil
+}
+
+// SaveTOTPSecret starts a TOTP enrollment, replacing any pending one.
+func (s *MySQLStorer) SaveTOTPSecret(ctx context.Context, userID int64, secret string) error {
+	ctx, done := s.startCall(ctx, "SaveTOTPSecret")
+	defer done()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO user_totp (user_id, secret) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), enabled_at = NULL, last_used_step = 0
+	`, userID, secret)
+	if err != nil {
+		return fmt.Errorf("failed to save totp secret: %w", dbError(err))
+	}
+	return nil
+}
+func (s *MySQLStorer) GetUserTOTP(ctx context.Context, userID int64) (*UserTOTP, error) {
+	ctx, done := s.startCall(ctx, "GetUserTOTP")
+	defer done()
+	var t UserTOTP
+	err := s.db.GetContext(ctx, &t, "SELECT * FROM user_totp WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user totp: %w", dbError(err))
+	}
+	return &t, nil
+}
+
+// ListUserTOTP returns every TOTP enrollment.
+func (s *MySQLStorer) ListUserTOTP(ctx context.Context) ([]UserTOTP, error) {
+	ctx, done := s.startCall(ctx, "ListUserTOTP")
+	defer done()
+	var ts []UserTOTP
+	err := s.db.SelectContext(ctx, &ts, "SELECT * FROM user_totp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list user totp: %w", dbError(err))
+	}
+	return ts, nil
+}
+
+// ReplaceTOTPSecret swaps the stored secret of an enrollment for an
+// equivalent encoding of it, keeping its state. It returns false if the
+// secret is no longer old, e.g. because the user enrolled again.
+func (s *MySQLStorer) ReplaceTOTPSecret(ctx context.Context, userID int64, old, secret string) (bool, error) {
+	ctx, done := s.startCall(ctx, "ReplaceTOTPSecret")
+	defer done()
+	res, err := s.db.ExecContext(ctx, "UPDATE user_totp SET secret = ? WHERE user_id = ? AND secret = ?", secret, userID, old)
+	if err != nil {
+		return false, fmt.Errorf("failed to replace totp secret: %w", dbError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", dbError(err))
+	}
+	return n == 1, nil
+}
+
+// EnableTOTP completes a pending enrollment and stores a fresh set of
+// recovery code hashes.
+func (s *MySQLStorer) EnableTOTP(ctx context.Context, userID int64, step int64, codeHashes []string) error {
+	ctx, done := s.startCall(ctx, "EnableTOTP")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, "UPDATE user_totp SET enabled_at = NOW(), last_used_step = ? WHERE user_id = ? AND enabled_at IS NULL", step, userID)
+		if err != nil {
+			return fmt.Errorf("error enabling totp: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("error getting rows affected: %w", err)
+		}
+		if n == 0 {
+			return fmt.Errorf("no pending totp enrollment")
+		}
+		return replaceRecoveryCodes(ctx, tx, userID, codeHashes)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable totp: %w", dbError(err))
+	}
+	return nil
+}
+
+// UseTOTPStep records step as used. It returns false if a code of this or a
+// later step was already accepted.
+func (s *MySQLStorer) UseTOTPStep(ctx context.Context, userID int64, step int64) (bool, error) {
+	ctx, done := s.startCall(ctx, "UseTOTPStep")
+	defer done()
+	res, err := s.db.ExecContext(ctx, "UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND last_used_step < ? AND enabled_at IS NOT NULL", step, userID, step)
+	if err != nil {
+		return false, fmt.Errorf("failed to use totp step: %w", dbError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", dbError(err))
+	}
+	return n == 1, nil
+}
+func (s *MySQLStorer) DisableTOTP(ctx context.Context, userID int64) error {
+	ctx, done := s.startCall(ctx, "DisableTOTP")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+			return fmt.Errorf("error deleting recovery codes: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+			return fmt.Errorf("error deleting totp: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to disable totp: %w", dbError(err))
+	}
+	return nil
+}
+
+// UseRecoveryCode marks an unused recovery code as used. It returns false if
+// the code is unknown or was already used.
+func (s *MySQLStorer) UseRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error) {
+	ctx, done := s.startCall(ctx, "UseRecoveryCode")
+	defer done()
+	res, err := s.db.ExecContext(ctx, "UPDATE mfa_recovery_codes SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", dbError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", dbError(err))
+	}
+	return n == 1, nil
+}
+func (s *MySQLStorer) ReplaceRecoveryCodes(ctx context.Context, userID int64, codeHashes []string) error {
+	ctx, done := s.startCall(ctx, "ReplaceRecoveryCodes")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		return replaceRecoveryCodes(ctx, tx, userID, codeHashes)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replace recovery codes: %w", dbError(err))
+	}
+	return nil
+}
+func replaceRecoveryCodes(ctx context.Context, tx *sqlx.Tx, userID int64, codeHashes []string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("error deleting recovery codes: %w", err)
+	}
+	for _, h := range codeHashes {
+		_, err := tx.ExecContext(ctx, "INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, h)
+		if err != nil {
+			return fmt.Errorf("error inserting recovery code: %w", err)
+		}
+	}
+	return nil
+}
+func (s *MySQLStorer) GetLoginThrottle(ctx context.Context, kind, key string) (*LoginThrottle, error) {
+	ctx, done := s.startCall(ctx, "GetLoginThrottle")
+	defer done()
+	var t LoginThrottle
+	err := s.db.GetContext(ctx, &t, "SELECT * FROM login_throttles WHERE kind = ? AND throttle_key = ?", kind, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login throttle: %w", dbError(err))
+	}
+	return &t, nil
+}
+
+// RecordLoginFailure counts a failed login. The count starts over when the
+// previous failure is older than window.
+func (s *MySQLStorer) RecordLoginFailure(ctx context.Context, kind, key string, window time.Duration) (*LoginThrottle, error) {
+	ctx, done := s.startCall(ctx, "RecordLoginFailure")
+	defer done()
+	var t LoginThrottle
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO login_throttles (kind, throttle_key, failures, last_failure_at) VALUES (?, ?, 1, NOW())
+			ON DUPLICATE KEY UPDATE
+				failures = IF(last_failure_at < NOW() - INTERVAL ? SECOND, 1, failures + 1),
+				last_failure_at = NOW()
+		`, kind, key, int64(window.Seconds()))
+		if err != nil {
+			return fmt.Errorf("error recording login failure: %w", err)
+		}
+		err = tx.GetContext(ctx, &t, "SELECT * FROM login_throttles WHERE kind = ? AND throttle_key = ?", kind, key)
+		if err != nil {
+			return fmt.Errorf("error getting login throttle: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record login failure: %w", dbError(err))
+	}
+	return &t, nil
+}
+func (s *MySQLStorer) LockLogin(ctx context.Context, kind, key string, until time.Time) error {
+	ctx, done := s.startCall(ctx, "LockLogin")
+	defer done()
+	_, err := s.db.ExecContext(ctx, "UPDATE login_throttles SET locked_until = ? WHERE kind = ? AND throttle_key = ?", until, kind, key)
+	if err != nil {
+		return fmt.Errorf("failed to lock login: %w", dbError(err))
+	}
+	return nil
+}
+func (s *MySQLStorer) ClearLoginThrottle(ctx context.Context, kind, key string) error {
+	ctx, done := s.startCall(ctx, "ClearLoginThrottle")
+	defer done()
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_throttles WHERE kind = ? AND throttle_key = ?", kind, key)
+	if err != nil {
+		return fmt.Errorf("failed to clear login throttle: %w", dbError(err))
+	}
+	return nil
+}
+
+// UnlockAccount clears the failed logins of a user and records who did it in
+// the audit log.
+func (s *MySQLStorer) UnlockAccount(ctx context.Context, u *User, actorID *int64) error {
+	ctx, done := s.startCall(ctx, "UnlockAccount")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM login_throttles WHERE kind = ? AND throttle_key = ?", ThrottleAccount, strings.ToLower(u.Email))
+		if err != nil {
+			return fmt.Errorf("error clearing login throttle: %w", err)
+		}
+		return createAuditLog(ctx, tx, &AuditLog{ActorID: actorID, Action: "account.unlock", TargetUserID: &u.ID})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unlock account: %w", dbError(err))
+	}
+	return nil
+}
+func (s *MySQLStorer) CreateAPIKey(ctx context.Context, k *APIKey) (*APIKey, error) {
+	ctx, done := s.startCall(ctx, "CreateAPIKey")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		res, err := tx.NamedExecContext(ctx, `INSERT INTO api_keys (prefix, key_hash, name, owner_id, scopes, expires_at, created_by) VALUES (:prefix, :key_hash, :name, :owner_id, :scopes, :expires_at, :created_by)`, k)
+		if err != nil {
+			return fmt.Errorf("error inserting api key: %w", err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("error getting last insert id: %w", err)
+		}
+		k.ID = id
+		return createAuditLog(ctx, tx, &AuditLog{ActorID: k.CreatedBy, Action: "api_key.create", TargetUserID: &k.OwnerID, Details: k.Prefix})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create api key: %w", dbError(err))
+	}
+	return k, nil
+}
+func (s *MySQLStorer) GetAPIKey(ctx context.Context, id int64) (*APIKey, error) {
+	ctx, done := s.startCall(ctx, "GetAPIKey")
+	defer done()
+	var k APIKey
+	err := s.db.GetContext(ctx, &k, "SELECT * FROM api_keys WHERE id = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api key: %w", dbError(err))
+	}
+	return &k, nil
+}
+func (s *MySQLStorer) GetAPIKeyByPrefix(ctx context.Context, prefix string) (*APIKey, error) {
+	ctx, done := s.startCall(ctx, "GetAPIKeyByPrefix")
+	defer done()
+	var k APIKey
+	err := s.db.GetContext(ctx, &k, "SELECT * FROM api_keys WHERE prefix = ?", prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api key: %w", dbError(err))
+	}
+	return &k, nil
+}
+func (s *MySQLStorer) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	ctx, done := s.startCall(ctx, "ListAPIKeys")
+	defer done()
+	var keys []APIKey
+	err := s.db.SelectContext(ctx, &keys, "SELECT * FROM api_keys ORDER BY created_at DESC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", dbError(err))
+	}
+	return keys, nil
+}
+func (s *MySQLStorer) RevokeAPIKey(ctx context.Context, k *APIKey, actorID *int64) error {
+	ctx, done := s.startCall(ctx, "RevokeAPIKey")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE api_keys SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", k.ID)
+		if err != nil {
+			return fmt.Errorf("error revoking api key: %w", err)
+		}
+		return createAuditLog(ctx, tx, &AuditLog{ActorID: actorID, Action: "api_key.revoke", TargetUserID: &k.OwnerID, Details: k.Prefix})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", dbError(err))
+	}
+	return nil
+}
+func (s *MySQLStorer) TouchAPIKey(ctx context.Context, id int64) error {
+	ctx, done := s.startCall(ctx, "TouchAPIKey")
+	defer done()
+	_, err := s.db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = NOW() WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to touch api key: %w", dbError(err))
+	}
+	return nil
+}
+
+// CreateUserWithIdentity creates a user who signed up through an external
+// provider, together with the link to that provider.
+func (s *MySQLStorer) CreateUserWithIdentity(ctx context.Context, u *User, ui *UserIdentity) (*User, error) {
+	ctx, done := s.startCall(ctx, "CreateUserWithIdentity")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		query := `INSERT INTO users (name, email, password, is_admin, email_verified_at) VALUES (:name, :email, :password, :is_admin, :email_verified_at)`
+		res, err := tx.NamedExecContext(ctx, query, u)
+		if err != nil {
+			return fmt.Errorf("error inserting user: %w", err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("error getting last insert id: %w", err)
+		}
+		u.ID = id
+		if err := assignRole(ctx, tx, u.ID, rbac.RoleCustomer); err != nil {
+			return err
+		}
+		ui.UserID = u.ID
+		return createUserIdentity(ctx, tx, ui)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", dbError(err))
+	}
+	return u, nil
+}
+func (s *MySQLStorer) CreateUserIdentity(ctx context.Context, ui *UserIdentity) error {
+	ctx, done := s.startCall(ctx, "CreateUserIdentity")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		if err := createUserIdentity(ctx, tx, ui); err != nil {
+			return err
+		}
+		return createAuditLog(ctx, tx, &AuditLog{ActorID: &ui.UserID, Action: "identity.link", TargetUserID: &ui.UserID, Details: ui.Provider})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create user identity: %w", dbError(err))
+	}
+	return nil
+}
+func createUserIdentity(ctx context.Context, tx *sqlx.Tx, ui *UserIdentity) error {
+	res, err := tx.NamedExecContext(ctx, `INSERT INTO user_identities (user_id, provider, subject, email) VALUES (:user_id, :provider, :subject, :email)`, ui)
+	if err != nil {
+		return fmt.Errorf("error inserting user identity: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error getting last insert id: %w", err)
+	}
+	ui.ID = id
+	return nil
+}
+func (s *MySQLStorer) GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	ctx, done := s.startCall(ctx, "GetUserByIdentity")
+	defer done()
+	var u User
+	err := s.db.GetContext(ctx, &u, `
+		SELECT u.* FROM users u
+		JOIN user_identities ui ON ui.user_id = u.id
+		WHERE ui.provider = ? AND ui.subject = ?
+	`, provider, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by identity: %w", dbError(err))
+	}
+	return &u, nil
+}
+func (s *MySQLStorer) ListUserIdentities(ctx context.Context, userID int64) ([]UserIdentity, error) {
+	ctx, done := s.startCall(ctx, "ListUserIdentities")
+	defer done()
+	var identities []UserIdentity
+	err := s.db.SelectContext(ctx, &identities, "SELECT * FROM user_identities WHERE user_id = ? ORDER BY created_at", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list user identities: %w", dbError(err))
+	}
+	return identities, nil
+}
+
+// DeleteUserIdentity unlinks the user's identity at a provider. It returns
+// sql.ErrNoRows if there is none.
+func (s *MySQLStorer) DeleteUserIdentity(ctx context.Context, userID int64, provider string) error {
+	ctx, done := s.startCall(ctx, "DeleteUserIdentity")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, "DELETE FROM user_identities WHERE user_id = ? AND provider = ?", userID, provider)
+		if err != nil {
+			return fmt.Errorf("error deleting user identity: %w", err)
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("error getting rows affected: %w", err)
+		}
+		if rows == 0 {
+			return sql.ErrNoRows
+		}
+		return createAuditLog(ctx, tx, &AuditLog{ActorID: &userID, Action: "identity.unlink", TargetUserID: &userID, Details: provider})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete user identity: %w", dbError(err))
+	}
+	return nil
+}
+func (s *MySQLStorer) CreateOAuthClient(ctx context.Context, c *OAuthClient) (*OAuthClient, error) {
+	ctx, done := s.startCall(ctx, "CreateOAuthClient")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExecContext(ctx, `INSERT INTO oauth_clients (id, secret_hash, name, redirect_uris, scopes, owner_id, created_by) VALUES (:id, :secret_hash, :name, :redirect_uris, :scopes, :owner_id, :created_by)`, c)
+		if err != nil {
+			return fmt.Errorf("error inserting oauth client: %w", err)
+		}
+		return createAuditLog(ctx, tx, &AuditLog{ActorID: c.CreatedBy, Action: "oauth_client.create", TargetUserID: &c.OwnerID, Details: c.ID})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create oauth client: %w", dbError(err))
+	}
+	return c, nil
+}
+func (s *MySQLStorer) GetOAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	ctx, done := s.startCall(ctx, "GetOAuthClient")
+	defer done()
+	var c OAuthClient
+	err := s.db.GetContext(ctx, &c, "SELECT * FROM oauth_clients WHERE id = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oauth client: %w", dbError(err))
+	}
+	return &c, nil
+}
+func (s *MySQLStorer) ListOAuthClients(ctx context.Context) ([]OAuthClient, error) {
+	ctx, done := s.startCall(ctx, "ListOAuthClients")
+	defer done()
+	var clients []OAuthClient
+	err := s.db.SelectContext(ctx, &clients, "SELECT * FROM oauth_clients ORDER BY created_at DESC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list oauth clients: %w", dbError(err))
+	}
+	return clients, nil
+}
+
+// RevokeOAuthClient disables a client together with every grant it holds.
+func (s *MySQLStorer) RevokeOAuthClient(ctx context.Context, c *OAuthClient, actorID *int64) error {
+	ctx, done := s.startCall(ctx, "RevokeOAuthClient")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE oauth_clients SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", c.ID)
+		if err != nil {
+			return fmt.Errorf("error revoking oauth client: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE oauth_grants SET revoked_at = NOW() WHERE client_id = ? AND revoked_at IS NULL", c.ID)
+		if err != nil {
+			return fmt.Errorf("error revoking oauth grants: %w", err)
+		}
+		return createAuditLog(ctx, tx, &AuditLog{ActorID: actorID, Action: "oauth_client.revoke", TargetUserID: &c.OwnerID, Details: c.ID})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke oauth client: %w", dbError(err))
+	}
+	return nil
+}
+func (s *MySQLStorer) CreateOAuthAuthorizationCode(ctx context.Context, code *OAuthAuthorizationCode) error {
+	ctx, done := s.startCall(ctx, "CreateOAuthAuthorizationCode")
+	defer done()
+	res, err := s.db.NamedExecContext(ctx, `INSERT INTO oauth_authorization_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at) VALUES (:code_hash, :client_id, :user_id, :redirect_uri, :scopes, :code_challenge, :expires_at)`, code)
+	if err != nil {
+		return fmt.Errorf("failed to create oauth authorization code: %w", dbError(err))
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get last insert id: %w", dbError(err))
+	}
+	code.ID = id
+	return nil
+}
+
+// GetOAuthAuthorizationCode returns the unused, unexpired code with the given
+// hash, or ErrInvalidToken.
+func (s *MySQLStorer) GetOAuthAuthorizationCode(ctx context.Context, codeHash string) (*OAuthAuthorizationCode, error) {
+	ctx, done := s.startCall(ctx, "GetOAuthAuthorizationCode")
+	defer done()
+	var code OAuthAuthorizationCode
+	err := s.db.GetContext(ctx, &code, "SELECT * FROM oauth_authorization_codes WHERE code_hash = ? AND used_at IS NULL AND expires_at > NOW()", codeHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get oauth authorization code: %w", ErrInvalidToken)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oauth authorization code: %w", dbError(err))
+	}
+	return &code, nil
+}
+
+// UseOAuthAuthorizationCode marks the code used, only if it was issued to
+// clientID. It returns ErrInvalidToken if the code was used concurrently,
+// expired or belongs to another client.
+func (s *MySQLStorer) UseOAuthAuthorizationCode(ctx context.Context, id int64, clientID string) error {
+	ctx, done := s.startCall(ctx, "UseOAuthAuthorizationCode")
+	defer done()
+	res, err := s.db.ExecContext(ctx, "UPDATE oauth_authorization_codes SET used_at = NOW() WHERE id = ? AND client_id = ? AND used_at IS NULL AND expires_at > NOW()", id, clientID)
+	if err != nil {
+		return fmt.Errorf("failed to use oauth authorization code: %w", dbError(err))
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", dbError(err))
+	}
+	if rows == 0 {
+		return fmt.Errorf("failed to use oauth authorization code: %w", ErrInvalidToken)
+	}
+	return nil
+}
+
+// CreateOAuthGrant stores a grant and, unless rt is nil, its first refresh token.
+func (s *MySQLStorer) CreateOAuthGrant(ctx context.Context, g *OAuthGrant, rt *OAuthRefreshToken) error {
+	ctx, done := s.startCall(ctx, "CreateOAuthGrant")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExecContext(ctx, `INSERT INTO oauth_grants (id, client_id, user_id, scopes) VALUES (:id, :client_id, :user_id, :scopes)`, g)
+		if err != nil {
+			return fmt.Errorf("error inserting oauth grant: %w", err)
+		}
+		if rt == nil {
+			return nil
+		}
+		rt.GrantID = g.ID
+		return createOAuthRefreshToken(ctx, tx, rt)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create oauth grant: %w", dbError(err))
+	}
+	return nil
+}
+
+// ClientCredentialsGrant returns the active client credentials grant of
+// g.ClientID, storing g as that grant if there is none, so repeated token
+// requests don't add a row each.
+func (s *MySQLStorer) ClientCredentialsGrant(ctx context.Context, g *OAuthGrant) (*OAuthGrant, error) {
+	ctx, done := s.startCall(ctx, "ClientCredentialsGrant")
+	defer done()
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		var active OAuthGrant
+		err := tx.GetContext(ctx, &active, "SELECT * FROM oauth_grants WHERE client_id = ? AND client_credentials = TRUE AND revoked_at IS NULL LIMIT 1 FOR UPDATE", g.ClientID)
+		if err == nil {
+			*g = active
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("error getting oauth grant: %w", err)
+		}
+		g.ClientCredentials = true
+		_, err = tx.NamedExecContext(ctx, `INSERT INTO oauth_grants (id, client_id, user_id, scopes, client_credentials) VALUES (:id, :client_id, :user_id, :scopes, :client_credentials)`, g)
+		if err != nil {
+			return fmt.Errorf("error inserting oauth grant: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client credentials grant: %w", dbError(err))
+	}
+	return g, nil
+}
+func createOAuthRefreshToken(ctx context.Context, tx *sqlx.Tx, rt *OAuthRefreshToken) error {
+	res, err := tx.NamedExecContext(ctx, `INSERT INTO oauth_refresh_tokens (token_hash, grant_id, expires_at) VALUES (:token_hash, :grant_id, :expires_at)`, rt)
+	if err != nil {
+		return fmt.Errorf("error inserting oauth refresh token: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error getting last insert id: %w", err)
+	}
+	rt.ID = id
+	return nil
+}
+func (s *MySQLStorer) GetOAuthGrant(ctx context.Context, id string) (*OAuthGrant, error) {
+	ctx, done := s.startCall(ctx, "GetOAuthGrant")
+	defer done()
+	var g OAuthGrant
+	err := s.db.GetContext(ctx, &g, "SELECT * FROM oauth_grants WHERE id = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oauth grant: %w", dbError(err))
+	}
+	return &g, nil
+}
+func (s *MySQLStorer) GetOAuthRefreshToken(ctx context.Context, tokenHash string) (*OAuthRefreshToken, error) {
+	ctx, done := s.startCall(ctx, "GetOAuthRefreshToken")
+	defer done()
+	var rt OAuthRefreshToken
+	err := s.db.GetContext(ctx, &rt, "SELECT * FROM oauth_refresh_tokens WHERE token_hash = ?", tokenHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oauth refresh token: %w", dbError(err))
+	}
+	return &rt, nil
+}
+
+// RotateOAuthRefreshToken exchanges the refresh token with oldHash for next,
+// which joins the same grant. A token that was already exchanged has leaked,
+// so presenting it revokes the whole grant. It returns ErrInvalidToken if the
+// token can't be used.
+func (s *MySQLStorer) RotateOAuthRefreshToken(ctx context.Context, oldHash string, next *OAuthRefreshToken) (*OAuthGrant, error) {
+	ctx, done := s.startCall(ctx, "RotateOAuthRefreshToken")
+	defer done()
+	var (
+		g      OAuthGrant
+		reused bool
+	)
+	err := s.execTx(ctx, func(tx *sqlx.Tx) error {
+		var rt OAuthRefreshToken
+		err := tx.GetContext(ctx, &rt, "SELECT * FROM oauth_refresh_tokens WHERE token_hash = ? FOR UPDATE", oldHash)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return fmt.Errorf("error getting oauth refresh token: %w", err)
+		}
+		if rt.UsedAt != nil {
+			reused = true
+			_, err := tx.ExecContext(ctx, "UPDATE oauth_grants SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", rt.GrantID)
+			if err != nil {
+				return fmt.Errorf("error revoking oauth grant: %w", err)
+			}
+			return nil
+		}
+		err = tx.GetContext(ctx, &g, "SELECT * FROM oauth_grants WHERE id = ?", rt.GrantID)
+		if err != nil {
+			return fmt.Errorf("error getting oauth grant: %w", err)
+		}
+		if g.RevokedAt != nil || rt.ExpiresAt.Before(time.Now()) {
+			return ErrInvalidToken
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE oauth_refresh_tokens SET used_at = NOW() WHERE id = ?", rt.ID)
+		if err != nil {
+			return fmt.Errorf("error using oauth refresh token: %w", err)
+		}
+		next.GrantID = rt.GrantID
+		return createOAuthRefreshToken(ctx, tx, next)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate oauth refresh token: %w", dbError(err))
+	}
+	if reused {
+		return nil, fmt.Errorf("failed to rotate oauth refresh token: %w", ErrInvalidToken)
+	}
+	return &g, nil
+}
+func (s *MySQLStorer) RevokeOAuthGrant(ctx context.Context, id string) error {
+	ctx, done := s.startCall(ctx, "RevokeOAuthGrant")
+	defer done()
+	_, err := s.db.ExecContext(ctx, "UPDATE oauth_grants SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke oauth grant: %w", dbError(err))
+	}
+	return nil
+}
+
+// ClaimIdempotencyKey stores k as in progress and reports true. When the key
+// is already used in its scope the existing record is returned instead,
+// unless it expired or its request was abandoned before completing, which k
+// then replaces.
+func (s *MySQLStorer) ClaimIdempotencyKey(ctx context.Context, k *IdempotencyKey, now time.Time) (*IdempotencyKey, bool, error) {
+	ctx, done := s.startCall(ctx, "ClaimIdempotencyKey")
+	defer done()
+	_, err := s.db.NamedExecContext(ctx, `INSERT INTO idempotency_keys (scope, idempotency_key, request_hash, locked_until, expires_at) VALUES (:scope, :idempotency_key, :request_hash, :locked_until, :expires_at)`, k)
+	if err == nil {
+		return k, true, nil
+	}
+	if err = dbError(err); !errors.Is(err, ErrConflict) {
+		return nil, false, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+
+	var existing IdempotencyKey
+	claimed := false
+	err = s.execTx(ctx, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &existing, "SELECT * FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? FOR UPDATE", k.Scope, k.Key)
+		if err != nil {
+			return fmt.Errorf("error getting idempotency key: %w", err)
+		}
+		if existing.ExpiresAt.After(now) && (existing.ResponseStatus != nil || existing.LockedUntil.After(now)) {
+			return nil
+		}
+		_, err = tx.NamedExecContext(ctx, `UPDATE idempotency_keys SET request_hash = :request_hash, response_status = NULL, response_headers = NULL, response_body = NULL, locked_until = :locked_until, expires_at = :expires_at WHERE scope = :scope AND idempotency_key = :idempotency_key`, k)
+		if err != nil {
+			return fmt.Errorf("error taking over idempotency key: %w", err)
+		}
+		claimed = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to claim idempotency key: %w", dbError(err))
+	}
+	if claimed {
+		return k, true, nil
+	}
+	return &existing, false, nil
+}
+
+// DeleteExpiredIdempotencyKeys deletes up to limit keys that expired before
+// now and reports how many it deleted. Callers repeat it while it deletes
+// limit keys, so no single statement holds locks for long.
+func (s *MySQLStorer) DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time, limit int) (int64, error) {
+	ctx, done := s.startCall(ctx, "DeleteExpiredIdempotencyKeys")
+	defer done()
+	res, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < ? LIMIT ?", now, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired idempotency keys: %w", dbError(err))
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return n, nil
+}
+
+// SaveIdempotentResponse stores the response of a claimed key, completing it.
+func (s *MySQLStorer) SaveIdempotentResponse(ctx context.Context, k *IdempotencyKey) error {
+	ctx, done := s.startCall(ctx, "SaveIdempotentResponse")
+	defer done()
+	_, err := s.db.NamedExecContext(ctx, `UPDATE idempotency_keys SET response_status = :response_status, response_headers = :response_headers, response_body = :response_body WHERE scope = :scope AND idempotency_key = :idempotency_key`, k)
+	if err != nil {
+		return fmt.Errorf("failed to save idempotent response: %w", dbError(err))
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey deletes a key that is still in progress, so a retry
+// runs the request again.
+func (s *MySQLStorer) ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	ctx, done := s.startCall(ctx, "ReleaseIdempotencyKey")
+	defer done()
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? AND response_status IS NULL", scope, key)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", dbError(err))
 	}
 	return nil
 }
@@ -2,12 +2,19 @@ package storer
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func withTestDB(t *testing.T, fn func(db *sqlx.DB, mock sqlmock.Sqlmock)) {
@@ -111,6 +118,19 @@ func TestGetProduct(t *testing.T) {
 
 }
 
+func TestGetProductNotFound(t *testing.T) {
+	withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+		st := NewMySQLStorer(db)
+
+		mock.ExpectQuery("SELECT * FROM products WHERE id = ?").
+			WithArgs(1).WillReturnError(sql.ErrNoRows)
+		_, err := st.GetProduct(context.Background(), 1)
+		require.ErrorIs(t, err, ErrNotFound)
+		err = mock.ExpectationsWereMet()
+		require.NoError(t, err)
+	})
+}
+
 func TestListProducts(t *testing.T) {
 	p := &Product{
 		Name:         "test product",
@@ -271,3 +291,768 @@ func TestDeleteProduct(t *testing.T) {
 		})
 	}
 }
+
+func TestListSessions(t *testing.T) {
+	tcs := []struct {
+		name string
+		test func(*testing.T, *MySQLStorer, sqlmock.Sqlmock)
+	}{
+		{
+			name: "success",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				rows := sqlmock.NewRows([]string{"id", "user_email", "refresh_token", "is_revoked", "created_at", "expires_at", "user_agent", "ip_address", "last_used_at"}).
+					AddRow("session-1", "test@example.com", "hash", false, time.Now(), time.Now().Add(time.Hour), "curl/8.0", "127.0.0.1", nil)
+				mock.ExpectQuery("SELECT * FROM sessions WHERE user_email = ? AND is_revoked = FALSE AND expires_at > NOW() ORDER BY created_at DESC").
+					WithArgs("test@example.com").WillReturnRows(rows)
+
+				sessions, err := st.ListSessions(context.Background(), "test@example.com")
+				require.NoError(t, err)
+				require.Len(t, sessions, 1)
+				require.Equal(t, "curl/8.0", sessions[0].UserAgent)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "failed listing sessions",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT * FROM sessions WHERE user_email = ? AND is_revoked = FALSE AND expires_at > NOW() ORDER BY created_at DESC").
+					WithArgs("test@example.com").WillReturnError(fmt.Errorf("error listing sessions"))
+
+				_, err := st.ListSessions(context.Background(), "test@example.com")
+				require.Error(t, err)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+			st := NewMySQLStorer(db)
+			tc.test(t, st, mock)
+		})
+	}
+}
+
+func TestRevokeUserSessions(t *testing.T) {
+	withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+		st := NewMySQLStorer(db)
+
+		mock.ExpectExec("UPDATE sessions SET is_revoked = TRUE WHERE user_email = ? AND id <> ?").
+			WithArgs("test@example.com", "session-1").WillReturnResult(sqlmock.NewResult(0, 2))
+		err := st.RevokeUserSessions(context.Background(), "test@example.com", "session-1")
+		require.NoError(t, err)
+
+		err = mock.ExpectationsWereMet()
+		require.NoError(t, err)
+	})
+}
+
+func TestCreateUser(t *testing.T) {
+	u := &User{
+		Name:     "test user",
+		Email:    "test@example.com",
+		Password: "hashed",
+	}
+	tcs := []struct {
+		name string
+		test func(*testing.T, *MySQLStorer, sqlmock.Sqlmock)
+	}{
+		{
+			name: "success",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO users (name, email, password, is_admin) VALUES (?, ?, ?, ?)").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT IGNORE INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE name = ?").
+					WithArgs(1, "customer").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+
+				cu, err := st.CreateUser(context.Background(), u)
+				require.NoError(t, err)
+				require.Equal(t, int64(1), cu.ID)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "failed assigning role",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO users (name, email, password, is_admin) VALUES (?, ?, ?, ?)").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT IGNORE INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE name = ?").
+					WithArgs(1, "customer").WillReturnError(fmt.Errorf("error assigning role"))
+				mock.ExpectRollback()
+
+				_, err := st.CreateUser(context.Background(), u)
+				require.Error(t, err)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "duplicate email",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO users (name, email, password, is_admin) VALUES (?, ?, ?, ?)").
+					WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'test@example.com' for key 'users.email'"})
+				mock.ExpectRollback()
+
+				_, err := st.CreateUser(context.Background(), u)
+				require.ErrorIs(t, err, ErrConflict)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+			st := NewMySQLStorer(db)
+			tc.test(t, st, mock)
+		})
+	}
+}
+
+func TestListUserPermissions(t *testing.T) {
+	withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+		st := NewMySQLStorer(db)
+
+		rows := sqlmock.NewRows([]string{"permission"}).AddRow("orders:create").AddRow("orders:read")
+		mock.ExpectQuery("SELECT DISTINCT rp.permission FROM role_permissions rp JOIN user_roles ur ON ur.role_id = rp.role_id WHERE ur.user_id = ? ORDER BY rp.permission").
+			WithArgs(1).WillReturnRows(rows)
+		permissions, err := st.ListUserPermissions(context.Background(), 1)
+		require.NoError(t, err)
+		require.Equal(t, []string{"orders:create", "orders:read"}, permissions)
+
+		err = mock.ExpectationsWereMet()
+		require.NoError(t, err)
+	})
+}
+
+func TestGrantRole(t *testing.T) {
+	actorID := int64(2)
+	withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+		st := NewMySQLStorer(db)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT IGNORE INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE name = ?").
+			WithArgs(1, "admin").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`
+		UPDATE users SET is_admin = EXISTS (
+			SELECT 1 FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = users.id AND r.name = ?
+		) WHERE id = ?`).WithArgs("admin", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO audit_logs (actor_id, action, target_user_id, details) VALUES (?, ?, ?, ?)").
+			WithArgs(actorID, "role.grant", 1, "admin").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		err := st.GrantRole(context.Background(), 1, "admin", &actorID)
+		require.NoError(t, err)
+
+		err = mock.ExpectationsWereMet()
+		require.NoError(t, err)
+	})
+}
+
+func TestLastAdmin(t *testing.T) {
+	actorID := int64(2)
+	lockAdmins := "SELECT ur.user_id FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE r.name = ? FOR UPDATE"
+	tcs := []struct {
+		name string
+		test func(*testing.T, *MySQLStorer, sqlmock.Sqlmock)
+	}{
+		{
+			name: "revoke last admin",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockAdmins).WithArgs("admin").WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectRollback()
+
+				err := st.RevokeRole(context.Background(), 1, "admin", &actorID)
+				require.ErrorIs(t, err, ErrLastAdmin)
+			},
+		},
+		{
+			name: "revoke one of two admins",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockAdmins).WithArgs("admin").WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+				mock.ExpectExec("DELETE ur FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = ? AND r.name = ?").
+					WithArgs(1, "admin").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`
+		UPDATE users SET is_admin = EXISTS (
+			SELECT 1 FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = users.id AND r.name = ?
+		) WHERE id = ?`).WithArgs("admin", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO audit_logs (actor_id, action, target_user_id, details) VALUES (?, ?, ?, ?)").
+					WithArgs(actorID, "role.revoke", 1, "admin").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+
+				err := st.RevokeRole(context.Background(), 1, "admin", &actorID)
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "delete last admin",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockAdmins).WithArgs("admin").WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectRollback()
+
+				err := st.DeleteUser(context.Background(), 1)
+				require.ErrorIs(t, err, ErrLastAdmin)
+			},
+		},
+		{
+			name: "demote last admin through update",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT EXISTS (SELECT 1 FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = ? AND r.name = ?)").
+					WithArgs(1, "admin").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectExec(`
+		UPDATE users SET
+			name = ?,
+			email = ?,
+			password = ?,
+			updated_at = ?,
+			email_verified_at = ?
+		WHERE id = ?
+	`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(lockAdmins).WithArgs("admin").WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectRollback()
+
+				_, err := st.UpdateUser(context.Background(), &User{ID: 1, Name: "john", Email: "john@example.com"}, &actorID)
+				require.ErrorIs(t, err, ErrLastAdmin)
+			},
+		},
+		{
+			name: "admin already exists",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockAdmins).WithArgs("admin").WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectRollback()
+
+				_, err := st.CreateFirstAdmin(context.Background(), &User{Name: "admin", Email: "admin@example.com"})
+				require.ErrorIs(t, err, ErrConflict)
+			},
+		},
+		{
+			name: "first admin fails to get the role",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(lockAdmins).WithArgs("admin").WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+				mock.ExpectExec("INSERT INTO users (name, email, password, is_admin) VALUES (?, ?, ?, ?)").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT IGNORE INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE name = ?").
+					WithArgs(1, "customer").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT IGNORE INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE name = ?").
+					WithArgs(1, "admin").WillReturnError(fmt.Errorf("connection reset"))
+				// the user isn't left behind without the role
+				mock.ExpectRollback()
+
+				_, err := st.CreateFirstAdmin(context.Background(), &User{Name: "admin", Email: "admin@example.com"})
+				require.Error(t, err)
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+				st := NewMySQLStorer(db)
+				tc.test(t, st, mock)
+				require.NoError(t, mock.ExpectationsWereMet())
+			})
+		})
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	pr := &PasswordReset{ID: 1, UserID: 2}
+	tcs := []struct {
+		name string
+		test func(*testing.T, *MySQLStorer, sqlmock.Sqlmock)
+	}{
+		{
+			name: "success",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE password_resets SET used_at = NOW() WHERE id = ? AND used_at IS NULL AND expires_at > NOW()").
+					WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE password_resets SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL").
+					WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE users SET password = ?, updated_at = NOW() WHERE id = ?").
+					WithArgs("hashed", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE sessions SET is_revoked = TRUE WHERE user_email = (SELECT email FROM users WHERE id = ?)").
+					WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 3))
+				mock.ExpectCommit()
+
+				err := st.ResetPassword(context.Background(), pr, "hashed")
+				require.NoError(t, err)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "token already used",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE password_resets SET used_at = NOW() WHERE id = ? AND used_at IS NULL AND expires_at > NOW()").
+					WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+
+				err := st.ResetPassword(context.Background(), pr, "hashed")
+				require.ErrorIs(t, err, ErrInvalidToken)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+			st := NewMySQLStorer(db)
+			tc.test(t, st, mock)
+		})
+	}
+}
+
+func TestMarkVerificationSent(t *testing.T) {
+	query := `
+		UPDATE users SET email_verification_sent_at = NOW()
+		WHERE id = ? AND (email_verification_sent_at IS NULL OR email_verification_sent_at < NOW() - INTERVAL ? SECOND)
+	`
+	tcs := []struct {
+		name string
+		test func(*testing.T, *MySQLStorer, sqlmock.Sqlmock)
+	}{
+		{
+			name: "sent",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectExec(query).WithArgs(1, 60).WillReturnResult(sqlmock.NewResult(0, 1))
+				ok, err := st.MarkVerificationSent(context.Background(), 1, time.Minute)
+				require.NoError(t, err)
+				require.True(t, ok)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "sent recently",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectExec(query).WithArgs(1, 60).WillReturnResult(sqlmock.NewResult(0, 0))
+				ok, err := st.MarkVerificationSent(context.Background(), 1, time.Minute)
+				require.NoError(t, err)
+				require.False(t, ok)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+			st := NewMySQLStorer(db)
+			tc.test(t, st, mock)
+		})
+	}
+}
+
+func TestUseTOTPStep(t *testing.T) {
+	query := "UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND last_used_step < ? AND enabled_at IS NOT NULL"
+	withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+		st := NewMySQLStorer(db)
+
+		mock.ExpectExec(query).WithArgs(100, 1, 100).WillReturnResult(sqlmock.NewResult(0, 1))
+		ok, err := st.UseTOTPStep(context.Background(), 1, 100)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		// replaying the same step is rejected
+		mock.ExpectExec(query).WithArgs(100, 1, 100).WillReturnResult(sqlmock.NewResult(0, 0))
+		ok, err = st.UseTOTPStep(context.Background(), 1, 100)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		err = mock.ExpectationsWereMet()
+		require.NoError(t, err)
+	})
+}
+
+func TestReplaceTOTPSecret(t *testing.T) {
+	query := "UPDATE user_totp SET secret = ? WHERE user_id = ? AND secret = ?"
+	withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+		st := NewMySQLStorer(db)
+
+		mock.ExpectExec(query).WithArgs("v1.sealed", 1, "PLAIN").WillReturnResult(sqlmock.NewResult(0, 1))
+		ok, err := st.ReplaceTOTPSecret(context.Background(), 1, "PLAIN", "v1.sealed")
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		// the user enrolled again meanwhile
+		mock.ExpectExec(query).WithArgs("v1.sealed", 1, "PLAIN").WillReturnResult(sqlmock.NewResult(0, 0))
+		ok, err = st.ReplaceTOTPSecret(context.Background(), 1, "PLAIN", "v1.sealed")
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		err = mock.ExpectationsWereMet()
+		require.NoError(t, err)
+	})
+}
+
+func TestRecordLoginFailure(t *testing.T) {
+	withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+		st := NewMySQLStorer(db)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(`
+			INSERT INTO login_throttles (kind, throttle_key, failures, last_failure_at) VALUES (?, ?, 1, NOW())
+			ON DUPLICATE KEY UPDATE
+				failures = IF(last_failure_at < NOW() - INTERVAL ? SECOND, 1, failures + 1),
+				last_failure_at = NOW()
+		`).WithArgs(ThrottleAccount, "test@example.com", 3600).WillReturnResult(sqlmock.NewResult(0, 2))
+		rows := sqlmock.NewRows([]string{"kind", "throttle_key", "failures", "locked_until", "last_failure_at"}).
+			AddRow(ThrottleAccount, "test@example.com", 3, nil, time.Now())
+		mock.ExpectQuery("SELECT * FROM login_throttles WHERE kind = ? AND throttle_key = ?").
+			WithArgs(ThrottleAccount, "test@example.com").WillReturnRows(rows)
+		mock.ExpectCommit()
+
+		lt, err := st.RecordLoginFailure(context.Background(), ThrottleAccount, "test@example.com", time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, int64(3), lt.Failures)
+
+		err = mock.ExpectationsWereMet()
+		require.NoError(t, err)
+	})
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	actorID := int64(1)
+	k := &APIKey{ID: 3, OwnerID: 2, Prefix: "abcdefgh"}
+	tcs := []struct {
+		name string
+		test func(*testing.T, *MySQLStorer, sqlmock.Sqlmock)
+	}{
+		{
+			name: "success",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE api_keys SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL").
+					WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO audit_logs (actor_id, action, target_user_id, details) VALUES (?, ?, ?, ?)").
+					WithArgs(&actorID, "api_key.revoke", &k.OwnerID, "abcdefgh").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+
+				err := st.RevokeAPIKey(context.Background(), k, &actorID)
+				require.NoError(t, err)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "failed audit log",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE api_keys SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL").
+					WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO audit_logs (actor_id, action, target_user_id, details) VALUES (?, ?, ?, ?)").
+					WithArgs(&actorID, "api_key.revoke", &k.OwnerID, "abcdefgh").WillReturnError(fmt.Errorf("error inserting audit log"))
+				mock.ExpectRollback()
+
+				err := st.RevokeAPIKey(context.Background(), k, &actorID)
+				require.Error(t, err)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+			st := NewMySQLStorer(db)
+			tc.test(t, st, mock)
+		})
+	}
+}
+
+func TestDeleteUserIdentity(t *testing.T) {
+	userID := int64(1)
+	tcs := []struct {
+		name string
+		test func(*testing.T, *MySQLStorer, sqlmock.Sqlmock)
+	}{
+		{
+			name: "success",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM user_identities WHERE user_id = ? AND provider = ?").
+					WithArgs(1, "google").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO audit_logs (actor_id, action, target_user_id, details) VALUES (?, ?, ?, ?)").
+					WithArgs(&userID, "identity.unlink", &userID, "google").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+
+				err := st.DeleteUserIdentity(context.Background(), userID, "google")
+				require.NoError(t, err)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "not linked",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM user_identities WHERE user_id = ? AND provider = ?").
+					WithArgs(1, "google").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+
+				err := st.DeleteUserIdentity(context.Background(), userID, "google")
+				require.ErrorIs(t, err, sql.ErrNoRows)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+			st := NewMySQLStorer(db)
+			tc.test(t, st, mock)
+		})
+	}
+}
+
+func TestUseOAuthAuthorizationCode(t *testing.T) {
+	query := "UPDATE oauth_authorization_codes SET used_at = NOW() WHERE id = ? AND client_id = ? AND used_at IS NULL AND expires_at > NOW()"
+	withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+		st := NewMySQLStorer(db)
+
+		mock.ExpectExec(query).WithArgs(1, "other-app").WillReturnResult(sqlmock.NewResult(0, 0))
+		err := st.UseOAuthAuthorizationCode(context.Background(), 1, "other-app")
+		require.ErrorIs(t, err, ErrInvalidToken)
+
+		mock.ExpectExec(query).WithArgs(1, "app").WillReturnResult(sqlmock.NewResult(0, 1))
+		err = st.UseOAuthAuthorizationCode(context.Background(), 1, "app")
+		require.NoError(t, err)
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	query := "SELECT * FROM oauth_grants WHERE client_id = ? AND client_credentials = TRUE AND revoked_at IS NULL LIMIT 1 FOR UPDATE"
+	withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+		st := NewMySQLStorer(db)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(query).WithArgs("app").WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec("INSERT INTO oauth_grants (id, client_id, user_id, scopes, client_credentials) VALUES (?, ?, ?, ?, ?)").
+			WithArgs("new", "app", 2, "orders:read", true).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		g, err := st.ClientCredentialsGrant(context.Background(), &OAuthGrant{ID: "new", ClientID: "app", UserID: 2, Scopes: "orders:read"})
+		require.NoError(t, err)
+		require.Equal(t, "new", g.ID)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(query).WithArgs("app").WillReturnRows(sqlmock.NewRows([]string{"id", "client_id", "user_id", "scopes", "client_credentials", "revoked_at", "created_at"}).
+			AddRow("new", "app", 2, "orders:read", true, nil, time.Now()))
+		mock.ExpectCommit()
+		g, err = st.ClientCredentialsGrant(context.Background(), &OAuthGrant{ID: "another", ClientID: "app", UserID: 2, Scopes: "orders:read"})
+		require.NoError(t, err)
+		require.Equal(t, "new", g.ID)
+
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRotateOAuthRefreshToken(t *testing.T) {
+	now := time.Now()
+	refreshTokenColumns := []string{"id", "token_hash", "grant_id", "expires_at", "used_at", "created_at"}
+	tcs := []struct {
+		name string
+		test func(*testing.T, *MySQLStorer, sqlmock.Sqlmock)
+	}{
+		{
+			name: "success",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT * FROM oauth_refresh_tokens WHERE token_hash = ? FOR UPDATE").
+					WithArgs("old").WillReturnRows(sqlmock.NewRows(refreshTokenColumns).
+					AddRow(1, "old", "grant", now.Add(time.Hour), nil, now))
+				mock.ExpectQuery("SELECT * FROM oauth_grants WHERE id = ?").
+					WithArgs("grant").WillReturnRows(sqlmock.NewRows([]string{"id", "client_id", "user_id", "scopes", "revoked_at", "created_at"}).
+					AddRow("grant", "client", 2, "orders:read", nil, now))
+				mock.ExpectExec("UPDATE oauth_refresh_tokens SET used_at = NOW() WHERE id = ?").
+					WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO oauth_refresh_tokens (token_hash, grant_id, expires_at) VALUES (?, ?, ?)").
+					WithArgs("new", "grant", now.Add(time.Hour)).WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectCommit()
+
+				g, err := st.RotateOAuthRefreshToken(context.Background(), "old", &OAuthRefreshToken{TokenHash: "new", ExpiresAt: now.Add(time.Hour)})
+				require.NoError(t, err)
+				require.Equal(t, "client", g.ClientID)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "reused token revokes grant",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT * FROM oauth_refresh_tokens WHERE token_hash = ? FOR UPDATE").
+					WithArgs("old").WillReturnRows(sqlmock.NewRows(refreshTokenColumns).
+					AddRow(1, "old", "grant", now.Add(time.Hour), now, now))
+				mock.ExpectExec("UPDATE oauth_grants SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL").
+					WithArgs("grant").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+
+				_, err := st.RotateOAuthRefreshToken(context.Background(), "old", &OAuthRefreshToken{TokenHash: "new", ExpiresAt: now.Add(time.Hour)})
+				require.ErrorIs(t, err, ErrInvalidToken)
+
+				err = mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+			st := NewMySQLStorer(db)
+			tc.test(t, st, mock)
+		})
+	}
+}
+
+func TestExecTxSpan(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+		st := NewMySQLStorer(db)
+		mock.ExpectBegin()
+		mock.ExpectRollback()
+
+		err := st.execTx(context.Background(), func(*sqlx.Tx) error { return ErrConflict })
+		require.ErrorIs(t, err, ErrConflict)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	spans := exp.GetSpans()
+	require.Len(t, spans, 1)
+	require.Equal(t, "MySQLStorer.execTx", spans[0].Name)
+	require.Equal(t, codes.Error, spans[0].Status.Code)
+	require.Len(t, spans[0].Events, 1)
+}
+
+func TestDeleteExpiredIdempotencyKeys(t *testing.T) {
+	now := time.Date(2025, 8, 11, 9, 0, 0, 0, time.UTC)
+	withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+		st := NewMySQLStorer(db)
+		mock.ExpectExec("DELETE FROM idempotency_keys WHERE expires_at < ? LIMIT ?").
+			WithArgs(now, 100).WillReturnResult(sqlmock.NewResult(0, 42))
+
+		n, err := st.DeleteExpiredIdempotencyKeys(context.Background(), now, 100)
+		require.NoError(t, err)
+		require.EqualValues(t, 42, n)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	now := time.Date(2025, 8, 11, 9, 0, 0, 0, time.UTC)
+	k := &IdempotencyKey{Scope: "user:1", Key: "k1", RequestHash: "abc", LockedUntil: now.Add(20 * time.Second), ExpiresAt: now.Add(24 * time.Hour)}
+	columns := []string{"scope", "idempotency_key", "request_hash", "response_status", "response_headers", "response_body", "locked_until", "expires_at", "created_at"}
+	duplicate := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'user:1-k1' for key 'idempotency_keys.PRIMARY'"}
+	expectInsert := func(mock sqlmock.Sqlmock) *sqlmock.ExpectedExec {
+		return mock.ExpectExec("INSERT INTO idempotency_keys (scope, idempotency_key, request_hash, locked_until, expires_at) VALUES (?, ?, ?, ?, ?)").
+			WithArgs("user:1", "k1", "abc", k.LockedUntil, k.ExpiresAt)
+	}
+	tcs := []struct {
+		name string
+		test func(*testing.T, *MySQLStorer, sqlmock.Sqlmock)
+	}{
+		{
+			name: "new key",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				expectInsert(mock).WillReturnResult(sqlmock.NewResult(0, 1))
+
+				rec, claimed, err := st.ClaimIdempotencyKey(context.Background(), k, now)
+				require.NoError(t, err)
+				require.True(t, claimed)
+				require.Equal(t, k, rec)
+			},
+		},
+		{
+			name: "completed key",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				expectInsert(mock).WillReturnError(duplicate)
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT * FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? FOR UPDATE").
+					WithArgs("user:1", "k1").
+					WillReturnRows(sqlmock.NewRows(columns).AddRow("user:1", "k1", "abc", 201, `{"Content-Type":"application/json"}`, []byte(`{"id":7}`), now.Add(-time.Minute), now.Add(time.Hour), now.Add(-time.Hour)))
+				mock.ExpectCommit()
+
+				rec, claimed, err := st.ClaimIdempotencyKey(context.Background(), k, now)
+				require.NoError(t, err)
+				require.False(t, claimed)
+				require.Equal(t, 201, *rec.ResponseStatus)
+				require.Equal(t, []byte(`{"id":7}`), rec.ResponseBody)
+			},
+		},
+		{
+			name: "in progress key",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				expectInsert(mock).WillReturnError(duplicate)
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT * FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? FOR UPDATE").
+					WithArgs("user:1", "k1").
+					WillReturnRows(sqlmock.NewRows(columns).AddRow("user:1", "k1", "abc", nil, nil, nil, now.Add(time.Second), now.Add(time.Hour), now))
+				mock.ExpectCommit()
+
+				rec, claimed, err := st.ClaimIdempotencyKey(context.Background(), k, now)
+				require.NoError(t, err)
+				require.False(t, claimed)
+				require.Nil(t, rec.ResponseStatus)
+			},
+		},
+		{
+			name: "abandoned key",
+			test: func(t *testing.T, st *MySQLStorer, mock sqlmock.Sqlmock) {
+				expectInsert(mock).WillReturnError(duplicate)
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT * FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? FOR UPDATE").
+					WithArgs("user:1", "k1").
+					WillReturnRows(sqlmock.NewRows(columns).AddRow("user:1", "k1", "old", nil, nil, nil, now.Add(-time.Second), now.Add(time.Hour), now.Add(-time.Hour)))
+				mock.ExpectExec("UPDATE idempotency_keys SET request_hash = ?, response_status = NULL, response_headers = NULL, response_body = NULL, locked_until = ?, expires_at = ? WHERE scope = ? AND idempotency_key = ?").
+					WithArgs("abc", k.LockedUntil, k.ExpiresAt, "user:1", "k1").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+
+				rec, claimed, err := st.ClaimIdempotencyKey(context.Background(), k, now)
+				require.NoError(t, err)
+				require.True(t, claimed)
+				require.Equal(t, k, rec)
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			withTestDB(t, func(db *sqlx.DB, mock sqlmock.Sqlmock) {
+				st := NewMySQLStorer(db)
+				tc.test(t, st, mock)
+				err := mock.ExpectationsWereMet()
+				require.NoError(t, err)
+			})
+		})
+	}
+}
@@ -48,19 +48,171 @@ type OrderItem struct {
 }
 
 type User struct {
-	ID        int64      `db:"id"`
-	Name      string     `db:"name"`
-	Email     string     `db:"email"`
-	Password  string     `db:"password"`
-	IsAdmin   bool       `db:"is_admin"`
-	CreatedAt time.Time  `db:"created_at"`
-	UpdatedAt *time.Time `db:"updated_at"`
+	ID                      int64      `db:"id"`
+	Name                    string     `db:"name"`
+	Email                   string     `db:"email"`
+	Password                string     `db:"password"`
+	IsAdmin                 bool       `db:"is_admin"`
+	CreatedAt               time.Time  `db:"created_at"`
+	UpdatedAt               *time.Time `db:"updated_at"`
+	EmailVerifiedAt         *time.Time `db:"email_verified_at"`
+	EmailVerificationSentAt *time.Time `db:"email_verification_sent_at"`
+	PasswordResetSentAt     *time.Time `db:"password_reset_sent_at"`
 }
 type Session struct {
-	ID           string    `db:"id"`
-	UserEmail    string    `db:"user_email"`
-	RefreshToken string    `db:"refresh_token"`
-	IsRevoked    bool      `db:"is_revoked"`
+	ID           string     `db:"id"`
+	UserEmail    string     `db:"user_email"`
+	RefreshToken string     `db:"refresh_token"`
+	IsRevoked    bool       `db:"is_revoked"`
+	CreatedAt    time.Time  `db:"created_at"`
+	ExpiresAt    time.Time  `db:"expires_at"`
+	UserAgent    string     `db:"user_agent"`
+	IPAddress    string     `db:"ip_address"`
+	LastUsedAt   *time.Time `db:"last_used_at"`
+}
+
+// AuditLog records a privileged change. ActorID is nil for changes made
+// outside of the API, such as the bootstrap command.
+type AuditLog struct {
+	ID           int64     `db:"id"`
+	ActorID      *int64    `db:"actor_id"`
+	Action       string    `db:"action"`
+	TargetUserID *int64    `db:"target_user_id"`
+	Details      string    `db:"details"`
 	CreatedAt    time.Time `db:"created_at"`
-	ExpiresAt    time.Time `db:"expires_at"`
+}
+
+// PasswordReset is a single-use password reset token. Only the SHA-256 hash of
+// the token is stored.
+type PasswordReset struct {
+	ID        int64      `db:"id"`
+	UserID    int64      `db:"user_id"`
+	TokenHash string     `db:"token_hash"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+// UserTOTP is a user's TOTP enrollment. It is pending until EnabledAt is set.
+// LastUsedStep is the time step of the last accepted code, so a code can't be
+// replayed.
+type UserTOTP struct {
+	UserID       int64      `db:"user_id"`
+	Secret       string     `db:"secret"`
+	EnabledAt    *time.Time `db:"enabled_at"`
+	LastUsedStep int64      `db:"last_used_step"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+// Kinds of login throttles, failed logins are counted per account and per
+// client IP.
+const (
+	ThrottleAccount = "account"
+	ThrottleIP      = "ip"
+)
+
+type LoginThrottle struct {
+	Kind          string     `db:"kind"`
+	Key           string     `db:"throttle_key"`
+	Failures      int64      `db:"failures"`
+	LockedUntil   *time.Time `db:"locked_until"`
+	LastFailureAt time.Time  `db:"last_failure_at"`
+}
+
+// APIKey lets an integration act as its owner, limited to Scopes, which is a
+// comma separated list of permissions. Only the SHA-256 hash of the key is
+// stored, Prefix identifies the key without revealing it.
+type APIKey struct {
+	ID         int64      `db:"id"`
+	Prefix     string     `db:"prefix"`
+	KeyHash    string     `db:"key_hash"`
+	Name       string     `db:"name"`
+	OwnerID    int64      `db:"owner_id"`
+	Scopes     string     `db:"scopes"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+	CreatedBy  *int64     `db:"created_by"`
+	CreatedAt  time.Time  `db:"created_at"`
+}
+
+// UserIdentity links a user to an account at an external OpenID Connect
+// provider, Subject is the provider's stable ID for that account.
+type UserIdentity struct {
+	ID        int64     `db:"id"`
+	UserID    int64     `db:"user_id"`
+	Provider  string    `db:"provider"`
+	Subject   string    `db:"subject"`
+	Email     string    `db:"email"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// OAuthClient is a third-party app registered to use the OAuth2 endpoints.
+// Public clients have no secret and can only use the authorization code
+// grant. Scopes are the permissions the client may ask for, client
+// credentials tokens act as OwnerID.
+type OAuthClient struct {
+	ID           string     `db:"id"`
+	SecretHash   *string    `db:"secret_hash"`
+	Name         string     `db:"name"`
+	RedirectURIs string     `db:"redirect_uris"`
+	Scopes       string     `db:"scopes"`
+	OwnerID      int64      `db:"owner_id"`
+	RevokedAt    *time.Time `db:"revoked_at"`
+	CreatedBy    *int64     `db:"created_by"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+type OAuthAuthorizationCode struct {
+	ID            int64      `db:"id"`
+	CodeHash      string     `db:"code_hash"`
+	ClientID      string     `db:"client_id"`
+	UserID        int64      `db:"user_id"`
+	RedirectURI   string     `db:"redirect_uri"`
+	Scopes        string     `db:"scopes"`
+	CodeChallenge string     `db:"code_challenge"`
+	ExpiresAt     time.Time  `db:"expires_at"`
+	UsedAt        *time.Time `db:"used_at"`
+	CreatedAt     time.Time  `db:"created_at"`
+}
+
+// OAuthGrant is what a user, or for client credentials the client's owner,
+// allowed a client to do. Access tokens carry the grant ID as their session,
+// revoking the grant invalidates every token issued under it. A client has
+// at most one active client credentials grant, shared by all its tokens.
+type OAuthGrant struct {
+	ID                string     `db:"id"`
+	ClientID          string     `db:"client_id"`
+	UserID            int64      `db:"user_id"`
+	Scopes            string     `db:"scopes"`
+	ClientCredentials bool       `db:"client_credentials"`
+	RevokedAt         *time.Time `db:"revoked_at"`
+	CreatedAt         time.Time  `db:"created_at"`
+}
+
+// OAuthRefreshToken is rotated on every use. UsedAt is set once it has been
+// exchanged, presenting it again revokes the grant.
+type OAuthRefreshToken struct {
+	ID        int64      `db:"id"`
+	TokenHash string     `db:"token_hash"`
+	GrantID   string     `db:"grant_id"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+// IdempotencyKey is a request made with an Idempotency-Key header. The
+// response is stored once the request completes, ResponseStatus is nil while
+// it is in progress. LockedUntil bounds how long a crashed request can keep
+// retries waiting.
+type IdempotencyKey struct {
+	Scope           string    `db:"scope"`
+	Key             string    `db:"idempotency_key"`
+	RequestHash     string    `db:"request_hash"`
+	ResponseStatus  *int      `db:"response_status"`
+	ResponseHeaders *string   `db:"response_headers"`
+	ResponseBody    []byte    `db:"response_body"`
+	LockedUntil     time.Time `db:"locked_until"`
+	ExpiresAt       time.Time `db:"expires_at"`
+	CreatedAt       time.Time `db:"created_at"`
 }
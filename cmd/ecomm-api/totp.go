@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/hellwind2019/ecomm/cmd/ecomm-api/server"
+	"github.com/hellwind2019/ecomm/token"
+)
+
+// sealTOTPSecrets encrypts the TOTP secrets stored in plaintext before
+// secrets were encrypted at rest. It does nothing once they all are.
+func sealTOTPSecrets(ctx context.Context, srv *server.Server, maker *token.JWTMaker) error {
+	ts, err := srv.ListUserTOTP(ctx)
+	if err != nil {
+		return err
+	}
+	sealed := 0
+	for _, t := range ts {
+		if token.IsSealed(t.Secret) {
+			continue
+		}
+		secret, err := maker.Seal(token.PurposeTOTPSecret, t.Secret)
+		if err != nil {
+			return err
+		}
+		ok, err := srv.ReplaceTOTPSecret(ctx, t.UserID, t.Secret, secret)
+		if err != nil {
+			return fmt.Errorf("failed to seal totp secret of user %d: %w", t.UserID, err)
+		}
+		if ok {
+			sealed++
+		}
+	}
+	if sealed > 0 {
+		slog.InfoContext(ctx, "encrypted plaintext totp secrets", "count", sealed)
+	}
+	return nil
+}
@@ -1,12 +1,23 @@
 package db
 
 import (
+	"context"
+	"embed"
 	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 )
 
+// migrations are the files the migrate CLI applies, embedded so the API knows
+// which version the schema must be at.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
 type Database struct {
 	db *sqlx.DB
 }
@@ -26,3 +37,52 @@ func (d *Database) Close() error {
 func (d *Database) GetDB() *sqlx.DB {
 	return d.db
 }
+
+// Ping checks that the database is reachable.
+func (d *Database) Ping(ctx context.Context) error {
+	if err := d.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping database: %w", err)
+	}
+	return nil
+}
+
+// CheckMigrations fails when the schema is behind the newest migration or the
+// last migration failed halfway. A schema ahead of this build is fine, newer
+// instances migrate before older ones are replaced.
+func (d *Database) CheckMigrations(ctx context.Context) error {
+	latest, err := LatestMigration()
+	if err != nil {
+		return err
+	}
+	var version uint64
+	var dirty bool
+	if err := d.db.QueryRowxContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty); err != nil {
+		return fmt.Errorf("failed to read migration version: %w", err)
+	}
+	if dirty {
+		return fmt.Errorf("migration %d is dirty", version)
+	}
+	if version < latest {
+		return fmt.Errorf("schema is at migration %d, want %d", version, latest)
+	}
+	return nil
+}
+
+// LatestMigration returns the version of the newest migration file.
+func LatestMigration() (uint64, error) {
+	files, err := fs.Glob(migrations, "migrations/*.up.sql")
+	if err != nil {
+		return 0, err
+	}
+	var latest uint64
+	for _, f := range files {
+		name := strings.TrimPrefix(f, "migrations/")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.ParseUint(prefix, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid migration file name %q: %w", name, err)
+		}
+		latest = max(latest, version)
+	}
+	return latest, nil
+}
@@ -0,0 +1,9 @@
+DROP INDEX `idx_sessions_user_email` ON `sessions`;
+
+-- refresh tokens stay hashed, they cannot be recovered
+ALTER TABLE `sessions` MODIFY `refresh_token` varchar(512) NOT NULL;
+
+ALTER TABLE `sessions`
+    DROP COLUMN `last_used_at`,
+    DROP COLUMN `ip_address`,
+    DROP COLUMN `user_agent`;
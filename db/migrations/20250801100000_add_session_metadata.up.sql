@@ -0,0 +1,10 @@
+ALTER TABLE `sessions`
+    ADD COLUMN `user_agent` varchar(512) NOT NULL DEFAULT '',
+    ADD COLUMN `ip_address` varchar(45) NOT NULL DEFAULT '',
+    ADD COLUMN `last_used_at` datetime;
+
+UPDATE `sessions` SET `refresh_token` = SHA2(`refresh_token`, 256);
+
+ALTER TABLE `sessions` MODIFY `refresh_token` char(64) NOT NULL;
+
+CREATE INDEX `idx_sessions_user_email` ON `sessions` (`user_email`);
@@ -0,0 +1,53 @@
+CREATE TABLE `roles` (
+  `id` int PRIMARY KEY NOT NULL AUTO_INCREMENT,
+  `name` varchar(64) NOT NULL UNIQUE,
+  `description` varchar(255) NOT NULL DEFAULT ''
+);
+
+CREATE TABLE `role_permissions` (
+  `role_id` int NOT NULL,
+  `permission` varchar(64) NOT NULL,
+  PRIMARY KEY (`role_id`, `permission`),
+  FOREIGN KEY (`role_id`) REFERENCES `roles` (`id`) ON DELETE CASCADE
+);
+
+CREATE TABLE `user_roles` (
+  `user_id` int NOT NULL,
+  `role_id` int NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT (now()),
+  PRIMARY KEY (`user_id`, `role_id`),
+  FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE,
+  FOREIGN KEY (`role_id`) REFERENCES `roles` (`id`) ON DELETE CASCADE
+);
+
+INSERT INTO `roles` (`name`, `description`) VALUES
+  ('customer', 'Places and views their own orders'),
+  ('support', 'Looks up customers, their orders and sessions'),
+  ('catalog-manager', 'Manages the product catalog'),
+  ('fulfillment', 'Processes and ships orders'),
+  ('admin', 'Full access');
+
+INSERT INTO `role_permissions` (`role_id`, `permission`)
+SELECT r.`id`, p.`permission` FROM `roles` r
+JOIN (
+  SELECT 'customer' AS `role`, 'orders:create' AS `permission`
+  UNION ALL SELECT 'customer', 'orders:read'
+  UNION ALL SELECT 'support', 'orders:read_all'
+  UNION ALL SELECT 'support', 'users:read'
+  UNION ALL SELECT 'support', 'sessions:manage'
+  UNION ALL SELECT 'catalog-manager', 'products:write'
+  UNION ALL SELECT 'fulfillment', 'orders:read_all'
+  UNION ALL SELECT 'fulfillment', 'orders:write'
+  UNION ALL SELECT 'admin', 'products:write'
+  UNION ALL SELECT 'admin', 'orders:create'
+  UNION ALL SELECT 'admin', 'orders:read'
+  UNION ALL SELECT 'admin', 'orders:read_all'
+  UNION ALL SELECT 'admin', 'orders:write'
+  UNION ALL SELECT 'admin', 'users:read'
+  UNION ALL SELECT 'admin', 'users:delete'
+  UNION ALL SELECT 'admin', 'sessions:manage'
+) p ON p.`role` = r.`name`;
+
+INSERT INTO `user_roles` (`user_id`, `role_id`)
+SELECT u.`id`, r.`id` FROM `users` u
+JOIN `roles` r ON r.`name` = IF(u.`is_admin`, 'admin', 'customer');
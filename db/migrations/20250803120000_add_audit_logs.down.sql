@@ -0,0 +1,3 @@
+DELETE FROM `role_permissions` WHERE `permission` = 'users:manage_roles';
+
+DROP TABLE IF EXISTS `audit_logs`;
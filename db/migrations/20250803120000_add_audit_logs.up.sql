@@ -0,0 +1,13 @@
+CREATE TABLE `audit_logs` (
+  `id` int PRIMARY KEY NOT NULL AUTO_INCREMENT,
+  `actor_id` int,
+  `action` varchar(64) NOT NULL,
+  `target_user_id` int,
+  `details` varchar(1024) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL DEFAULT (now())
+);
+
+CREATE INDEX `idx_audit_logs_target_user_id` ON `audit_logs` (`target_user_id`);
+
+INSERT INTO `role_permissions` (`role_id`, `permission`)
+SELECT `id`, 'users:manage_roles' FROM `roles` WHERE `name` = 'admin';
@@ -0,0 +1,9 @@
+CREATE TABLE `password_resets` (
+  `id` int PRIMARY KEY NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `token_hash` char(64) NOT NULL UNIQUE,
+  `expires_at` datetime NOT NULL,
+  `used_at` datetime,
+  `created_at` datetime NOT NULL DEFAULT (now()),
+  FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+);
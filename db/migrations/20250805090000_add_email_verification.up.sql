@@ -0,0 +1,6 @@
+ALTER TABLE `users`
+    ADD COLUMN `email_verified_at` datetime,
+    ADD COLUMN `email_verification_sent_at` datetime;
+
+-- accounts created before verification existed are trusted as they are
+UPDATE `users` SET `email_verified_at` = `created_at`;
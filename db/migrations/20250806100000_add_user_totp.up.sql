@@ -0,0 +1,18 @@
+CREATE TABLE `user_totp` (
+  `user_id` int PRIMARY KEY NOT NULL,
+  `secret` varchar(64) NOT NULL,
+  `enabled_at` datetime,
+  `last_used_step` bigint NOT NULL DEFAULT 0,
+  `created_at` datetime NOT NULL DEFAULT (now()),
+  FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+);
+
+CREATE TABLE `mfa_recovery_codes` (
+  `id` int PRIMARY KEY NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `code_hash` char(64) NOT NULL,
+  `used_at` datetime,
+  `created_at` datetime NOT NULL DEFAULT (now()),
+  UNIQUE (`user_id`, `code_hash`),
+  FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+DELETE FROM `role_permissions` WHERE `permission` = 'users:unlock';
+
+DROP TABLE IF EXISTS `login_throttles`;
@@ -0,0 +1,11 @@
+CREATE TABLE `login_throttles` (
+  `kind` varchar(16) NOT NULL,
+  `throttle_key` varchar(255) NOT NULL,
+  `failures` int NOT NULL DEFAULT 0,
+  `locked_until` datetime,
+  `last_failure_at` datetime NOT NULL DEFAULT (now()),
+  PRIMARY KEY (`kind`, `throttle_key`)
+);
+
+INSERT INTO `role_permissions` (`role_id`, `permission`)
+SELECT `id`, 'users:unlock' FROM `roles` WHERE `name` IN ('admin', 'support');
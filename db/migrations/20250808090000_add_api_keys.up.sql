@@ -0,0 +1,17 @@
+CREATE TABLE `api_keys` (
+  `id` int PRIMARY KEY NOT NULL AUTO_INCREMENT,
+  `prefix` varchar(16) NOT NULL UNIQUE,
+  `key_hash` char(64) NOT NULL,
+  `name` varchar(255) NOT NULL,
+  `owner_id` int NOT NULL,
+  `scopes` varchar(1024) NOT NULL DEFAULT '',
+  `expires_at` datetime,
+  `last_used_at` datetime,
+  `revoked_at` datetime,
+  `created_by` int,
+  `created_at` datetime NOT NULL DEFAULT (now()),
+  FOREIGN KEY (`owner_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+);
+
+INSERT INTO `role_permissions` (`role_id`, `permission`)
+SELECT `id`, 'api_keys:manage' FROM `roles` WHERE `name` = 'admin';
@@ -0,0 +1,11 @@
+CREATE TABLE `user_identities` (
+  `id` int PRIMARY KEY NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `provider` varchar(64) NOT NULL,
+  `subject` varchar(255) NOT NULL,
+  `email` varchar(255) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL DEFAULT (now()),
+  UNIQUE KEY `provider_subject` (`provider`, `subject`),
+  UNIQUE KEY `user_provider` (`user_id`, `provider`),
+  FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+);
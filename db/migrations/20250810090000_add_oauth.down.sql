@@ -0,0 +1,6 @@
+DELETE FROM `role_permissions` WHERE `permission` = 'oauth_clients:manage';
+
+DROP TABLE IF EXISTS `oauth_refresh_tokens`;
+DROP TABLE IF EXISTS `oauth_grants`;
+DROP TABLE IF EXISTS `oauth_authorization_codes`;
+DROP TABLE IF EXISTS `oauth_clients`;
@@ -0,0 +1,51 @@
+CREATE TABLE `oauth_clients` (
+  `id` varchar(64) PRIMARY KEY NOT NULL,
+  `secret_hash` char(64),
+  `name` varchar(255) NOT NULL,
+  `redirect_uris` varchar(2048) NOT NULL DEFAULT '',
+  `scopes` varchar(1024) NOT NULL DEFAULT '',
+  `owner_id` int NOT NULL,
+  `revoked_at` datetime,
+  `created_by` int,
+  `created_at` datetime NOT NULL DEFAULT (now()),
+  FOREIGN KEY (`owner_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+);
+
+CREATE TABLE `oauth_authorization_codes` (
+  `id` int PRIMARY KEY NOT NULL AUTO_INCREMENT,
+  `code_hash` char(64) NOT NULL UNIQUE,
+  `client_id` varchar(64) NOT NULL,
+  `user_id` int NOT NULL,
+  `redirect_uri` varchar(2048) NOT NULL,
+  `scopes` varchar(1024) NOT NULL DEFAULT '',
+  `code_challenge` varchar(128) NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `used_at` datetime,
+  `created_at` datetime NOT NULL DEFAULT (now()),
+  FOREIGN KEY (`client_id`) REFERENCES `oauth_clients` (`id`) ON DELETE CASCADE,
+  FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+);
+
+CREATE TABLE `oauth_grants` (
+  `id` char(36) PRIMARY KEY NOT NULL,
+  `client_id` varchar(64) NOT NULL,
+  `user_id` int NOT NULL,
+  `scopes` varchar(1024) NOT NULL DEFAULT '',
+  `revoked_at` datetime,
+  `created_at` datetime NOT NULL DEFAULT (now()),
+  FOREIGN KEY (`client_id`) REFERENCES `oauth_clients` (`id`) ON DELETE CASCADE,
+  FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+);
+
+CREATE TABLE `oauth_refresh_tokens` (
+  `id` int PRIMARY KEY NOT NULL AUTO_INCREMENT,
+  `token_hash` char(64) NOT NULL UNIQUE,
+  `grant_id` char(36) NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `used_at` datetime,
+  `created_at` datetime NOT NULL DEFAULT (now()),
+  FOREIGN KEY (`grant_id`) REFERENCES `oauth_grants` (`id`) ON DELETE CASCADE
+);
+
+INSERT INTO `role_permissions` (`role_id`, `permission`)
+SELECT `id`, 'oauth_clients:manage' FROM `roles` WHERE `name` = 'admin';
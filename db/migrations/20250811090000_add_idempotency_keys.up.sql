@@ -0,0 +1,13 @@
+CREATE TABLE `idempotency_keys` (
+  `scope` varchar(64) NOT NULL,
+  `idempotency_key` varchar(255) NOT NULL,
+  `request_hash` char(64) NOT NULL,
+  `response_status` int,
+  `response_headers` text,
+  `response_body` mediumblob,
+  `locked_until` datetime NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `created_at` datetime NOT NULL DEFAULT (now()),
+  PRIMARY KEY (`scope`, `idempotency_key`),
+  INDEX (`expires_at`)
+);
@@ -0,0 +1,2 @@
+INSERT INTO `role_permissions` (`role_id`, `permission`)
+SELECT `id`, 'products:moderate' FROM `roles` WHERE `name` = 'admin';
@@ -0,0 +1 @@
+ALTER TABLE `oauth_grants` DROP COLUMN `client_credentials`;
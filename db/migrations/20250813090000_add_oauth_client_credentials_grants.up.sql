@@ -0,0 +1 @@
+ALTER TABLE `oauth_grants` ADD COLUMN `client_credentials` BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+INSERT INTO `role_permissions` (`role_id`, `permission`)
+SELECT `id`, 'metrics:read' FROM `roles` WHERE `name` = 'admin';
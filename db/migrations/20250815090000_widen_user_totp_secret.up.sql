@@ -0,0 +1 @@
+ALTER TABLE `user_totp` MODIFY `secret` varchar(128) NOT NULL;
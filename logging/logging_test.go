@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "info", "json")
+	require.NoError(t, err)
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	logger.DebugContext(ctx, "hidden")
+	logger.InfoContext(ctx, "login", "email", "a@b.c", "password", "hunter2", "refresh_token", "abc")
+
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &rec))
+	require.Equal(t, "login", rec["msg"])
+	require.Equal(t, "req-1", rec["request_id"])
+	require.Equal(t, "a@b.c", rec["email"])
+	require.Equal(t, Redacted, rec["password"])
+	require.Equal(t, Redacted, rec["refresh_token"])
+
+	_, err = New(&buf, "loud", "json")
+	require.Error(t, err)
+	_, err = New(&buf, "info", "xml")
+	require.Error(t, err)
+}
+
+func TestRedactURL(t *testing.T) {
+	tcs := []struct {
+		url  string
+		want string
+	}{
+		{"/products", "/products"},
+		{"/products?page=2", "/products?page=2"},
+		{"/users/verify?token=abc", "/users/verify?token=%5BREDACTED%5D"},
+		{"/oauth/authorize?client_id=app&code_challenge=xyz&state=s", "/oauth/authorize?client_id=app&code_challenge=%5BREDACTED%5D&state=s"},
+	}
+	for _, tc := range tcs {
+		u, err := url.Parse(tc.url)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, RedactURL(u))
+	}
+}
@@ -0,0 +1,29 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// OutboxMailer writes messages to w instead of delivering them. It is meant
+// for local development, where w is a file or the process log.
+type OutboxMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewOutboxMailer(w io.Writer) *OutboxMailer {
+	return &OutboxMailer{w: w}
+}
+func (m *OutboxMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.w, "--- %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC3339), msg.To, msg.Subject, msg.Body)
+	if err != nil {
+		return fmt.Errorf("failed to write to outbox: %w", err)
+	}
+	return nil
+}
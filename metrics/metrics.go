@@ -0,0 +1,102 @@
+// Package metrics holds the Prometheus collectors of ecomm-api. They are
+// registered on Registry, which /metrics serves.
+package metrics
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "ecomm"
+
+// Registry holds every collector of this package plus the Go runtime and
+// process collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts requests by chi route pattern, so /products/1 and
+	// /products/2 share a series.
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route pattern, method and status.",
+	}, []string{"route", "method", "status"})
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route pattern, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// StorerCallDuration times each storer method including all queries of
+	// its transaction, see ObserveStorerCall.
+	StorerCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storer_call_duration_seconds",
+		Help:      "Duration of storer calls by method.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"method"})
+
+	// There is no out-of-stock rejection counter yet, orders don't check
+	// stock. It is added with stock enforcement, backlog item user-051.
+	OrdersCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_created_total",
+		Help:      "Orders placed.",
+	})
+	OrderValue = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "order_value",
+		Help:      "Total price of placed orders.",
+		Buckets:   []float64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
+	})
+	// Logins counts password logins by result, success or failure. A login
+	// waiting for its second factor only counts once that is checked.
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Logins by result.",
+	}, []string{"result"})
+	TokenRenewals = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_renewals_total",
+		Help:      "Access tokens renewed with the refresh token of a session.",
+	})
+)
+
+// Values of the result label of Logins.
+const (
+	LoginSuccess = "success"
+	LoginFailure = "failure"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		StorerCallDuration,
+		OrdersCreated,
+		OrderValue,
+		Logins,
+		TokenRenewals,
+	)
+	// both results show up as 0 before the first login
+	Logins.WithLabelValues(LoginSuccess)
+	Logins.WithLabelValues(LoginFailure)
+}
+
+// ObserveStorerCall records the duration of a storer call, it is the call
+// observer of the storer.
+func ObserveStorerCall(method string, d time.Duration) {
+	StorerCallDuration.WithLabelValues(method).Observe(d.Seconds())
+}
+
+// RegisterDB exports the connection pool stats of db.
+func RegisterDB(db *sql.DB, name string) {
+	Registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
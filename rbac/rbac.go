@@ -0,0 +1,63 @@
+package rbac
+
+// Role names as stored in the roles table.
+const (
+	RoleCustomer       = "customer"
+	RoleSupport        = "support"
+	RoleCatalogManager = "catalog-manager"
+	RoleFulfillment    = "fulfillment"
+	RoleAdmin          = "admin"
+)
+
+// Roles lists every role seeded by the migrations.
+var Roles = []string{RoleCustomer, RoleSupport, RoleCatalogManager, RoleFulfillment, RoleAdmin}
+
+func IsRole(name string) bool {
+	for _, r := range Roles {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Permission is a granular capability granted to roles through the
+// role_permissions table and embedded in access tokens.
+type Permission string
+
+const (
+	ProductsWrite Permission = "products:write"
+	// ProductsModerate allows correcting ratings and review counts, which
+	// otherwise follow from reviews.
+	ProductsModerate   Permission = "products:moderate"
+	OrdersCreate       Permission = "orders:create"
+	OrdersRead         Permission = "orders:read"
+	OrdersReadAll      Permission = "orders:read_all"
+	OrdersWrite        Permission = "orders:write"
+	UsersRead          Permission = "users:read"
+	UsersDelete        Permission = "users:delete"
+	UsersManageRoles   Permission = "users:manage_roles"
+	UsersUnlock        Permission = "users:unlock"
+	SessionsManage     Permission = "sessions:manage"
+	APIKeysManage      Permission = "api_keys:manage"
+	OAuthClientsManage Permission = "oauth_clients:manage"
+	// MetricsRead allows scraping /metrics, which exposes business figures
+	// such as order counts and revenue.
+	MetricsRead Permission = "metrics:read"
+)
+
+// Permissions lists every permission the API checks.
+var Permissions = []Permission{
+	ProductsWrite, ProductsModerate, OrdersCreate, OrdersRead, OrdersReadAll, OrdersWrite,
+	UsersRead, UsersDelete, UsersManageRoles, UsersUnlock, SessionsManage, APIKeysManage,
+	OAuthClientsManage, MetricsRead,
+}
+
+func IsPermission(name string) bool {
+	for _, p := range Permissions {
+		if string(p) == name {
+			return true
+		}
+	}
+	return false
+}
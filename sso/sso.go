@@ -0,0 +1,147 @@
+// Package sso signs users in with external OpenID Connect providers using the
+// authorization code flow with PKCE.
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var ErrNonceMismatch = errors.New("id token nonce does not match")
+
+// ProviderConfig describes one OpenID Connect provider. The issuer must
+// support discovery, the endpoints are read from its
+// /.well-known/openid-configuration.
+type ProviderConfig struct {
+	Name         string   `json:"name"`
+	IssuerURL    string   `json:"issuer_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+}
+
+// Identity is what we keep from a verified ID token.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type Provider struct {
+	name     string
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewProvider runs discovery against the issuer.
+func NewProvider(ctx context.Context, cfg ProviderConfig) (*Provider, error) {
+	p, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover provider %s: %w", cfg.Name, err)
+	}
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+	return &Provider{
+		name: cfg.Name,
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     p.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		},
+		verifier: p.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+func (p *Provider) Name() string {
+	return p.name
+}
+
+// CallbackPath is the path of the redirect URL, where the provider sends
+// users back to.
+func (p *Provider) CallbackPath() string {
+	u, err := url.Parse(p.oauth2.RedirectURL)
+	if err != nil || u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// AuthCodeURL returns where to send the user. codeVerifier and nonce have to
+// be kept by the caller until the callback.
+func (p *Provider) AuthCodeURL(state, nonce, codeVerifier string) string {
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(codeVerifier))
+}
+
+// Exchange redeems the authorization code and verifies the ID token that
+// comes with it.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Identity, error) {
+	tok, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+	rawIDToken, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify id token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, ErrNonceMismatch
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse id token claims: %w", err)
+	}
+	return &Identity{
+		Provider:      p.name,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}, nil
+}
+
+// LoadProviders reads a JSON array of ProviderConfig from path and discovers
+// every provider in it.
+func LoadProviders(ctx context.Context, path string) (map[string]*Provider, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read providers file: %w", err)
+	}
+	var cfgs []ProviderConfig
+	if err := json.Unmarshal(b, &cfgs); err != nil {
+		return nil, fmt.Errorf("failed to parse providers file: %w", err)
+	}
+	providers := make(map[string]*Provider, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("provider without a name in %s", path)
+		}
+		p, err := NewProvider(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		providers[cfg.Name] = p
+	}
+	return providers, nil
+}
@@ -0,0 +1,160 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// stubProvider is a minimal OpenID Connect provider. authorize stands in for
+// the user approving the login and returns the code the provider would
+// redirect back with.
+type stubProvider struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]url.Values
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	sp := &stubProvider{key: key, codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                sp.URL,
+			"authorization_endpoint":                sp.URL + "/authorize",
+			"token_endpoint":                        sp.URL + "/token",
+			"jwks_uri":                              sp.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sp.mu.Lock()
+		auth, ok := sp.codes[r.Form.Get("code")]
+		delete(sp.codes, r.Form.Get("code"))
+		sp.mu.Unlock()
+		if !ok || oauth2.S256ChallengeFromVerifier(r.Form.Get("code_verifier")) != auth.Get("code_challenge") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            sp.URL,
+			"sub":            "external-1",
+			"aud":            auth.Get("client_id"),
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"iat":            time.Now().Unix(),
+			"nonce":          auth.Get("nonce"),
+			"email":          "jane@example.com",
+			"email_verified": true,
+			"name":           "Jane",
+		})
+		idToken.Header["kid"] = "test"
+		signed, err := idToken.SignedString(key)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     signed,
+		})
+	})
+	sp.Server = httptest.NewServer(mux)
+	t.Cleanup(sp.Close)
+	return sp
+}
+
+func (sp *stubProvider) authorize(t *testing.T, authURL string) string {
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	code := "code-" + u.Query().Get("state")
+	sp.codes[code] = u.Query()
+	return code
+}
+
+func TestExchange(t *testing.T) {
+	sp := newStubProvider(t)
+	ctx := context.Background()
+	p, err := NewProvider(ctx, ProviderConfig{
+		Name:        "stub",
+		IssuerURL:   sp.URL,
+		ClientID:    "ecomm",
+		RedirectURL: "http://localhost:8080/users/oidc/stub/callback",
+	})
+	require.NoError(t, err)
+
+	tcs := []struct {
+		name string
+		test func(*testing.T)
+	}{
+		{
+			name: "success",
+			test: func(t *testing.T) {
+				verifier := oauth2.GenerateVerifier()
+				code := sp.authorize(t, p.AuthCodeURL("state1", "nonce1", verifier))
+				id, err := p.Exchange(ctx, code, verifier, "nonce1")
+				require.NoError(t, err)
+				require.Equal(t, &Identity{
+					Provider:      "stub",
+					Subject:       "external-1",
+					Email:         "jane@example.com",
+					EmailVerified: true,
+					Name:          "Jane",
+				}, id)
+			},
+		},
+		{
+			name: "wrong code verifier",
+			test: func(t *testing.T) {
+				code := sp.authorize(t, p.AuthCodeURL("state2", "nonce2", oauth2.GenerateVerifier()))
+				_, err := p.Exchange(ctx, code, oauth2.GenerateVerifier(), "nonce2")
+				require.Error(t, err)
+			},
+		},
+		{
+			name: "wrong nonce",
+			test: func(t *testing.T) {
+				verifier := oauth2.GenerateVerifier()
+				code := sp.authorize(t, p.AuthCodeURL("state3", "nonce3", verifier))
+				_, err := p.Exchange(ctx, code, verifier, "other")
+				require.ErrorIs(t, err, ErrNonceMismatch)
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, tc.test)
+	}
+}
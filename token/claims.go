@@ -8,22 +8,48 @@ import (
 	"github.com/google/uuid"
 )
 
+// Types of the tokens issued for a session. Both are signed with the same key,
+// the type keeps a refresh token from being used as an access token.
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+)
+
 type UserClaims struct {
-	ID      int64  `json:"id"`
-	Email   string `json:"email"`
-	IsAdmin bool   `json:"is_admin"`
+	// Type is TokenTypeAccess or TokenTypeRefresh.
+	Type        string   `json:"typ"`
+	ID          int64    `json:"id"`
+	Email       string   `json:"email"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	SessionID   string   `json:"sid"`
+	// APIKeyID is set instead of SessionID when the request was
+	// authenticated with an API key, it never appears in a JWT.
+	APIKeyID int64 `json:"-"`
+	// ClientID is set on tokens issued to a third-party app through OAuth2,
+	// SessionID is then the ID of the app's grant.
+	ClientID string `json:"client_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func NewUserClaims(id int64, email string, isAdmin bool, duration time.Duration) (*UserClaims, error) {
+// NewUserClaims creates claims of the given token type bound to the given
+// session. An empty sessionID means the token starts a new session and its own
+// token ID is used instead.
+func NewUserClaims(tokenType string, id int64, email string, roles []string, permissions []string, sessionID string, duration time.Duration) (*UserClaims, error) {
 	tokenId, err := uuid.NewRandom()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate token ID: %v", err)
 	}
+	if sessionID == "" {
+		sessionID = tokenId.String()
+	}
 	return &UserClaims{
-		ID:      id,
-		Email:   email,
-		IsAdmin: isAdmin,
+		Type:        tokenType,
+		ID:          id,
+		Email:       email,
+		Roles:       roles,
+		Permissions: permissions,
+		SessionID:   sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ID:        tokenId.String(),
 			Subject:   email,
@@ -32,3 +58,18 @@ func NewUserClaims(id int64, email string, isAdmin bool, duration time.Duration)
 		},
 	}, nil
 }
+
+// Delegated reports whether the request comes from an integration acting on
+// behalf of the user rather than from the user's own session.
+func (c *UserClaims) Delegated() bool {
+	return c.APIKeyID != 0 || c.ClientID != ""
+}
+
+func (c *UserClaims) HasPermission(permission string) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -14,20 +14,32 @@ type JWTMaker struct {
 func NewJWTMaker(secretKey string) *JWTMaker {
 	return &JWTMaker{secretKey: secretKey}
 }
-func (maker *JWTMaker) CreateToken(id int64, email string, isAdmin bool, duration time.Duration) (string, *UserClaims, error) {
-	claims, err := NewUserClaims(id, email, isAdmin, duration)
+func (maker *JWTMaker) CreateToken(tokenType string, id int64, email string, roles []string, permissions []string, sessionID string, duration time.Duration) (string, *UserClaims, error) {
+	claims, err := NewUserClaims(tokenType, id, email, roles, permissions, sessionID, duration)
 	if err != nil {
 		return "", nil, err
 	}
+	tokenStr, err := maker.SignClaims(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return tokenStr, claims, nil
+}
 
+// SignClaims signs claims built with NewUserClaims, for callers that need to
+// set more than CreateToken does.
+func (maker *JWTMaker) SignClaims(claims *UserClaims) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenStr, err := token.SignedString([]byte(maker.secretKey))
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to sign token: %v", err)
+		return "", fmt.Errorf("failed to sign token: %v", err)
 	}
-	return tokenStr, claims, nil
+	return tokenStr, nil
 }
-func (maker *JWTMaker) VerifyToken(tokenStr string) (*UserClaims, error) {
+
+// VerifyToken checks the signature and expiry of a token and that it is of
+// the given type.
+func (maker *JWTMaker) VerifyToken(tokenType string, tokenStr string) (*UserClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenStr, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
 		//verify the signing method
 		_, ok := token.Method.(*jwt.SigningMethodHMAC)
@@ -43,5 +55,8 @@ func (maker *JWTMaker) VerifyToken(tokenStr string) (*UserClaims, error) {
 	if !ok || !token.Valid {
 		return nil, fmt.Errorf("invalid token")
 	}
+	if claims.Type != tokenType {
+		return nil, fmt.Errorf("expected %s token, got %q", tokenType, claims.Type)
+	}
 	return claims, nil
 }
@@ -0,0 +1,62 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Purposes of single-purpose tokens. Each purpose signs with its own derived
+// key, so a token minted for one flow is rejected by every other flow and by
+// VerifyToken.
+const (
+	PurposeEmailVerification = "email-verification"
+	PurposeMFAChallenge      = "mfa-challenge"
+	PurposeOIDCLogin         = "oidc-login"
+	PurposeOAuthConsent      = "oauth-consent"
+)
+
+// CreatePurposeToken signs a short token that carries only a subject and is
+// valid for the given purpose.
+func (maker *JWTMaker) CreatePurposeToken(purpose, subject string, duration time.Duration) (string, error) {
+	claims := jwt.RegisteredClaims{
+		Subject:   subject,
+		Audience:  jwt.ClaimStrings{purpose},
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenStr, err := token.SignedString(maker.purposeKey(purpose))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %v", err)
+	}
+	return tokenStr, nil
+}
+
+// VerifyPurposeToken returns the subject of a token created by CreatePurposeToken.
+func (maker *JWTMaker) VerifyPurposeToken(purpose, tokenStr string) (string, error) {
+	token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
+		_, ok := token.Method.(*jwt.SigningMethodHMAC)
+		if !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return maker.purposeKey(purpose), nil
+	}, jwt.WithAudience(purpose))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse token: %v", err)
+	}
+	claims, ok := token.Claims.(*jwt.RegisteredClaims)
+	if !ok || !token.Valid {
+		return "", fmt.Errorf("invalid token")
+	}
+	return claims.Subject, nil
+}
+
+func (maker *JWTMaker) purposeKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(maker.secretKey))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
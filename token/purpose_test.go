@@ -0,0 +1,24 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurposeToken(t *testing.T) {
+	maker := NewJWTMaker(testSecretKey)
+	tok, err := maker.CreatePurposeToken(PurposeEmailVerification, "john@example.com", time.Minute)
+	require.NoError(t, err)
+
+	subject, err := maker.VerifyPurposeToken(PurposeEmailVerification, tok)
+	require.NoError(t, err)
+	require.Equal(t, "john@example.com", subject)
+
+	// a token for one flow is rejected by the others and as an access token
+	_, err = maker.VerifyPurposeToken(PurposeMFAChallenge, tok)
+	require.Error(t, err)
+	_, err = maker.VerifyToken(TokenTypeAccess, tok)
+	require.Error(t, err)
+}
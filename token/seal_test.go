@@ -0,0 +1,40 @@
+package token
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testSecretKey = "0123456789012345678901234567890123456789"
+
+func TestSeal(t *testing.T) {
+	maker := NewJWTMaker(testSecretKey)
+	sealed, err := maker.Seal(PurposeTOTPSecret, "JBSWY3DPEHPK3PXP")
+	require.NoError(t, err)
+	require.True(t, IsSealed(sealed))
+
+	t.Run("round trip", func(t *testing.T) {
+		plaintext, err := maker.Open(PurposeTOTPSecret, sealed)
+		require.NoError(t, err)
+		require.Equal(t, "JBSWY3DPEHPK3PXP", plaintext)
+	})
+	t.Run("wrong purpose", func(t *testing.T) {
+		_, err := maker.Open(PurposeOAuthConsent, sealed)
+		require.Error(t, err)
+	})
+	t.Run("tampered", func(t *testing.T) {
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+		require.NoError(t, err)
+		b[len(b)-1] ^= 1
+		_, err = maker.Open(PurposeTOTPSecret, sealedPrefix+base64.RawURLEncoding.EncodeToString(b))
+		require.Error(t, err)
+	})
+	t.Run("unsealed legacy value", func(t *testing.T) {
+		require.False(t, IsSealed("JBSWY3DPEHPK3PXP"))
+		_, err := maker.Open(PurposeTOTPSecret, "JBSWY3DPEHPK3PXP")
+		require.Error(t, err)
+	})
+}
@@ -1,14 +1,166 @@
 package util
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
 
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords into self-describing strings: argon2id
+// hashes use the PHC string format and bcrypt hashes its modular crypt format,
+// so both record the algorithm and the parameters they were made with.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, hash string) error
+	// NeedsRehash reports whether hash was made with another algorithm or
+	// other parameters than the hasher uses now.
+	NeedsRehash(hash string) bool
+}
+
+var ErrPasswordMismatch = errors.New("password does not match")
+
+// defaultHasher is used for new hashes. Verification picks the algorithm
+// from the hash itself, so existing hashes keep working when it changes.
+var defaultHasher PasswordHasher = NewArgon2idHasher(DefaultArgon2idParams)
+
+// SetPasswordHasher changes the hasher used for new passwords. It is meant to
+// be called once at startup.
+func SetPasswordHasher(h PasswordHasher) {
+	defaultHasher = h
+}
 func HashPassword(password string) (string, error) {
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return defaultHasher.Hash(password)
+}
+func CheckPasswordHash(password, hash string) error {
+	h, err := hasherFor(hash)
+	if err != nil {
+		return err
+	}
+	return h.Verify(password, hash)
+}
+func NeedsRehash(hash string) bool {
+	return defaultHasher.NeedsRehash(hash)
+}
+func hasherFor(hash string) (PasswordHasher, error) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return &Argon2idHasher{}, nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return &BcryptHasher{}, nil
+	}
+	return nil, fmt.Errorf("unknown password hash format")
+}
+
+type Argon2idParams struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+type Argon2idHasher struct {
+	params Argon2idParams
+}
+
+func NewArgon2idHasher(params Argon2idParams) *Argon2idHasher {
+	return &Argon2idHasher{params: params}
+}
+func (a *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, a.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	p := a.params
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+func (a *Argon2idHasher) Verify(password, hash string) error {
+	p, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+func (a *Argon2idHasher) NeedsRehash(hash string) bool {
+	p, _, _, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return p != a.params
+}
+
+// decodeArgon2id parses $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>.
+func decodeArgon2id(hash string) (Argon2idParams, []byte, []byte, error) {
+	var p Argon2idParams
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id key: %w", err)
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
+
+type BcryptHasher struct {
+	cost int
+}
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{cost: cost}
+}
+func (b *BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
 	if err != nil {
 		return "", err
 	}
 	return string(hashed), nil
 }
-func CheckPasswordHash(password, hash string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+func (b *BcryptHasher) Verify(password, hash string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+func (b *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost != b.cost
 }
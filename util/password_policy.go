@@ -0,0 +1,66 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DefaultMinPasswordLength = 8
+	// maxPasswordLength bounds the work a single hash can cause.
+	maxPasswordLength = 128
+)
+
+// PasswordPolicy decides whether a new password is strong enough.
+type PasswordPolicy struct {
+	minLength int
+	breached  map[string]struct{}
+}
+
+// NewPasswordPolicy loads the breached password list from breachedListPath,
+// one password per line. An empty path disables the breached password check.
+func NewPasswordPolicy(minLength int, breachedListPath string) (*PasswordPolicy, error) {
+	p := &PasswordPolicy{minLength: minLength, breached: map[string]struct{}{}}
+	if breachedListPath == "" {
+		return p, nil
+	}
+	f, err := os.Open(breachedListPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password list: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.breached[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read breached password list: %w", err)
+	}
+	return p, nil
+}
+
+// Validate returns an error that can be shown to the user when password is
+// not acceptable for the account with the given email.
+func (p *PasswordPolicy) Validate(password, email string) error {
+	n := utf8.RuneCountInString(password)
+	if n < p.minLength {
+		return fmt.Errorf("password must be at least %d characters long", p.minLength)
+	}
+	if n > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d characters long", maxPasswordLength)
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		return fmt.Errorf("password must not be the email address")
+	}
+	if _, ok := p.breached[strings.ToLower(password)]; ok {
+		return fmt.Errorf("password appears in a list of breached passwords, please choose another one")
+	}
+	return nil
+}
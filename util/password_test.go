@@ -0,0 +1,40 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2idHasher(t *testing.T) {
+	params := Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	h := NewArgon2idHasher(params)
+
+	hash, err := h.Hash("correct horse")
+	require.NoError(t, err)
+	require.Regexp(t, `^\$argon2id\$v=19\$m=1024,t=1,p=1\$[A-Za-z0-9+/]+\$[A-Za-z0-9+/]+$`, hash)
+	require.NoError(t, h.Verify("correct horse", hash))
+	require.ErrorIs(t, h.Verify("wrong horse", hash), ErrPasswordMismatch)
+	require.False(t, h.NeedsRehash(hash))
+
+	params.Iterations = 2
+	require.True(t, NewArgon2idHasher(params).NeedsRehash(hash))
+}
+
+func TestCheckPasswordHashDetectsAlgorithm(t *testing.T) {
+	argon := NewArgon2idHasher(Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	SetPasswordHasher(argon)
+	defer SetPasswordHasher(NewArgon2idHasher(DefaultArgon2idParams))
+
+	legacy, err := NewBcryptHasher(bcrypt.MinCost).Hash("secret password")
+	require.NoError(t, err)
+	require.NoError(t, CheckPasswordHash("secret password", legacy))
+	require.Error(t, CheckPasswordHash("other password", legacy))
+	require.True(t, NeedsRehash(legacy))
+
+	hash, err := HashPassword("secret password")
+	require.NoError(t, err)
+	require.NoError(t, CheckPasswordHash("secret password", hash))
+	require.False(t, NeedsRehash(hash))
+}